@@ -0,0 +1,227 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archive reads the files inside zip, jar and tar archives,
+// so that they can be indexed and searched like other files.
+//
+// A file inside an archive has a virtual path: the path of the
+// archive, then Sep, then the slash-separated name of the file in
+// the archive, as in lib/foo.jar!/com/x/Y.java.  Archives inside
+// archives are not read.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Sep separates the path of an archive from the name of a file
+// inside it in a virtual path.
+const Sep = "!/"
+
+// A format is a kind of archive.
+type format int
+
+const (
+	none format = iota
+	zipFormat
+	tarFormat
+	tgzFormat
+)
+
+// formatOf returns the format of the archive with the given name,
+// judging by its extension.
+func formatOf(name string) format {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"), strings.HasSuffix(lower, ".jar"):
+		return zipFormat
+	case strings.HasSuffix(lower, ".tar"):
+		return tarFormat
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return tgzFormat
+	}
+	return none
+}
+
+// Is reports whether name is the name of an archive that the
+// package can read, judging by its extension.
+func Is(name string) bool {
+	return formatOf(name) != none
+}
+
+// Split splits the virtual path name into the path of the archive
+// and the name of the file inside it.  It reports false if name is
+// not a virtual path.
+func Split(name string) (arch, member string, ok bool) {
+	for i := 0; ; {
+		j := strings.Index(name[i:], Sep)
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		if Is(name[:i]) {
+			return name[:i], name[i+len(Sep):], true
+		}
+		i++
+	}
+}
+
+// Join returns the virtual path of the file member of the archive arch.
+func Join(arch, member string) string {
+	return arch + Sep + member
+}
+
+// cleanName returns the name of a file in an archive in the form
+// used in virtual paths: without a leading / or ./, or any .. that
+// would lead outside the archive.
+func cleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// WalkFunc is called by Walk for each file in an archive, with its
+// name in the archive and its info.  The file's contents can be read
+// from r until WalkFunc returns.  If WalkFunc returns an error, Walk
+// stops and returns it.
+type WalkFunc func(name string, info os.FileInfo, r io.Reader) error
+
+// Walk calls fn for each regular file in the archive arch, in the
+// order in which they appear in the archive.
+func Walk(arch string, fn WalkFunc) error {
+	switch formatOf(arch) {
+	case zipFormat:
+		z, err := zip.OpenReader(arch)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		for _, zf := range z.File {
+			if !zf.Mode().IsRegular() {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %v", Join(arch, zf.Name), err)
+			}
+			err = fn(cleanName(zf.Name), zf.FileInfo(), r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case tarFormat, tgzFormat:
+		f, t, err := openTar(arch)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		for {
+			h, err := t.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", arch, err)
+			}
+			if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+				continue
+			}
+			if err := fn(cleanName(h.Name), h.FileInfo(), t); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("%s: not an archive", arch)
+}
+
+// openTar opens the tar archive arch, decompressing it if need be.
+func openTar(arch string) (*os.File, *tar.Reader, error) {
+	f, err := os.Open(arch)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r io.Reader = f
+	if formatOf(arch) == tgzFormat {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: %v", arch, err)
+		}
+		r = z
+	}
+	return f, tar.NewReader(r), nil
+}
+
+// Open opens the file with the given name, which may be a virtual
+// path.  The first file in the archive with the name is opened.
+func Open(name string) (io.ReadCloser, error) {
+	arch, member, ok := Split(name)
+	if !ok {
+		return os.Open(name)
+	}
+	switch formatOf(arch) {
+	case zipFormat:
+		z, err := zip.OpenReader(arch)
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range z.File {
+			if zf.Mode().IsRegular() && cleanName(zf.Name) == member {
+				r, err := zf.Open()
+				if err != nil {
+					z.Close()
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				return &zipFile{r, z}, nil
+			}
+		}
+		z.Close()
+	case tarFormat, tgzFormat:
+		f, t, err := openTar(arch)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			h, err := t.Next()
+			if err != nil {
+				f.Close()
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("%s: %v", arch, err)
+			}
+			if (h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA) && cleanName(h.Name) == member {
+				return &tarFile{t, f}, nil
+			}
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// A zipFile is a file opened in a zip archive.
+type zipFile struct {
+	io.ReadCloser
+	z *zip.ReadCloser
+}
+
+func (f *zipFile) Close() error {
+	f.ReadCloser.Close()
+	return f.z.Close()
+}
+
+// A tarFile is a file opened in a tar archive.
+type tarFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (f *tarFile) Close() error {
+	return f.f.Close()
+}
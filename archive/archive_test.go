@@ -0,0 +1,175 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFiles are the files written to the test archives, in order.
+var testFiles = []struct {
+	name, data string
+}{
+	{"com/x/Y.java", "class Y {}\n"},
+	{"./README", "read me\n"},
+	{"/abs/../z.txt", "zed\n"},
+	{"README", "again\n"},
+}
+
+// writeZip writes the test files to the zip archive file.
+func writeZip(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	if _, err := z.Create("com/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tf := range testFiles {
+		w, err := z.Create(tf.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, tf.data)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+// writeTar writes the test files to the tar archive file,
+// compressing it if gz is true.
+func writeTar(t *testing.T, file string, gz bool) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "com/", Typeflag: tar.TypeDir, Mode: 0777})
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "README"})
+	for _, tf := range testFiles {
+		tw.WriteHeader(&tar.Header{Name: tf.name, Typeflag: tar.TypeReg, Mode: 0666, Size: int64(len(tf.data))})
+		io.WriteString(tw, tf.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		zw.Close()
+	}
+	f.Close()
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.zip", "b.JAR", "c.tar", "d.tar.gz", "e.tgz"} {
+		file := filepath.Join(dir, name)
+		switch formatOf(name) {
+		case zipFormat:
+			writeZip(t, file)
+		case tarFormat:
+			writeTar(t, file, false)
+		case tgzFormat:
+			writeTar(t, file, true)
+		}
+
+		var got []string
+		err := Walk(file, func(member string, info os.FileInfo, r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if info.Size() != int64(len(data)) {
+				t.Errorf("%s: size %d, read %d bytes", Join(file, member), info.Size(), len(data))
+			}
+			got = append(got, member+"="+strings.TrimSpace(string(data)))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Walk(%s): %v", name, err)
+		}
+		want := "com/x/Y.java=class Y {} README=read me z.txt=zed README=again"
+		if strings.Join(got, " ") != want {
+			t.Errorf("Walk(%s) = %q, want %q", name, strings.Join(got, " "), want)
+		}
+
+		for _, tt := range []struct{ member, data string }{
+			{"com/x/Y.java", "class Y {}\n"},
+			{"README", "read me\n"}, // the first one
+			{"z.txt", "zed\n"},
+			{"com", ""},
+			{"link", ""},
+			{"missing", ""},
+		} {
+			r, err := Open(Join(file, tt.member))
+			if tt.data == "" {
+				if err == nil {
+					r.Close()
+					t.Errorf("Open(%s!/%s) succeeded", name, tt.member)
+				} else if !os.IsNotExist(err) {
+					t.Errorf("Open(%s!/%s): %v, want not exist", name, tt.member, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Open(%s!/%s): %v", name, tt.member, err)
+				continue
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(data) != tt.data {
+				t.Errorf("Open(%s!/%s) read %q, %v, want %q", name, tt.member, data, err, tt.data)
+			}
+		}
+	}
+
+	// Ordinary files open as usual.
+	plain := filepath.Join(dir, "x!/y")
+	os.Mkdir(filepath.Join(dir, "x!"), 0777)
+	ioutil.WriteFile(plain, []byte("plain"), 0666)
+	if r, err := Open(plain); err != nil {
+		t.Errorf("Open(%s): %v", plain, err)
+	} else {
+		r.Close()
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tt := range []struct {
+		name, arch, member string
+	}{
+		{"lib/foo.jar!/com/x/Y.java", "lib/foo.jar", "com/x/Y.java"},
+		{"a!/b.zip!/c!/d", "a!/b.zip", "c!/d"},
+		{"a.tar.gz!/b", "a.tar.gz", "b"},
+		{"a.zip", "", ""},
+		{"a!/b", "", ""},
+		{"a.txt!/b", "", ""},
+	} {
+		arch, member, ok := Split(tt.name)
+		if arch != tt.arch || member != tt.member || ok != (tt.arch != "") {
+			t.Errorf("Split(%q) = %q, %q, %v, want %q, %q", tt.name, arch, member, ok, tt.arch, tt.member)
+		}
+	}
+}
@@ -7,16 +7,21 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strings"
 
+	"github.com/waddyano/codesearch/archive"
+	"github.com/waddyano/codesearch/git"
+	"github.com/waddyano/codesearch/ignore"
 	"github.com/waddyano/codesearch/index"
 )
 
@@ -25,6 +30,9 @@ const (
 	DEFAULT_MAX_LINE_LENGTH             = 2000
 	DEFAULT_MAX_TEXT_TRIGRAMS           = 30000
 	DEFAULT_MAX_INVALID_UTF8_PERCENTAGE = 0.1
+	DEFAULT_POST_BUF_MB                 = 64
+	DEFAULT_MAX_SPILL_FILES             = 64
+	DEFAULT_MAX_READERS                 = 8
 )
 
 var usageMessage = `usage: cindex [options] [path...]
@@ -33,14 +41,47 @@ Options:
 
   -verbose     print extra information
   -list        list indexed paths and exit
+  -check       check the index for corruption and exit
+  -remove      remove the named paths from the index and exit
+  -compact     rewrite the index without removed or replaced files and exit
   -reset       discard existing index
   -indexpath FILE
                use specified FILE as the index path. Overrides $CSEARCHINDEX.
+  -shard NAME  use the shard NAME of the index set directory named by the
+               index path
   -cpuprofile FILE
                write CPU profile to FILE
   -logskip     print why a file was skipped from indexing
   -no-follow-symlinks
                do not follow symlinked files and directories
+  -canonical-symlinks
+               index a file reached through symlinks once, under its real
+               path if that is in a path being indexed and otherwise under
+               the first path that leads to it in walk order, instead of
+               under every path that leads to it
+  -no-ignore   index the files that .gitignore, .ignore and .csearchignore
+               files say to ignore
+  -xdev        do not walk directories on other file systems than the
+               path being indexed
+  -maxdepth N  index only the files up to N levels below the path being
+               indexed, 1 being the files in it; 0 means no limit
+  -skip-dotfiles
+               skip files whose names begin with a dot
+  -skip-dotdirs
+               skip directories whose names begin with a dot
+  -maxfiles COUNT
+               index at most COUNT files of each path, warning if it
+               has more; 0 means no limit
+  -archives    index the files inside zip, jar, tar and tar.gz files
+  -store       store the contents of the indexed files in the index,
+               compressed, for csearch -stored
+  -rev REVS    index the revisions REVS, separated by commas, of the git
+               repositories named by the paths instead of their files
+  -walkers COUNT
+               read up to COUNT directories at once while walking the
+               file trees (Default: 16)
+  -j COUNT     read up to COUNT files at once, each taking 64MB for its
+               trigram set (Default: the number of CPUs, at most %v)
   -maxFileLen BYTES
                skip indexing a file if longer than this size in bytes (Default: %v)
   -maxlinelen BYTES
@@ -53,6 +94,19 @@ Options:
                path to file containing a list of file patterns to exclude from indexing
   -filelist FILE
                path to file containing a list of file paths to index
+  -rules FILE  path to file containing include and exclude rules, one per
+               line, matched against paths relative to the indexed root
+  -rule RULE   add the include or exclude rule RULE after those from -rules;
+               may be repeated
+  -postbuf MB  hold up to MB megabytes of index entries in memory before
+               sorting them and writing them to a temporary file; sorting
+               takes as much again (Default: %v)
+  -tmpdir DIR  write temporary files, also those of merging the new
+               entries into the index and of -compact, to DIR instead of
+               the default directory for temporary files
+  -maxspill COUNT
+               merge some of the temporary files into one whenever there
+               are COUNT of them; 0 means never (Default: %v)
 
 cindex prepares the trigram index for use by csearch.  The index is the
 file named by $CSEARCHINDEX, or else $HOME/.csearchindex.
@@ -73,30 +127,136 @@ or, equivalently:
 
 If cindex is invoked with no paths, it reindexes the paths that have
 already been added, in case the files have changed.  Thus, 'cindex' by
-itself is a useful command to run in a nightly cron job.
+itself is a useful command to run in a nightly cron job.  Files whose
+modification time and size have not changed since they were indexed
+are not read again; use -reset to force them to be.
+
+cindex records with each path the options that decide which of its
+files are indexed: -exclude, -rules, -rule, -no-follow-symlinks,
+-canonical-symlinks, -no-ignore, -xdev, -maxdepth, -skip-dotfiles,
+-skip-dotdirs, -maxfiles, -archives and the limits on file contents.
+Reindexing a path uses them again, so that 'cindex' with no paths
+indexes each path as it was first indexed.  The options given on the
+command line replace the recorded ones of the paths named there, so
+to change them for a single path, index it again with the new options:
+
+	cindex -maxlinelen 5000 $HOME/src
+
+With no paths, cindex ignores those options and reindexes every path
+with its recorded ones.
+
+A symlink to a directory that holds it, directly or through other
+symlinks, would make the walk go round in circles; cindex does not
+follow it, and -logskip reports it once.  Nor does it walk a directory
+of a path a second time through another symlink to it.  The files
+reached through other symlinks are indexed under each path that leads
+to them.  With -canonical-symlinks, cindex does not follow a symlink to
+a file or directory in one of the paths being indexed, which is indexed
+under its real path instead, and indexes a file outside all of them
+only once, under the first path to it in walk order, so that the names
+stay in the order the index keeps them in; that also indexes files with
+several hard links once.
+
+With -archives, cindex indexes the text files inside zip, jar, tar and
+tar.gz files (but not inside archives inside them) under virtual paths
+such as lib/foo.jar!/com/x/Y.java, which csearch searches like other
+paths.  The archives are read again each time they are indexed.
+
+With -rev, each path names a git repository, bare or not, and cindex
+indexes the files of each revision in REVS (branches, tags or commits)
+from the repository's object store, without a checkout, under virtual
+paths such as /srv/foo.git@main:src/x.go.  The path recorded in the
+index is /srv/foo.git@main:, which can also be given instead of -rev
+and a path; /srv/foo.git@main:src indexes only the files in the src
+directory.  Reindexing it reads the revision again, following a branch
+as it moves.  The commit indexed is recorded with the path, and csearch
+reads the files back from it in the repository, so that they are
+searched as they were indexed.
+
+Files with the same content, such as a file in several revisions,
+share their entry in the index: its trigrams are recorded once, and
+a search that finds one finds them all.  Files indexed separately
+share it only once they are indexed together again, as 'cindex'
+with no paths does.
+
+With -store, cindex also stores the content of each indexed file in
+the index, compressed, so that csearch -stored can search the files as
+they were when they were indexed, even if they have since changed or
+gone.  Once an index stores contents, updating it goes on storing
+them; -reset without -store stops.
+
+cindex -list prints after each path the options that differ from the
+defaults.  -reset discards the recorded options.
 
 By default cindex adds the named paths to the index but preserves
 information about other paths that might already be indexed
 (the ones printed by cindex -list).  The -reset flag causes cindex to
 delete the existing index before indexing the new paths.
 With no path arguments, cindex -reset removes the index.
+
+The index path may instead name an index set directory, which holds
+several index files ("shards"), each named NAME.csi, that csearch searches
+together.  The -shard flag selects the shard that cindex updates, creating
+it if need be, and leaves the others alone:
+
+	cindex -indexpath ~/csearch -shard team1 /src/team1
+	cindex -indexpath ~/csearch -shard team2 /src/team2
+
+Where shards cover the same paths, csearch takes the files under them
+from the shard whose name sorts last.
+
+While walking the trees, cindex skips the files and directories that
+.gitignore files, .git/info/exclude, .ignore files and .csearchignore
+files ignore, following the rules of git; -no-ignore turns this off.
+
+The -rules and -rule flags give include and exclude rules, which match
+paths relative to the root being indexed.  The last rule that matches a
+path decides; a glob ending in / matches directories, which are then not
+walked, and re: introduces a regular expression.  For example:
+
+	cindex -rule 'exclude **' -rule 'include services/**/*.go' \
+		-rule 'exclude third_party/**/test/' $HOME/src
+
+The -remove flag causes cindex to remove the named files, and the files
+in the named directories, from the index without reading any files.
+They are left out of search results at once and dropped from the index
+for good the next time cindex updates it, or when cindex -compact
+rewrites it.
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage, DEFAULT_MAX_FILE_LENGTH, DEFAULT_MAX_LINE_LENGTH, DEFAULT_MAX_TEXT_TRIGRAMS, DEFAULT_MAX_INVALID_UTF8_PERCENTAGE)
+	fmt.Fprintf(os.Stderr, usageMessage, DEFAULT_MAX_READERS, DEFAULT_MAX_FILE_LENGTH, DEFAULT_MAX_LINE_LENGTH, DEFAULT_MAX_TEXT_TRIGRAMS, DEFAULT_MAX_INVALID_UTF8_PERCENTAGE,
+		DEFAULT_POST_BUF_MB, DEFAULT_MAX_SPILL_FILES)
 	os.Exit(2)
 }
 
 var (
 	listFlag             = flag.Bool("list", false, "list indexed paths and exit")
+	checkFlag            = flag.Bool("check", false, "check the index for corruption and exit")
+	removeFlag           = flag.Bool("remove", false, "remove the named paths from the index and exit")
+	compactFlag          = flag.Bool("compact", false, "rewrite the index without removed or replaced files and exit")
+	shardFlag            = flag.String("shard", "", "update the named shard of the index set directory")
 	resetFlag            = flag.Bool("reset", false, "discard existing index")
 	verboseFlag          = flag.Bool("verbose", false, "print extra information")
 	cpuProfile           = flag.String("cpuprofile", "", "write cpu profile to this file")
 	indexPath            = flag.String("indexpath", "", "specifies index path")
 	logSkipFlag          = flag.Bool("logskip", false, "print why a file was skipped from indexing")
 	noFollowSymlinksFlag = flag.Bool("no-follow-symlinks", false, "do not follow symlinked files and directories")
+	canonicalSymlinks    = flag.Bool("canonical-symlinks", false, "index a file reached through symlinks once, under its real path")
+	noIgnoreFlag         = flag.Bool("no-ignore", false, "do not skip files ignored by .gitignore, .ignore and .csearchignore files")
+	xdevFlag             = flag.Bool("xdev", false, "do not walk directories on other file systems")
+	maxDepth             = flag.Int("maxdepth", 0, "index only the files up to this many levels below the path")
+	skipDotFiles         = flag.Bool("skip-dotfiles", false, "skip files whose names begin with a dot")
+	skipDotDirs          = flag.Bool("skip-dotdirs", false, "skip directories whose names begin with a dot")
+	maxFiles             = flag.Int("maxfiles", 0, "index at most this many files of each path")
+	archivesFlag         = flag.Bool("archives", false, "index the files inside zip, jar, tar and tar.gz files")
+	storeFlag            = flag.Bool("store", false, "store the contents of the indexed files in the index")
+	revFlag              = flag.String("rev", "", "index these comma-separated revisions of the git repositories named by the paths")
+	walkers              = flag.Int("walkers", 16, "read up to this many directories at once")
+	readers              = flag.Int("j", 0, "read up to this many files at once")
 	exclude              = flag.String("exclude", "", "path to file containing a list of file patterns to exclude from indexing")
 	fileList             = flag.String("filelist", "", "path to file containing a list of file paths to index")
+	rulesFile            = flag.String("rules", "", "path to file containing include and exclude rules")
 	// Tuning variables for detecting text files.
 	// A file is assumed not to be text files (and thus not indexed) if
 	// 1) if it contains an invalid UTF-8 sequences
@@ -109,23 +269,170 @@ var (
 	maxTextTrigrams     = flag.Int("maxtrigrams", DEFAULT_MAX_TEXT_TRIGRAMS, "skip indexing a file if it has more than this number of trigrams")
 	maxInvalidUTF8Ratio = flag.Float64("maxinvalidutf8ratio", DEFAULT_MAX_INVALID_UTF8_PERCENTAGE, "skip indexing a file if it has more than this ratio of invalid UTF-8 sequences")
 
+	// Resources for building the index.
+	postBufMB     = flag.Int("postbuf", DEFAULT_POST_BUF_MB, "hold up to this many megabytes of index entries in memory")
+	tmpDir        = flag.String("tmpdir", "", "directory for temporary files")
+	maxSpillFiles = flag.Int("maxspill", DEFAULT_MAX_SPILL_FILES, "merge temporary files when there are this many")
+
+	// Patterns of names excluded in every root.
 	excludePatterns = []string{
 		".csearchindex",
 	}
+
+	// The rules given by -rule.
+	ruleFlags []string
 )
 
+func init() {
+	flag.Var(ruleFlag{}, "rule", "add an include or exclude rule")
+}
+
+// A ruleFlag collects the -rule flags in ruleFlags.
+type ruleFlag struct{}
+
+func (ruleFlag) String() string { return "" }
+
+func (ruleFlag) Set(rule string) error {
+	if err := new(ignore.Rules).Add(rule); err != nil {
+		return err
+	}
+	ruleFlags = append(ruleFlags, rule)
+	return nil
+}
+
 type walkStats struct {
 	nFiles       int
 	nDirectories int
 	nSkipped     int
 	extCounts    map[string]int
+
+	files  map[fileID]string // files sent to index, with -canonical-symlinks
+	cycles map[string]bool   // symlinks reported as making cycles
+	dirs   map[fileID]string // directories of the root walked through symlinks
+	roots  []rootPath        // the paths being indexed, for -canonical-symlinks
+
+	rootFiles int  // files of the current root sent to index
+	full      bool // whether the root has more than -maxfiles files
+}
+
+// A rootPath is a path being indexed and the path it resolves to.
+type rootPath struct {
+	name, real string
+}
+
+// rootName returns the name under one of the paths being indexed
+// of the file or directory whose real path is p, if it is in one.
+func (s *walkStats) rootName(p string) (string, bool) {
+	for _, r := range s.roots {
+		rel, err := filepath.Rel(r.real, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return filepath.Join(r.name, rel), true
+		}
+	}
+	return "", false
+}
+
+// errMaxFiles stops the walk of a root with more than -maxfiles files.
+var errMaxFiles = errors.New("too many files")
+
+// A fileID identifies a file by device and inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// ancestors returns the fileIDs of anc followed by those of
+// the directories from dir up to arg, which holds dir.
+func ancestors(anc []fileID, arg, dir string) []fileID {
+	ids := append([]fileID(nil), anc...)
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if fi, err := os.Stat(d); err == nil {
+			if id, ok := getFileID(d, fi); ok {
+				ids = append(ids, id)
+			}
+		}
+		if len(d) <= len(arg) || filepath.Dir(d) == d {
+			return ids
+		}
+	}
+}
+
+// hasID reports whether id is one of ids.
+func hasID(ids []fileID, id fileID) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
 }
 
-func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan struct {
+// enterDir returns the ignore.Matcher for the subdirectory elem
+// of the directory of m, whose files are in dir, logging any error
+// reading its ignore files.
+func enterDir(m *ignore.Matcher, elem, dir string) *ignore.Matcher {
+	m, err := m.Enter(elem, dir)
+	if err != nil {
+		log.Print(err)
+	}
+	return m
+}
+
+// dirWalker reads the directories for walk.
+var dirWalker *walker
+
+// walk walks the tree rooted at arg, sending the files to index to out.
+// If pre is not nil, it is the result of dirWalker.prefetch(arg).
+// Opts are the options of the indexed root, root, which is arg unless
+// arg is the target of a symlink under root, found at symlinkFrom;
+// rules match the paths relative to it.  If ign is not nil, it is the
+// ignore.Matcher for arg, and walk skips the files and directories
+// it ignores.  Anc holds the fileIDs of the directories through which
+// the walks of the enclosing symlinks reached arg; a symlink to one of
+// them, or to a directory between arg and the symlink, makes a cycle
+// and is not followed.
+func walk(rootNo int, root, arg string, pre *dirList, opts *rootOptions, ign *ignore.Matcher, anc []fileID, stats *walkStats, symlinkFrom string, out chan struct {
 	int
 	string
 }, logskip bool) {
-	filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+	// The Matcher of each directory visited.
+	ignoreDir := map[string]*ignore.Matcher{filepath.Clean(arg): ign}
+	// relPath returns the path of path as reached through symlinkFrom,
+	// and that path relative to the root, if it is below the root.
+	relPath := func(path string) (logical, rel string, inRoot bool) {
+		logical = path
+		if symlinkFrom != "" {
+			logical = symlinkFrom + path[len(arg):]
+		}
+		rel, err := filepath.Rel(root, logical)
+		return logical, rel, err == nil && rel != "."
+	}
+	// matchIgnore returns the Matcher of the directory holding path
+	// and whether it ignores path.
+	matchIgnore := func(path string, isDir bool) (*ignore.Matcher, bool) {
+		if ign == nil || path == arg {
+			return nil, false
+		}
+		m := ignoreDir[filepath.Dir(path)]
+		return m, m != nil && m.Match(filepath.Base(path), isDir)
+	}
+	// skip reports whether the walk function skips the directory at
+	// path, so that the walker need not read it ahead.  The directory
+	// holding it has been visited, so its Matcher is known.
+	skip := func(path string, info os.FileInfo) bool {
+		_, rel, inRoot := relPath(path)
+		if opts.excluded(filepath.Base(path)) {
+			return true
+		}
+		if inRoot && (opts.rules != nil && opts.rules.Excluded(filepath.ToSlash(rel), true) || opts.skipReason(rel, path, info) != "") {
+			return true
+		}
+		_, ignored := matchIgnore(path, true)
+		return ignored
+	}
+	dirWalker.Walk(arg, pre, skip, func(path string, info os.FileInfo, err error) error {
+		if stats.full {
+			return errMaxFiles
+		}
 		if info != nil && info.IsDir() {
 			stats.nDirectories++
 		} else {
@@ -135,16 +442,24 @@ func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan
 			log.Printf("scanned %d files, skipped %d", stats.nFiles, stats.nSkipped)
 		}
 		if basedir, elem := filepath.Split(path); elem != "" {
-			exclude := false
-			for _, pattern := range excludePatterns {
-				exclude, err = filepath.Match(pattern, elem)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if exclude {
-					break
+			logical, rel, inRoot := relPath(path)
+			exclude := opts.excluded(elem)
+			if !exclude && opts.rules != nil && inRoot {
+				exclude = opts.rules.Excluded(filepath.ToSlash(rel), info != nil && info.IsDir())
+			}
+			if inRoot && info != nil {
+				if why := opts.skipReason(rel, path, info); why != "" {
+					stats.nSkipped++
+					if logskip {
+						log.Printf("%s: skipped. %s", logical, why)
+					}
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
 				}
 			}
+			m, ignored := matchIgnore(path, info != nil && info.IsDir())
 
 			// Skip various temporary or "hidden" files or directories.
 			if info != nil && info.IsDir() {
@@ -159,6 +474,20 @@ func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan
 					}
 					return filepath.SkipDir
 				}
+				if ignored {
+					stats.nSkipped++
+					if logskip {
+						if symlinkFrom != "" {
+							log.Printf("%s: skipped. Ignored directory", symlinkFrom+path[len(arg):])
+						} else {
+							log.Printf("%s: skipped. Ignored directory", path)
+						}
+					}
+					return filepath.SkipDir
+				}
+				if m != nil {
+					ignoreDir[path] = enterDir(m, elem, path)
+				}
 			} else {
 				ext := filepath.Ext(path)
 				stats.extCounts[ext]++
@@ -173,8 +502,19 @@ func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan
 					}
 					return nil
 				}
+				if ignored {
+					stats.nSkipped++
+					if logskip {
+						if symlinkFrom != "" {
+							log.Printf("%s: skipped. Ignored file", symlinkFrom+path[len(arg):])
+						} else {
+							log.Printf("%s: skipped. Ignored file", path)
+						}
+					}
+					return nil
+				}
 				if info != nil && info.Mode()&os.ModeSymlink != 0 {
-					if *noFollowSymlinksFlag {
+					if opts.NoFollowSymlinks {
 						if logskip {
 							log.Printf("%s: skipped. Symlink", path)
 						}
@@ -189,15 +529,58 @@ func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan
 					if symlinkFrom != "" {
 						symlinkAs = symlinkFrom + symlinkAs[len(arg):]
 					}
-					if p, err := filepath.EvalSymlinks(symlinkAs); err != nil {
+					p, err := filepath.EvalSymlinks(symlinkAs)
+					if err != nil {
 						if symlinkFrom != "" {
 							log.Printf("%s: skipped. Symlink could not be resolved", symlinkFrom+path[len(arg):])
 						} else {
 							log.Printf("%s: skipped. Symlink could not be resolved", path)
 						}
-					} else {
-						walk(rootNo, p, stats, symlinkAs, out, logskip)
+						return nil
+					}
+					pa := anc
+					var dirID fileID
+					haveDirID := false
+					if pi, err := os.Stat(p); err == nil && pi.IsDir() {
+						pa = ancestors(anc, arg, basedir)
+						dirID, haveDirID = getFileID(p, pi)
+						if haveDirID && hasID(pa, dirID) {
+							// Report each symlink once, however
+							// many paths lead to it.
+							stats.nSkipped++
+							if logskip && !stats.cycles[path] {
+								stats.cycles[path] = true
+								log.Printf("%s: skipped. Symlink cycle to %s", symlinkAs, p)
+							}
+							return nil
+						}
+					}
+					if opts.CanonicalSymlinks {
+						// The walk of the path holding p
+						// finds it under its real name.
+						if name, ok := stats.rootName(p); ok {
+							stats.nSkipped++
+							if logskip {
+								log.Printf("%s: skipped. Symlink to %s", symlinkAs, name)
+							}
+							return nil
+						}
+					}
+					if haveDirID {
+						if first, dup := stats.dirs[dirID]; dup {
+							stats.nSkipped++
+							if logskip {
+								log.Printf("%s: skipped. Already walked as %s", symlinkAs, first)
+							}
+							return nil
+						}
+						stats.dirs[dirID] = symlinkAs
 					}
+					var pm *ignore.Matcher
+					if m != nil {
+						pm = enterDir(m, elem, p)
+					}
+					walk(rootNo, root, p, nil, opts, pm, pa, stats, symlinkAs, out, logskip)
 					return nil
 				}
 			}
@@ -212,17 +595,46 @@ func walk(rootNo int, arg string, stats *walkStats, symlinkFrom string, out chan
 		}
 		if info != nil {
 			if info.Mode()&os.ModeType == 0 {
-				if symlinkFrom == "" {
-					out <- struct {
-						int
-						string
-					}{rootNo, path}
-				} else {
-					out <- struct {
-						int
-						string
-					}{-1, symlinkFrom + path[len(arg):]}
+				name := path
+				if symlinkFrom != "" {
+					name = symlinkFrom + path[len(arg):]
 				}
+				if opts.CanonicalSymlinks {
+					// Path is the real path of the file.  If that
+					// is in a path being indexed, the file is
+					// indexed there.  Otherwise the walk finds
+					// the names in order, so the first name of the
+					// file is kept; the path it resolves to could
+					// sort before names already sent to the index.
+					if symlinkFrom != "" {
+						if real, ok := stats.rootName(path); ok {
+							stats.nSkipped++
+							if logskip {
+								log.Printf("%s: skipped. Indexed as %s", name, real)
+							}
+							return nil
+						}
+					}
+					if id, ok := getFileID(path, info); ok {
+						if first, dup := stats.files[id]; dup {
+							stats.nSkipped++
+							if logskip {
+								log.Printf("%s: skipped. Already indexed as %s", name, first)
+							}
+							return nil
+						}
+						stats.files[id] = name
+					}
+				}
+				if opts.MaxFiles > 0 && stats.rootFiles >= opts.MaxFiles {
+					stats.full = true
+					return errMaxFiles
+				}
+				stats.rootFiles++
+				out <- struct {
+					int
+					string
+				}{rootNo, name}
 			} else if !info.IsDir() {
 				if logskip {
 					if symlinkFrom != "" {
@@ -257,20 +669,98 @@ func main() {
 		}
 	}
 
+	master := index.File()
+	if *shardFlag != "" {
+		master = filepath.Join(master, *shardFlag+index.ShardExt)
+	}
+
 	if *listFlag {
-		master := index.File()
 		if stat, err := os.Stat(master); err != nil || stat == nil {
 			log.Fatal("Index " + master + " is not accessible")
-		} else if stat.IsDir() || !stat.Mode().IsRegular() {
-			log.Fatal("Index " + master + " must point to an index file")
+		} else if !stat.IsDir() && !stat.Mode().IsRegular() {
+			log.Fatal("Index " + master + " must point to an index file or set")
 		}
-		ix := index.Open(master)
-		for _, arg := range ix.Paths() {
+		ix, err := index.OpenSet(master)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := ix.PathOptions()
+		for i, arg := range ix.Paths() {
+			if f := parseOptions(arg, opts[i]).flags(); f != "" {
+				fmt.Printf("%s\t%s\n", arg, f)
+				continue
+			}
 			fmt.Printf("%s\n", arg)
 		}
 		return
 	}
 
+	if *checkFlag {
+		files, err := index.SetFiles(master)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bad := false
+		for _, file := range files {
+			problems, err := index.Verify(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, p := range problems {
+				fmt.Println(p)
+			}
+			if len(problems) > 0 {
+				fmt.Printf("%s: %d problems found\n", file, len(problems))
+				bad = true
+				continue
+			}
+			fmt.Printf("%s: ok\n", file)
+		}
+		if bad {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The rest of the modes update a single index file.
+	if stat, err := os.Stat(master); err == nil && stat.IsDir() {
+		log.Fatalf("%s is an index set; use -shard to choose the shard to update", master)
+	}
+
+	if *removeFlag {
+		if len(args) == 0 {
+			usage()
+		}
+		for i, arg := range args {
+			a, err := filepath.Abs(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			args[i] = a
+		}
+		n, err := index.Remove(master+"~", master, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Rename(master+"~", master); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("removed %d files", n)
+		return
+	}
+
+	if *compactFlag {
+		m := &index.Merger{TempDir: *tmpDir}
+		if err := m.MergeMany(master+"~", master); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Rename(master+"~", master); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("compacted %s", master)
+		return
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -282,7 +772,6 @@ func main() {
 	}
 
 	if *resetFlag && len(args) == 0 {
-		master := index.File()
 		stat, err := os.Stat(master)
 		if err != nil {
 			// does not exist so nothing to do
@@ -295,26 +784,6 @@ func main() {
 		log.Fatal("Invalid index path " + master)
 	}
 
-	if *exclude != "" {
-		var excludePath string
-		if (*exclude)[:2] == "~/" {
-			excludePath = filepath.Join(index.HomeDir(), (*exclude)[2:])
-		} else {
-			excludePath = *exclude
-		}
-		if *logSkipFlag {
-			log.Printf("Loading exclude patterns from %s", excludePath)
-		}
-		data, err := ioutil.ReadFile(excludePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		excludePatterns = append(excludePatterns, strings.Split(string(data), "\n")...)
-		for i, pattern := range excludePatterns {
-			excludePatterns[i] = strings.TrimSpace(pattern)
-		}
-	}
-
 	if *fileList != "" {
 		var fileListPath string
 		if (*fileList)[:2] == "~/" {
@@ -332,16 +801,59 @@ func main() {
 		args = append(args, strings.Split(string(data), "\n")...)
 	}
 
-	if len(args) == 0 {
-		ix := index.Open(index.File())
-		for _, arg := range ix.Paths() {
-			args = append(args, arg)
+	// With -rev, the paths are the git repositories to index.
+	if *revFlag != "" {
+		if len(args) == 0 {
+			usage()
+		}
+		var revArgs []string
+		for _, arg := range args {
+			if arg == "" {
+				continue
+			}
+			a, err := filepath.Abs(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !git.IsRepo(a) {
+				log.Fatalf("%s: not a git repository", arg)
+			}
+			for _, rev := range strings.Split(*revFlag, ",") {
+				if rev != "" {
+					revArgs = append(revArgs, git.Name(a, rev, ""))
+				}
+			}
+		}
+		args = revArgs
+	}
+
+	// The options given on the command line apply only to the
+	// paths named there, not to those of a plain reindex.
+	named := len(args) > 0
+
+	// The options with which each path was last indexed, and
+	// whether the index stores the contents of the files.
+	storedOptions := make(map[string]string)
+	storeContents := *storeFlag
+	if !*resetFlag {
+		if _, err := os.Stat(master); err == nil || len(args) == 0 {
+			ix := index.Open(master)
+			paths, opts := ix.Paths(), ix.PathOptions()
+			for i, p := range paths {
+				storedOptions[p] = opts[i]
+			}
+			if ix.HasContents() {
+				storeContents = true
+			}
+			if len(args) == 0 {
+				args = paths
+			}
+			ix.Close()
 		}
-		ix.Close()
 	}
 
 	// Translate paths to absolute paths so that we can
-	// generate the file list in sorted order.
+	// generate the file list in walk order.
 	for i, arg := range args {
 		a, err := filepath.Abs(arg)
 		if err != nil {
@@ -351,16 +863,22 @@ func main() {
 		}
 		args[i] = a
 	}
-	sort.Strings(args)
+	sort.Slice(args, func(i, j int) bool {
+		return index.ComparePaths(args[i], args[j]) < 0
+	})
 
 	for len(args) > 0 && args[0] == "" {
 		args = args[1:]
 	}
 
-	master := index.File()
 	if stat, err := os.Stat(master); err != nil {
 		// Does not exist.
 		*resetFlag = true
+		if *shardFlag != "" {
+			if err := os.MkdirAll(filepath.Dir(master), 0777); err != nil {
+				log.Fatal(err)
+			}
+		}
 	} else {
 		if stat != nil && (stat.IsDir() || !stat.Mode().IsRegular()) {
 			log.Fatal("Invalid index path " + master)
@@ -375,26 +893,109 @@ func main() {
 	ix := index.Create(file)
 	ix.Verbose = *verboseFlag
 	ix.LogSkip = *logSkipFlag
+	ix.Dedup = true
+	ix.StoreContents = storeContents
 	ix.MaxFileLen = *maxFileLen
 	ix.MaxLineLen = *maxLineLen
 	ix.MaxTextTrigrams = *maxTextTrigrams
 	ix.MaxInvalidUTF8Ratio = *maxInvalidUTF8Ratio
+	ix.PostBufSize = *postBufMB << 20
+	ix.TempDir = *tmpDir
+	ix.MaxSpillFiles = *maxSpillFiles
 	ix.AddPaths(args)
 
+	// Each path is indexed with the options it was indexed with
+	// before, replaced by those given on the command line if the
+	// path was named there.
+	setFlags := make(map[string]bool)
+	if named {
+		flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	}
+	opts := make([]*rootOptions, len(args))
+	gits := make([]*gitRoot, len(args))
+	sameLimits := true
+	for i, arg := range args {
+		stored, ok := storedOptions[arg]
+		o := parseOptions(arg, stored)
+		prev := o.limits()
+		o.setFlags(setFlags)
+		if err := o.load(arg, *logSkipFlag); err != nil {
+			log.Fatal(err)
+		}
+		if ok && o.limits() != prev {
+			sameLimits = false
+		}
+		opts[i] = o
+		gits[i] = newGitRoot(arg)
+		o.Commit = ""
+		if gits[i] != nil {
+			o.Commit = gits[i].commit
+		}
+		ix.SetRootLimits(i, o.limits())
+		ix.SetPathOptions(arg, o.String())
+	}
+
+	// Files that have not changed since they were last indexed
+	// are not read again.  Their trigrams are copied from the
+	// existing index, so check that it is intact first.  If the
+	// limits on what files to index have changed, every file
+	// must be read again.
+	var old *index.Index
+	switch {
+	case *resetFlag:
+	case !sameLimits:
+		log.Printf("limits changed; reading all files again")
+	default:
+		var err error
+		old, err = index.OpenChecked(master)
+		if err != nil {
+			log.Fatalf("%v; use -reset to rebuild the index", err)
+		}
+		ix.Reuse(old)
+	}
+
 	walkChan := make(chan struct {
 		int
 		string
 	}, 10000)
 	doneChan := make(chan bool)
 
+	// The files are read in parallel but added to the
+	// index in the order in which the walk finds them.
+	// Each reader has a 64MB trigram set, so without -j
+	// there are no more than DEFAULT_MAX_READERS.
+	nReaders := *readers
+	if nReaders <= 0 {
+		nReaders = runtime.GOMAXPROCS(0)
+		if nReaders > DEFAULT_MAX_READERS {
+			nReaders = DEFAULT_MAX_READERS
+		}
+	}
+	adder := ix.NewAdder(nReaders)
+	nProcessed := 0
+	nAdded := 0
+	adder.Done = func(name string, added bool) {
+		if added {
+			nAdded++
+		}
+		nProcessed++
+		if nProcessed%10000 == 0 {
+			log.Printf("added %d/%d files", nAdded, nProcessed)
+		}
+	}
+
 	go func() {
 		seen := make(map[string]bool)
-		nProcessed := 0
-		nAdded := 0
 		for {
 			rootAndPath := <-walkChan
 			path := rootAndPath.string
 			if path == "" {
+				adder.Wait()
+				for _, g := range gits {
+					if g != nil {
+						g.close()
+					}
+				}
 				log.Printf("added %d/%d files", nAdded, nProcessed)
 				doneChan <- true
 				return
@@ -402,12 +1003,14 @@ func main() {
 
 			if !seen[path] {
 				seen[path] = true
-				if ix.AddFile(rootAndPath.int, path) {
-					nAdded++
-				}
-				nProcessed++
-				if nProcessed%10000 == 0 {
-					log.Printf("added %d/%d files", nAdded, nProcessed)
+				if g := gits[rootAndPath.int]; g != nil {
+					if data, ok := g.read(path); ok {
+						adder.AddData(rootAndPath.int, path, data)
+					}
+				} else if opts[rootAndPath.int].Archives && archive.Is(path) {
+					adder.AddArchive(rootAndPath.int, path)
+				} else {
+					adder.AddFile(rootAndPath.int, path)
 				}
 			}
 		}
@@ -415,10 +1018,44 @@ func main() {
 
 	var stats walkStats
 	stats.extCounts = make(map[string]int)
+	stats.files = make(map[fileID]string)
+	stats.cycles = make(map[string]bool)
+	for i, arg := range args {
+		if gits[i] == nil {
+			if real, err := filepath.EvalSymlinks(arg); err == nil {
+				stats.roots = append(stats.roots, rootPath{arg, real})
+			}
+		}
+	}
 
+	// The roots are walked one after another, but the
+	// directories are read in parallel, starting with the roots.
+	dirWalker = newWalker(*walkers)
+	pre := make([]*dirList, len(args))
+	for i, arg := range args {
+		if gits[i] == nil {
+			pre[i] = dirWalker.prefetch(arg)
+		}
+	}
 	for i, arg := range args {
 		log.Printf("index %s", arg)
-		walk(i, arg, &stats, "", walkChan, *logSkipFlag)
+		stats.rootFiles, stats.full = 0, false
+		stats.dirs = make(map[fileID]string)
+		if gits[i] != nil {
+			gits[i].walk(i, opts[i], &stats, walkChan, *logSkipFlag)
+		} else {
+			var ign *ignore.Matcher
+			if !opts[i].NoIgnore {
+				var err error
+				if ign, err = ignore.New(arg); err != nil {
+					log.Print(err)
+				}
+			}
+			walk(i, arg, arg, pre[i], opts[i], ign, nil, &stats, "", walkChan, *logSkipFlag)
+		}
+		if stats.full {
+			log.Printf("%s: warning: indexed only the first %d files (-maxfiles)", arg, opts[i].MaxFiles)
+		}
 	}
 	log.Printf("walk done %d files %d directories, %d skipped", stats.nFiles, stats.nDirectories, stats.nSkipped)
 
@@ -439,12 +1076,22 @@ func main() {
 	}{-1, ""}
 	<-doneChan
 	log.Printf("flush index")
-	ix.Flush()
+	if err := ix.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if old != nil {
+		log.Printf("reused %d unchanged files", ix.NumReused())
+		old.Close()
+	}
 
 	if !*resetFlag {
 		log.Printf("merge %s %s", master, file)
-		index.Merge(file+"~", master, file)
+		m := &index.Merger{TempDir: *tmpDir}
+		err := m.Merge(file+"~", master, file)
 		os.Remove(file)
+		if err != nil {
+			log.Fatal(err)
+		}
 		os.Remove(master)
 		if err := os.Rename(file+"~", master); err != nil {
 			log.Fatalf("failed to merge indexes: %s", err)
@@ -0,0 +1,253 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/waddyano/codesearch/index"
+)
+
+// makeTree creates the files and symlinks described by tree under dir.
+// Each entry is a slash-separated name mapped to the file's content,
+// or to "-> target" for a symlink or "= name" for a hard link.
+// The files are created before the links.
+func makeTree(t *testing.T, dir string, tree map[string]string) {
+	t.Helper()
+	var names []string
+	for name := range tree {
+		names = append(names, name)
+	}
+	isLink := func(data string) bool {
+		return strings.HasPrefix(data, "-> ") || strings.HasPrefix(data, "= ")
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return !isLink(tree[names[i]]) && isLink(tree[names[j]])
+	})
+	for _, name := range names {
+		data := tree[name]
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(data, "-> "):
+			err = os.Symlink(filepath.FromSlash(data[3:]), file)
+		case strings.HasPrefix(data, "= "):
+			err = os.Link(filepath.Join(dir, filepath.FromSlash(data[2:])), file)
+		default:
+			err = ioutil.WriteFile(file, []byte(data), 0666)
+		}
+		if err != nil {
+			t.Skipf("cannot create test tree: %v", err)
+		}
+	}
+}
+
+// walkRoot walks root with the given options and returns
+// the names of the files it would index, and the walk stats.
+func walkRoot(t *testing.T, root string, opts *rootOptions) ([]string, *walkStats) {
+	t.Helper()
+	if err := opts.load(root, false); err != nil {
+		t.Fatal(err)
+	}
+	stats := &walkStats{
+		extCounts: make(map[string]int),
+		files:     make(map[fileID]string),
+		cycles:    make(map[string]bool),
+		dirs:      make(map[fileID]string),
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		stats.roots = []rootPath{{root, real}}
+	}
+	out := make(chan struct {
+		int
+		string
+	})
+	dirWalker = newWalker(4)
+	go func() {
+		walk(0, root, root, nil, opts, nil, nil, stats, "", out, true)
+		close(out)
+	}()
+	var names []string
+	for f := range out {
+		names = append(names, f.string)
+	}
+	return names, stats
+}
+
+// relNames returns names relative to dir, slash-separated.
+func relNames(dir string, names []string) string {
+	var rel []string
+	for _, name := range names {
+		r, err := filepath.Rel(dir, name)
+		if err != nil {
+			r = name
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return strings.Join(rel, " ")
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// EvalSymlinks resolves the temporary directory too.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		tree      map[string]string
+		root      string // the directory of the tree to walk, if not all of it
+		canonical bool
+		want      string
+		cycles    string
+	}{
+		{
+			// The link sorts before the file it leads to, and
+			// before a file that sorts before that.
+			tree: map[string]string{
+				"a/link": "-> ../z",
+				"m.txt":  "m",
+				"z/f":    "f",
+			},
+			want: "a/link/f m.txt z/f",
+		},
+		{
+			tree: map[string]string{
+				"a/link": "-> ../z",
+				"m.txt":  "m",
+				"z/f":    "f",
+			},
+			canonical: true,
+			want:      "m.txt z/f",
+		},
+		{
+			// Links to the same file, and a hard link to it.
+			tree: map[string]string{
+				"x.txt": "x",
+				"l1":    "-> x.txt",
+				"l2":    "-> x.txt",
+				"h.txt": "= x.txt",
+				"y.txt": "y",
+			},
+			want: "h.txt l1 l2 x.txt y.txt",
+		},
+		{
+			tree: map[string]string{
+				"x.txt": "x",
+				"l1":    "-> x.txt",
+				"l2":    "-> x.txt",
+				"h.txt": "= x.txt",
+				"y.txt": "y",
+			},
+			canonical: true,
+			want:      "h.txt y.txt",
+		},
+		{
+			// Links to the root and to a directory between the
+			// link and the root make cycles; a link to a sibling
+			// directory does not.
+			tree: map[string]string{
+				"d/e/f":    "f",
+				"d/e/up":   "-> ../..",
+				"d/e/mid":  "-> ..",
+				"d/e/side": "-> ../g",
+				"d/g/h":    "h",
+			},
+			want:   "d/e/f d/e/side/h d/g/h",
+			cycles: "d/e/mid d/e/up",
+		},
+		{
+			tree: map[string]string{
+				"d/e/f":    "f",
+				"d/e/up":   "-> ../..",
+				"d/e/mid":  "-> ..",
+				"d/e/side": "-> ../g",
+				"d/g/h":    "h",
+			},
+			canonical: true,
+			want:      "d/e/f d/g/h",
+			cycles:    "d/e/mid d/e/up",
+		},
+		{
+			// A directory is walked through only one of the
+			// links to it.
+			tree: map[string]string{
+				"d/f": "f",
+				"l1":  "-> d",
+				"l2":  "-> d",
+			},
+			want: "d/f l1/f",
+		},
+		{
+			tree: map[string]string{
+				"d/f": "f",
+				"l1":  "-> d",
+				"l2":  "-> d",
+			},
+			canonical: true,
+			want:      "d/f",
+		},
+		{
+			// Files outside the root are found through
+			// the links to them.
+			tree: map[string]string{
+				"r/a":   "-> ../out",
+				"r/b":   "-> ../out/f",
+				"out/f": "f",
+			},
+			root: "r",
+			want: "a/f b",
+		},
+		{
+			tree: map[string]string{
+				"r/a":   "-> ../out",
+				"r/b":   "-> ../out/f",
+				"out/f": "f",
+			},
+			root:      "r",
+			canonical: true,
+			want:      "a/f",
+		},
+	} {
+		root, err := ioutil.TempDir(dir, "root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		makeTree(t, root, tt.tree)
+		root = filepath.Join(root, filepath.FromSlash(tt.root))
+		opts := defaultOptions()
+		opts.CanonicalSymlinks = tt.canonical
+		names, stats := walkRoot(t, root, opts)
+		if have := relNames(root, names); have != tt.want {
+			t.Errorf("walk %v (canonical %v) = %s, want %s", tt.tree, tt.canonical, have, tt.want)
+		}
+		for i := 1; i < len(names); i++ {
+			if index.ComparePaths(names[i-1], names[i]) >= 0 {
+				t.Errorf("walk %v (canonical %v): %s before %s", tt.tree, tt.canonical, names[i-1], names[i])
+			}
+		}
+		var cycles []string
+		for link := range stats.cycles {
+			cycles = append(cycles, link)
+		}
+		sort.Slice(cycles, func(i, j int) bool {
+			return index.ComparePaths(cycles[i], cycles[j]) < 0
+		})
+		if have := relNames(root, cycles); have != tt.cycles {
+			t.Errorf("walk %v: cycles = %s, want %s", tt.tree, have, tt.cycles)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// getFileID returns the fileID of the file with the given name and
+// info, which is not a symlink, and whether it could be found.
+// The volume serial number and file index stand for the device and
+// inode.
+func getFileID(name string, info os.FileInfo) (fileID, bool) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return fileID{}, false
+	}
+	h, err := syscall.CreateFile(p, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileID{}, false
+	}
+	defer syscall.CloseHandle(h)
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(d.VolumeSerialNumber), ino: uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)}, true
+}
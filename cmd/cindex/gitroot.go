@@ -0,0 +1,129 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/waddyano/codesearch/git"
+	"github.com/waddyano/codesearch/index"
+)
+
+// A gitRoot is a root that is a revision of a git repository, or a
+// directory in one: repo@rev:dir.  Its files are read from the
+// repository's object store, from the commit that rev names when
+// the root is indexed, which is recorded with the root's options
+// for csearch to read them from.
+type gitRoot struct {
+	repo, rev, dir string
+	commit         string // commit named by rev, or "" if it names none
+
+	blobs map[string]string // object names of the files sent to index
+	r     *git.BlobReader
+}
+
+// newGitRoot returns the gitRoot for the root path, or nil if
+// path is not in a git revision.
+func newGitRoot(path string) *gitRoot {
+	repo, rev, dir, ok := git.Split(path)
+	if !ok {
+		return nil
+	}
+	// An error is reported by walk.
+	commit, _ := git.Commit(repo, rev)
+	return &gitRoot{repo: repo, rev: rev, dir: dir, commit: commit, blobs: make(map[string]string)}
+}
+
+// walk sends the files of the revision to index to out, in walk order.
+// The names and object names of the files are recorded before any is
+// sent, so that read can be called for them.
+func (g *gitRoot) walk(rootNo int, opts *rootOptions, stats *walkStats, out chan struct {
+	int
+	string
+}, logskip bool) {
+	rev := g.commit
+	if rev == "" {
+		rev = g.rev
+	}
+	files, err := git.Files(g.repo, rev)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return index.ComparePaths(files[i].Path, files[j].Path) < 0
+	})
+	var names []string
+	skip := "" // a directory whose files are skipped
+	for _, f := range files {
+		rel := f.Path
+		if g.dir != "" {
+			if !strings.HasPrefix(rel, g.dir+"/") {
+				continue
+			}
+			rel = rel[len(g.dir)+1:]
+		}
+		stats.nFiles++
+		name := git.Name(g.repo, g.rev, f.Path)
+		if skip != "" && strings.HasPrefix(rel, skip+"/") {
+			stats.nSkipped++
+			continue
+		}
+		if why, p := opts.skipPath(rel); why != "" {
+			stats.nSkipped++
+			if p != rel {
+				skip = p
+				name = git.Name(g.repo, g.rev, path.Join(g.dir, p))
+			}
+			if logskip {
+				log.Printf("%s: skipped. %s", name, why)
+			}
+			continue
+		}
+		if opts.MaxFiles > 0 && len(names) >= opts.MaxFiles {
+			stats.full = true
+			break
+		}
+		stats.extCounts[path.Ext(f.Path)]++
+		g.blobs[name] = f.Hash
+		names = append(names, name)
+	}
+	stats.rootFiles = len(names)
+	for _, name := range names {
+		out <- struct {
+			int
+			string
+		}{rootNo, name}
+	}
+	log.Printf("finished scanning %d files, skipped %d", stats.nFiles, stats.nSkipped)
+}
+
+// read returns the contents of the file name sent to index by walk.
+func (g *gitRoot) read(name string) ([]byte, bool) {
+	if g.r == nil {
+		r, err := git.NewBlobReader(g.repo)
+		if err != nil {
+			log.Print(err)
+			return nil, false
+		}
+		g.r = r
+	}
+	data, err := g.r.Read(g.blobs[name])
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// close stops reading the repository.
+func (g *gitRoot) close() {
+	if g.r != nil {
+		g.r.Close()
+		g.r = nil
+	}
+}
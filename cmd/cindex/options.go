@@ -0,0 +1,340 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/waddyano/codesearch/ignore"
+	"github.com/waddyano/codesearch/index"
+)
+
+// rootOptions are the options that decide which files under a root
+// are indexed.  They are recorded in the index with the root, as JSON,
+// so that reindexing the root uses them again.  Fields missing from
+// the recorded options keep their defaults.
+type rootOptions struct {
+	Exclude             string   `json:",omitempty"` // file of patterns of names to exclude
+	Rules               string   `json:",omitempty"` // file of include and exclude rules
+	Rule                []string `json:",omitempty"` // rules after those in Rules
+	NoFollowSymlinks    bool     `json:",omitempty"`
+	CanonicalSymlinks   bool     `json:",omitempty"`
+	NoIgnore            bool     `json:",omitempty"`
+	Xdev                bool     `json:",omitempty"` // stay on the root's file system
+	MaxDepth            int      `json:",omitempty"` // levels below the root to index
+	SkipDotFiles        bool     `json:",omitempty"`
+	SkipDotDirs         bool     `json:",omitempty"`
+	MaxFiles            int      `json:",omitempty"` // files of the root to index
+	Archives            bool     `json:",omitempty"` // index the files in archives
+	MaxFileLen          int64
+	MaxLineLen          int
+	MaxTextTrigrams     int
+	MaxInvalidUTF8Ratio float64
+	Commit              string `json:",omitempty"` // commit indexed, for a git revision
+
+	excludePatterns []string      // patterns read from Exclude
+	rules           *ignore.Rules // rules read from Rules and Rule
+	dev             uint64        // device of the root, for Xdev
+	haveDev         bool
+}
+
+// defaultOptions returns the options used when no flags are given.
+func defaultOptions() *rootOptions {
+	return &rootOptions{
+		MaxFileLen:          DEFAULT_MAX_FILE_LENGTH,
+		MaxLineLen:          DEFAULT_MAX_LINE_LENGTH,
+		MaxTextTrigrams:     DEFAULT_MAX_TEXT_TRIGRAMS,
+		MaxInvalidUTF8Ratio: DEFAULT_MAX_INVALID_UTF8_PERCENTAGE,
+	}
+}
+
+// parseOptions returns the options recorded as s for the root path,
+// or the defaults if none are recorded.
+func parseOptions(path, s string) *rootOptions {
+	o := defaultOptions()
+	if s == "" {
+		return o
+	}
+	if err := json.Unmarshal([]byte(s), o); err != nil {
+		log.Printf("%s: ignoring recorded options: %v", path, err)
+		return defaultOptions()
+	}
+	return o
+}
+
+// String returns the options as they are recorded in the index.
+func (o *rootOptions) String() string {
+	data, err := json.Marshal(o)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(data)
+}
+
+// setFlags replaces the options with the values of the flags
+// named in set, which are those given on the command line.
+// -rules and -rule together replace the rules.
+func (o *rootOptions) setFlags(set map[string]bool) {
+	if set["exclude"] {
+		o.Exclude = absHome(*exclude)
+	}
+	if set["rules"] || set["rule"] {
+		o.Rules = absHome(*rulesFile)
+		o.Rule = ruleFlags
+	}
+	if set["no-follow-symlinks"] {
+		o.NoFollowSymlinks = *noFollowSymlinksFlag
+	}
+	if set["canonical-symlinks"] {
+		o.CanonicalSymlinks = *canonicalSymlinks
+	}
+	if set["no-ignore"] {
+		o.NoIgnore = *noIgnoreFlag
+	}
+	if set["xdev"] {
+		o.Xdev = *xdevFlag
+	}
+	if set["maxdepth"] {
+		o.MaxDepth = *maxDepth
+	}
+	if set["skip-dotfiles"] {
+		o.SkipDotFiles = *skipDotFiles
+	}
+	if set["skip-dotdirs"] {
+		o.SkipDotDirs = *skipDotDirs
+	}
+	if set["maxfiles"] {
+		o.MaxFiles = *maxFiles
+	}
+	if set["archives"] {
+		o.Archives = *archivesFlag
+	}
+	if set["maxfilelen"] {
+		o.MaxFileLen = *maxFileLen
+	}
+	if set["maxlinelen"] {
+		o.MaxLineLen = *maxLineLen
+	}
+	if set["maxtrigrams"] {
+		o.MaxTextTrigrams = *maxTextTrigrams
+	}
+	if set["maxinvalidutf8ratio"] {
+		o.MaxInvalidUTF8Ratio = *maxInvalidUTF8Ratio
+	}
+}
+
+// absHome returns the absolute form of the file name, in which a
+// leading ~/ stands for the home directory.  It leaves "" alone.
+func absHome(file string) string {
+	if file == "" {
+		return ""
+	}
+	if strings.HasPrefix(file, "~/") {
+		file = filepath.Join(index.HomeDir(), file[2:])
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	return file
+}
+
+// load reads the exclude patterns and the rules, and for Xdev
+// finds the device of root.
+func (o *rootOptions) load(root string, logskip bool) error {
+	o.haveDev = false
+	if o.Xdev {
+		if fi, err := os.Stat(root); err == nil {
+			var id fileID
+			id, o.haveDev = getFileID(root, fi)
+			o.dev = id.dev
+		}
+	}
+	o.excludePatterns = nil
+	if o.Exclude != "" {
+		if logskip {
+			log.Printf("Loading exclude patterns from %s", o.Exclude)
+		}
+		data, err := ioutil.ReadFile(o.Exclude)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range strings.Split(string(data), "\n") {
+			o.excludePatterns = append(o.excludePatterns, strings.TrimSpace(pattern))
+		}
+	}
+	o.rules = nil
+	if o.Rules != "" || len(o.Rule) > 0 {
+		rules := new(ignore.Rules)
+		if o.Rules != "" {
+			data, err := ioutil.ReadFile(o.Rules)
+			if err != nil {
+				return err
+			}
+			rules, err = ignore.ParseRules(string(data))
+			if err != nil {
+				return fmt.Errorf("%s: %v", o.Rules, err)
+			}
+		}
+		for _, r := range o.Rule {
+			if err := rules.Add(r); err != nil {
+				return fmt.Errorf("-rule %q: %v", r, err)
+			}
+		}
+		o.rules = rules
+	}
+	return nil
+}
+
+// excluded reports whether the file or directory elem matches one
+// of excludePatterns or of the patterns read from o.Exclude.
+func (o *rootOptions) excluded(elem string) bool {
+	for _, patterns := range [][]string{excludePatterns, o.excludePatterns} {
+		for _, pattern := range patterns {
+			exclude, err := filepath.Match(pattern, elem)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if exclude {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipReason returns why the walk skips the file or directory path,
+// with the given info, found at rel below the root, or "" if it does
+// not.  A symlink is judged by what it links to, once that is walked.
+func (o *rootOptions) skipReason(rel, path string, info os.FileInfo) string {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return ""
+	}
+	isDir := info.IsDir()
+	if strings.HasPrefix(filepath.Base(rel), ".") {
+		if isDir && o.SkipDotDirs {
+			return "Hidden directory"
+		}
+		if !isDir && o.SkipDotFiles {
+			return "Hidden file"
+		}
+	}
+	if o.MaxDepth > 0 {
+		// Nothing in a directory at the maximum depth is indexed.
+		depth := strings.Count(rel, string(filepath.Separator)) + 1
+		if depth > o.MaxDepth || isDir && depth == o.MaxDepth {
+			return "Too deep"
+		}
+	}
+	if isDir && o.Xdev && o.haveDev {
+		if id, ok := getFileID(path, info); ok && id.dev != o.dev {
+			return "Other file system"
+		}
+	}
+	return ""
+}
+
+// skipPath returns why the files at the slash-separated path rel
+// below the root of a git revision are skipped, or "" if they are
+// not, along with the path that is skipped: rel or a directory
+// holding it.
+func (o *rootOptions) skipPath(rel string) (why, skip string) {
+	elems := strings.Split(rel, "/")
+	for i, elem := range elems {
+		p := strings.Join(elems[:i+1], "/")
+		isDir := i < len(elems)-1
+		kind := "file"
+		if isDir {
+			kind = "directory"
+		}
+		switch {
+		case o.excluded(elem) || o.rules != nil && o.rules.Excluded(p, isDir):
+			return "Excluded " + kind, p
+		case strings.HasPrefix(elem, ".") && (isDir && o.SkipDotDirs || !isDir && o.SkipDotFiles):
+			return "Hidden " + kind, p
+		case o.MaxDepth > 0 && (i+1 > o.MaxDepth || isDir && i+1 == o.MaxDepth):
+			return "Too deep", p
+		}
+	}
+	return "", ""
+}
+
+// limits returns the limits on what files to index.
+func (o *rootOptions) limits() index.Limits {
+	return index.Limits{
+		MaxFileLen:          o.MaxFileLen,
+		MaxLineLen:          o.MaxLineLen,
+		MaxTextTrigrams:     o.MaxTextTrigrams,
+		MaxInvalidUTF8Ratio: o.MaxInvalidUTF8Ratio,
+	}
+}
+
+// flags returns the flags that set the options that differ from
+// the defaults, for cindex -list.
+func (o *rootOptions) flags() string {
+	var f []string
+	if o.Exclude != "" {
+		f = append(f, "-exclude="+shellQuote(o.Exclude))
+	}
+	if o.Rules != "" {
+		f = append(f, "-rules="+shellQuote(o.Rules))
+	}
+	for _, r := range o.Rule {
+		f = append(f, "-rule="+shellQuote(r))
+	}
+	if o.NoFollowSymlinks {
+		f = append(f, "-no-follow-symlinks")
+	}
+	if o.CanonicalSymlinks {
+		f = append(f, "-canonical-symlinks")
+	}
+	if o.NoIgnore {
+		f = append(f, "-no-ignore")
+	}
+	if o.Xdev {
+		f = append(f, "-xdev")
+	}
+	if o.MaxDepth != 0 {
+		f = append(f, fmt.Sprintf("-maxdepth=%d", o.MaxDepth))
+	}
+	if o.SkipDotFiles {
+		f = append(f, "-skip-dotfiles")
+	}
+	if o.SkipDotDirs {
+		f = append(f, "-skip-dotdirs")
+	}
+	if o.MaxFiles != 0 {
+		f = append(f, fmt.Sprintf("-maxfiles=%d", o.MaxFiles))
+	}
+	if o.Archives {
+		f = append(f, "-archives")
+	}
+	d := defaultOptions()
+	if o.MaxFileLen != d.MaxFileLen {
+		f = append(f, fmt.Sprintf("-maxfilelen=%d", o.MaxFileLen))
+	}
+	if o.MaxLineLen != d.MaxLineLen {
+		f = append(f, fmt.Sprintf("-maxlinelen=%d", o.MaxLineLen))
+	}
+	if o.MaxTextTrigrams != d.MaxTextTrigrams {
+		f = append(f, fmt.Sprintf("-maxtrigrams=%d", o.MaxTextTrigrams))
+	}
+	if o.MaxInvalidUTF8Ratio != d.MaxInvalidUTF8Ratio {
+		f = append(f, fmt.Sprintf("-maxinvalidutf8ratio=%g", o.MaxInvalidUTF8Ratio))
+	}
+	return strings.Join(f, " ")
+}
+
+// shellQuote quotes s for a shell if it needs to be.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+=:,@") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,287 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/waddyano/codesearch/index"
+)
+
+// TestMain runs the test binary as cindex for runCindex.
+func TestMain(m *testing.M) {
+	if os.Getenv("CINDEX_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCindex runs cindex with the given arguments on the index file.
+func runCindex(t *testing.T, file string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "CINDEX_TEST_MAIN=1", "CSEARCHINDEX="+file)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("cindex %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// A fakeInfo is the os.FileInfo of a file that is not on disk.
+type fakeInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (fi fakeInfo) Name() string       { return fi.name }
+func (fi fakeInfo) Size() int64        { return 0 }
+func (fi fakeInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeInfo) Sys() interface{}   { return nil }
+
+func TestSkipReason(t *testing.T) {
+	dotFiles := &rootOptions{SkipDotFiles: true}
+	dotDirs := &rootOptions{SkipDotDirs: true}
+	depth1 := &rootOptions{MaxDepth: 1}
+	depth2 := &rootOptions{MaxDepth: 2}
+	for _, tt := range []struct {
+		opts *rootOptions
+		rel  string
+		mode os.FileMode
+		want string
+	}{
+		{dotFiles, ".x", 0, "Hidden file"},
+		{dotFiles, "a/.x", 0, "Hidden file"},
+		{dotFiles, ".d", os.ModeDir, ""},
+		{dotFiles, ".d/x", 0, ""},
+		{dotFiles, ".x", os.ModeSymlink, ""},
+		{dotDirs, ".d", os.ModeDir, "Hidden directory"},
+		{dotDirs, "a/.d", os.ModeDir, "Hidden directory"},
+		{dotDirs, ".x", 0, ""},
+		{depth1, "f", 0, ""},
+		{depth1, "d", os.ModeDir, "Too deep"},
+		{depth1, "d/f", 0, "Too deep"},
+		{depth2, "d", os.ModeDir, ""},
+		{depth2, "d/f", 0, ""},
+		{depth2, "d/e", os.ModeDir, "Too deep"},
+		{depth2, "d/e/f", 0, "Too deep"},
+		{depth2, "d/e", os.ModeSymlink, ""},
+		{&rootOptions{}, ".d/.e/f", 0, ""},
+	} {
+		rel := filepath.FromSlash(tt.rel)
+		info := fakeInfo{filepath.Base(rel), tt.mode}
+		if why := tt.opts.skipReason(rel, rel, info); why != tt.want {
+			t.Errorf("%+v skipReason(%s, %v) = %q, want %q", *tt.opts, tt.rel, tt.mode, why, tt.want)
+		}
+	}
+
+	// With Xdev, only directories on other devices are skipped.
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := getFileID(dir, info)
+	if !ok {
+		t.Skip("no device numbers")
+	}
+	for _, tt := range []struct {
+		dev  uint64
+		want string
+	}{
+		{id.dev, ""},
+		{id.dev + 1, "Other file system"},
+	} {
+		o := &rootOptions{Xdev: true, dev: tt.dev, haveDev: true}
+		if why := o.skipReason("d", dir, info); why != tt.want {
+			t.Errorf("xdev on %d: skipReason(%s) on %d = %q, want %q", tt.dev, dir, id.dev, why, tt.want)
+		}
+	}
+	o := &rootOptions{Xdev: true, dev: id.dev + 1}
+	if why := o.skipReason("d", dir, info); why != "" {
+		t.Errorf("xdev with unknown root device: skipReason(%s) = %q, want %q", dir, why, "")
+	}
+}
+
+func TestSkipPath(t *testing.T) {
+	for _, tt := range []struct {
+		opts *rootOptions
+		rel  string
+		why  string
+		skip string
+	}{
+		{&rootOptions{}, "a/b/c", "", ""},
+		{&rootOptions{}, "a/.csearchindex", "Excluded file", "a/.csearchindex"},
+		{&rootOptions{Rule: []string{"exclude b/"}}, "a/b/c", "Excluded directory", "a/b"},
+		{&rootOptions{Rule: []string{"exclude *.go"}}, "a/b.go", "Excluded file", "a/b.go"},
+		{&rootOptions{SkipDotDirs: true}, "a/.git/x", "Hidden directory", "a/.git"},
+		{&rootOptions{SkipDotDirs: true}, "a/.x", "", ""},
+		{&rootOptions{SkipDotFiles: true}, "a/.x", "Hidden file", "a/.x"},
+		{&rootOptions{SkipDotFiles: true}, ".d/x", "", ""},
+		{&rootOptions{MaxDepth: 1}, "x", "", ""},
+		{&rootOptions{MaxDepth: 1}, "a/x", "Too deep", "a"},
+		{&rootOptions{MaxDepth: 2}, "a/b/c", "Too deep", "a/b"},
+	} {
+		if err := tt.opts.load("/nonexistent", false); err != nil {
+			t.Fatal(err)
+		}
+		why, skip := tt.opts.skipPath(tt.rel)
+		if why != tt.why || skip != tt.skip {
+			t.Errorf("%+v skipPath(%s) = %q, %q, want %q, %q", *tt.opts, tt.rel, why, skip, tt.why, tt.skip)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(file, []byte("exclude *.go\nbad x\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	good := filepath.Join(dir, "good")
+	if err := ioutil.WriteFile(good, []byte("exclude *.go\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// An error names the file or the -rule it comes from,
+	// and lines are counted in the file alone.
+	for _, tt := range []struct {
+		opts *rootOptions
+		want string
+	}{
+		{&rootOptions{Rules: file}, file + ": line 2: "},
+		{&rootOptions{Rules: file, Rule: []string{"include *.go"}}, file + ": line 2: "},
+		{&rootOptions{Rule: []string{"include *.go", "bad y"}}, `-rule "bad y": `},
+		{&rootOptions{Rules: good, Rule: []string{"bad y"}}, `-rule "bad y": `},
+	} {
+		err := tt.opts.load(dir, false)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%+v load = %v, want error starting %q", *tt.opts, err, tt.want)
+		}
+	}
+
+	// The -rule rules come after those in the file.
+	o := &rootOptions{Rules: good, Rule: []string{"include main.go"}}
+	if err := o.load(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		rel  string
+		want bool
+	}{
+		{"a.go", true},
+		{"main.go", false},
+		{"a.c", false},
+	} {
+		if ex := o.rules.Excluded(tt.rel, false); ex != tt.want {
+			t.Errorf("Excluded(%s) = %v, want %v", tt.rel, ex, tt.want)
+		}
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	makeTree(t, dir, map[string]string{"a": "a", "b/c": "c", "b/d": "d", "e": "e"})
+
+	for _, tt := range []struct {
+		max  int
+		want string
+		full bool
+	}{
+		{0, "a b/c b/d e", false},
+		{4, "a b/c b/d e", false},
+		{2, "a b/c", true},
+	} {
+		opts := defaultOptions()
+		opts.MaxFiles = tt.max
+		names, stats := walkRoot(t, dir, opts)
+		if have := relNames(dir, names); have != tt.want || stats.full != tt.full {
+			t.Errorf("walk with MaxFiles %d = %s, full %v, want %s, full %v", tt.max, have, stats.full, tt.want, tt.full)
+		}
+	}
+}
+
+// TestRecordedOptions checks that the options a path is indexed with
+// are recorded in the index and used again when it is reindexed.
+func TestRecordedOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	makeTree(t, root, map[string]string{
+		"a.txt":       "a",
+		".hidden.txt": "hidden",
+		"d/b.txt":     "b",
+		"d/e/c.txt":   "c",
+	})
+	file := filepath.Join(dir, "index")
+
+	check := func(when, want string) {
+		t.Helper()
+		ix, err := index.OpenSet(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		names, err := ix.PostingQueryE(&index.Query{Op: index.QAll})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := relNames(root, names); have != want {
+			t.Errorf("%s: indexed %s, want %s", when, have, want)
+		}
+		opts := ix.PathOptions()
+		if len(opts) != 1 {
+			t.Fatalf("%s: options %q, want one", when, opts)
+		}
+		o := parseOptions(root, opts[0])
+		if o.MaxDepth != 2 || !o.SkipDotFiles {
+			t.Errorf("%s: recorded options %s, want MaxDepth 2 and SkipDotFiles", when, opts[0])
+		}
+	}
+
+	runCindex(t, file, "-maxdepth", "2", "-skip-dotfiles", root)
+	check("first index", "a.txt d/b.txt")
+
+	// New files, too deep or hidden, are not indexed by a plain
+	// reindex, nor by indexing the path again without the flags.
+	makeTree(t, root, map[string]string{
+		".new.txt":    "new",
+		"d/e/f/g.txt": "g",
+		"d/h.txt":     "h",
+	})
+	runCindex(t, file)
+	check("reindex", "a.txt d/b.txt d/h.txt")
+	runCindex(t, file, "-maxdepth", "5", "-skip-dotfiles=false")
+	check("reindex with flags", "a.txt d/b.txt d/h.txt")
+	runCindex(t, file, root)
+	check("reindex path", "a.txt d/b.txt d/h.txt")
+
+	if out := runCindex(t, file, "-list"); !strings.Contains(out, root+"\t-maxdepth=2 -skip-dotfiles\n") {
+		t.Errorf("cindex -list = %q, want %s with its flags", out, root)
+	}
+}
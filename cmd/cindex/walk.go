@@ -0,0 +1,130 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A walker walks file trees like filepath.Walk, calling the walk function
+// for the same paths in the same order, but it reads the directories
+// using a bounded number of goroutines.  When the walk visits a
+// directory, the walker starts reading each of its subdirectories, so
+// that they have usually been read by the time the walk gets to them.
+type walker struct {
+	sem chan bool // limits the number of directories being read
+}
+
+// newWalker returns a walker that reads up to n directories at once.
+func newWalker(n int) *walker {
+	if n < 1 {
+		n = 1
+	}
+	return &walker{sem: make(chan bool, n)}
+}
+
+// A dirList is the result of reading a directory.
+type dirList struct {
+	done  chan bool // closed when the directory has been read
+	names []string  // sorted names of the entries
+	infos []os.FileInfo
+	errs  []error // errors from lstat of the entries
+	err   error   // error reading the directory
+}
+
+// read starts reading the directory dir.
+func (w *walker) read(dir string) *dirList {
+	d := &dirList{done: make(chan bool)}
+	go func() {
+		w.sem <- true
+		defer func() {
+			<-w.sem
+			close(d.done)
+		}()
+		f, err := os.Open(dir)
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.names, d.err = f.Readdirnames(-1)
+		f.Close()
+		if d.err != nil {
+			return
+		}
+		sort.Strings(d.names)
+		d.infos = make([]os.FileInfo, len(d.names))
+		d.errs = make([]error, len(d.names))
+		for i, name := range d.names {
+			d.infos[i], d.errs[i] = os.Lstat(filepath.Join(dir, name))
+		}
+	}()
+	return d
+}
+
+// prefetch starts reading root, if it is a directory, so that a later
+// call to Walk can use the result.
+func (w *walker) prefetch(root string) *dirList {
+	if info, err := os.Lstat(root); err == nil && info.IsDir() {
+		return w.read(root)
+	}
+	return nil
+}
+
+// Walk walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root.  It has the same semantics as
+// filepath.Walk.  If d is not nil, it is the result of prefetch(root).
+// Walk does not read ahead into the directories for which skip returns
+// true, which is called only once fn has been called for the directory
+// holding them; fn is expected to return filepath.SkipDir for them.
+func (w *walker) Walk(root string, d *dirList, skip func(path string, info os.FileInfo) bool, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walk(root, info, d, skip, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (w *walker) walk(path string, info os.FileInfo, d *dirList, skip func(string, os.FileInfo) bool, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	if d == nil {
+		d = w.read(path)
+	}
+	<-d.done
+	err1 := fn(path, info, d.err)
+	if d.err != nil || err1 != nil {
+		return err1
+	}
+
+	subdirs := make([]*dirList, len(d.names))
+	for i, name := range d.names {
+		if d.errs[i] == nil && d.infos[i].IsDir() {
+			if dir := filepath.Join(path, name); !skip(dir, d.infos[i]) {
+				subdirs[i] = w.read(dir)
+			}
+		}
+	}
+	for i, name := range d.names {
+		filename := filepath.Join(path, name)
+		if d.errs[i] != nil {
+			if err := fn(filename, d.infos[i], d.errs[i]); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err := w.walk(filename, d.infos[i], subdirs[i], skip, fn)
+		if err != nil && (!d.infos[i].IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
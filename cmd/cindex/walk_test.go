@@ -0,0 +1,93 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var walkTree = map[string]string{
+	"a/b/c/f":      "f",
+	"a/b/g":        "g",
+	"a/b-c/h":      "h",
+	"a/skipme/i":   "i",
+	"a/skipme/j/k": "k",
+	"a/x/stop":     "stop",
+	"a/x/y":        "y",
+	"a/x/z/k":      "k",
+	"a.b/l":        "l",
+	"ab":           "ab",
+	"link":         "-> a/b",
+	"skipme/m":     "m",
+	"z/n":          "n",
+}
+
+// walkFn returns a filepath.WalkFunc that records the calls in *visits
+// and returns filepath.SkipDir for the directories named skipme and for
+// the files named stop, which skips the rest of their directories.
+func walkFn(visits *[]string) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		kind := "file"
+		if info == nil {
+			kind = "nil"
+		} else if info.IsDir() {
+			kind = "dir"
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			kind = "link"
+		}
+		*visits = append(*visits, fmt.Sprintf("%s %s %v", filepath.ToSlash(path), kind, err != nil))
+		if info != nil && (info.IsDir() && info.Name() == "skipme" || info.Name() == "stop") {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+}
+
+func TestWalker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cindex-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	makeTree(t, dir, walkTree)
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, root := range []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "ab"), filepath.Join(dir, "missing")} {
+		var want []string
+		wantErr := filepath.Walk(root, walkFn(&want))
+
+		for _, pre := range []bool{false, true} {
+			var have []string
+			visited := make(map[string]bool)
+			fn := walkFn(&have)
+			w := newWalker(3)
+			var d *dirList
+			if pre {
+				d = w.prefetch(root)
+			}
+			// Skip what fn skips, and check that the walker
+			// asks only once it has visited the parent.
+			skip := func(path string, info os.FileInfo) bool {
+				if !visited[filepath.Dir(path)] {
+					t.Errorf("Walk(%s): skip(%s) before visiting %s", root, path, filepath.Dir(path))
+				}
+				return info.Name() == "skipme"
+			}
+			haveErr := w.Walk(root, d, skip, func(path string, info os.FileInfo, err error) error {
+				visited[path] = true
+				return fn(path, info, err)
+			})
+			if strings.Join(have, "\n") != strings.Join(want, "\n") || haveErr != wantErr {
+				t.Errorf("Walk(%s) (prefetch %v) = %v:\n\t%s\nwant %v:\n\t%s", root, pre, haveErr, strings.Join(have, "\n\t"), wantErr, strings.Join(want, "\n\t"))
+			}
+		}
+	}
+}
@@ -7,14 +7,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 
+	"github.com/waddyano/codesearch/git"
 	"github.com/waddyano/codesearch/index"
 	"github.com/waddyano/codesearch/regexp"
 )
@@ -25,6 +32,8 @@ Options:
 
   -c           print only a count of selected lines to stdout
                (Not meaningful with -l or -M modes)
+  -collapse    report files with identical contents once, as the first of
+               them followed by (+N identical copies)
   -f PATHREGEXP
                search only files with names matching this regexp
   -h           print this help text and exit
@@ -37,6 +46,12 @@ Options:
                (Not allowed with -c or -l modes)
   -n           print each output line preceded by its relative line number in
                the file, starting at 1
+  -stored      search the contents of the files stored in the index (see
+               cindex -store), as they were when they were indexed,
+               instead of the files as they are now
+  -rev REV     search only the files of revision REV of the indexed git
+               repositories (see cindex -rev), instead of those of every
+               revision and the other indexed files
   -indexpath FILE
                use specified FILE as the index path. Overrides $CSEARCHINDEX.
   -verbose     print extra information
@@ -60,7 +75,18 @@ the index. If no index exists, this command creates one.  If an index already
 exists, cindex overwrites it.  Run cindex -help for more.
 
 csearch uses the index stored in $CSEARCHINDEX or, if that variable is unset or
-empty, $HOME/.csearchindex.
+empty, $HOME/.csearchindex.  The index may also be an index set: a directory
+of index shards named *.csi, or a file beginning with the line
+"csearch index set" followed by the names of the shards, one per line.
+csearch searches the shards of a set in parallel.
+
+The files of git revisions indexed with cindex -rev are read from the
+repository as they were indexed, from the commit that cindex recorded,
+even if the revision is a branch that has moved on since.
+
+When cindex has recorded that files have the same contents, csearch
+reads only one of them and reports its matches in each, or only in the
+first with -collapse.
 `
 
 func usage() {
@@ -78,6 +104,9 @@ var (
 	maxCount        = flag.Int64("m", 0, "specified maximum number of search results")
 	maxCountPerFile = flag.Int64("M", 0, "specified maximum number of search results per file")
 	oneThread       = flag.Bool("1", false, "only use on thread")
+	revFlag         = flag.String("rev", "", "search only the files of this revision of indexed git repositories")
+	collapseFlag    = flag.Bool("collapse", false, "report files with identical contents once")
+	storedFlag      = flag.Bool("stored", false, "search the file contents stored in the index")
 
 	matches bool
 )
@@ -135,43 +164,71 @@ func Main() {
 		log.Printf("query: %s\n", q)
 	}
 
-	ix := index.Open(index.File())
+	ix, err := index.OpenSet(index.File())
+	if err != nil {
+		log.Fatal(err)
+	}
 	ix.Verbose = *verboseFlag
-	var post []uint32
+	pinRevisions(ix)
+	var post [][]index.FileRef
 	if *bruteFlag {
-		post = ix.PostingQuery(&index.Query{Op: index.QAll})
+		post = ix.PostingFileGroups(&index.Query{Op: index.QAll})
 	} else {
-		post = ix.PostingQuery(q)
+		post = ix.PostingFileGroups(q)
 	}
 	if *verboseFlag {
-		log.Printf("post query identified %d possible files\n", len(post))
+		log.Printf("post query identified %d possible files\n", countFiles(post))
 	}
 
 	if fre != nil {
-		fnames := make([]uint32, 0, len(post))
+		post = filterGroups(post, func(name string) bool {
+			return fre.MatchString(name, true, true) >= 0
+		})
 
-		for _, fileid := range post {
-			name := ix.Name(fileid)
-			if fre.MatchString(name, true, true) < 0 {
-				continue
-			}
-			fnames = append(fnames, fileid)
+		if *verboseFlag {
+			log.Printf("filename regexp matched %d files\n", countFiles(post))
 		}
+	}
+
+	if *revFlag != "" {
+		post = filterGroups(post, func(name string) bool {
+			if !strings.Contains(name, "@"+*revFlag+":") {
+				return false
+			}
+			_, rev, _, ok := git.SplitPinned(name)
+			return ok && rev == *revFlag
+		})
 
 		if *verboseFlag {
-			log.Printf("filename regexp matched %d files\n", len(fnames))
+			log.Printf("revision %s has %d files\n", *revFlag, countFiles(post))
 		}
-		post = fnames
 	}
 
+	g.Collapse = *collapseFlag
+	if *storedFlag && !ix.HasContents() {
+		log.Fatal("the index does not store file contents; see cindex -store")
+	}
 	g.LimitPrintCount(*maxCount, *maxCountPerFile)
 
-	fileChan := make(chan string)
+	// search searches a group of files with g.
+	search := func(g *regexp.Grep, group []index.FileRef) {
+		names := make([]string, len(group))
+		for i, f := range group {
+			names[i] = f.Name
+		}
+		if *storedFlag {
+			g.Open = func(name string) (io.ReadCloser, error) {
+				return openStored(ix, group, name)
+			}
+		}
+		g.Group(names)
+	}
+
+	fileChan := make(chan []index.FileRef)
 
 	if *oneThread {
-		for _, fileid := range post {
-			name := ix.Name(fileid)
-			g.File(name)
+		for _, group := range post {
+			search(&g, group)
 			// short circuit here too
 			if g.Done {
 				break
@@ -191,22 +248,21 @@ func Main() {
 				log.Fatal(err)
 			}
 			pg.Regexp = pre
-			go func(fileChan chan string, myg regexp.Grep) {
+			go func(fileChan chan []index.FileRef, myg regexp.Grep) {
 				for {
-					name, more := <-fileChan
+					group, more := <-fileChan
 					if !more {
 						wg.Done()
 						return
 					}
 
-					myg.File(name)
+					search(&myg, group)
 				}
 			}(fileChan, pg)
 		}
 
-		for _, fileid := range post {
-			name := ix.Name(fileid)
-			fileChan <- name
+		for _, group := range post {
+			fileChan <- group
 		}
 
 		close(fileChan)
@@ -214,6 +270,67 @@ func Main() {
 	}
 }
 
+var errNotStored = errors.New("content not stored in index")
+
+// pinRevisions makes git.Open open the files of the git revisions in
+// the index, reading them from the commits cindex recorded with their
+// paths, so that a branch that has moved on since it was indexed is
+// searched as it was.
+func pinRevisions(ix *index.Set) {
+	opts := ix.PathOptions()
+	for i, p := range ix.Paths() {
+		if !strings.Contains(p, "@") {
+			continue
+		}
+		var o struct{ Commit string }
+		json.Unmarshal([]byte(opts[i]), &o)
+		git.Pin(p, o.Commit)
+	}
+}
+
+// openStored opens the content stored in the index for the file
+// of the group with the given name, reading it by the file ID that
+// the query found rather than looking the name up again.
+func openStored(ix *index.Set, group []index.FileRef, name string) (io.ReadCloser, error) {
+	for _, f := range group {
+		if f.Name != name {
+			continue
+		}
+		if data, ok := ix.FileContents(f); ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		break
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: errNotStored}
+}
+
+// filterGroups returns the groups of files
+// with only the files whose names keep returns true for.
+func filterGroups(groups [][]index.FileRef, keep func(name string) bool) [][]index.FileRef {
+	var out [][]index.FileRef
+	for _, group := range groups {
+		var files []index.FileRef
+		for _, f := range group {
+			if keep(f.Name) {
+				files = append(files, f)
+			}
+		}
+		if len(files) > 0 {
+			out = append(out, files)
+		}
+	}
+	return out
+}
+
+// countFiles returns the number of files in groups.
+func countFiles(groups [][]index.FileRef) int {
+	n := 0
+	for _, group := range groups {
+		n += len(group)
+	}
+	return n
+}
+
 func main() {
 	Main()
 	if !matches {
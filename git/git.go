@@ -0,0 +1,384 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package git reads the files of a revision of a local git repository,
+// bare or not, from its object store rather than from a checkout.  It
+// runs the git command to do so.
+//
+// A file in a revision has a virtual path: the path of the repository,
+// @, the revision, :, and the slash-separated path of the file in the
+// revision's tree, as in /srv/mirror/foo.git@main:src/x.go.
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Name returns the virtual path of the file path in revision rev of
+// the repository repo.  With path "", it is the prefix of the virtual
+// paths of all the files in the revision.
+func Name(repo, rev, path string) string {
+	return repo + "@" + rev + ":" + path
+}
+
+// Split splits the virtual path name into the repository, revision and
+// path of the file.  It reports false if name is not a virtual path:
+// the part before the @ must be a git repository, and the revision must
+// not be empty or begin with -.  Split looks in the file system for the
+// repository, so it is meant for the virtual paths of indexed roots;
+// SplitPinned splits the names of the files under them.
+func Split(name string) (repo, rev, path string, ok bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '@' {
+			continue
+		}
+		rest := name[i+1:]
+		j := strings.IndexByte(rest, ':')
+		if j > 0 && rest[0] != '-' && IsRepo(name[:i]) {
+			return name[:i], rest[:j], rest[j+1:], true
+		}
+	}
+	return "", "", "", false
+}
+
+// IsRepo reports whether dir is a git repository: a bare one,
+// or a working tree with a .git directory or file.
+func IsRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	fi, err = os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && fi.IsDir()
+}
+
+// command returns a git command run in repo.
+func command(repo string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// checkRev returns an error if git could take rev for an option.
+func checkRev(repo, rev string) error {
+	if strings.HasPrefix(rev, "-") {
+		return fmt.Errorf("%s: bad revision %q", repo, rev)
+	}
+	return nil
+}
+
+// run runs a git command in repo and returns its output.
+func run(repo string, args ...string) ([]byte, error) {
+	cmd := command(repo, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s: git %s: %s", repo, args[0], msg)
+	}
+	return out, nil
+}
+
+// A File is a file in the tree of a revision.
+type File struct {
+	Path string // slash-separated path in the tree
+	Hash string // object name of the blob
+	Size int64
+}
+
+// Files returns the regular files in the tree of revision rev of the
+// repository repo, in the order git lists them.  Symlinks and
+// submodules are left out.
+func Files(repo, rev string) ([]File, error) {
+	if err := checkRev(repo, rev); err != nil {
+		return nil, err
+	}
+	out, err := run(repo, "ls-tree", "-r", "-z", "-l", "--full-tree", rev+"^{tree}")
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+		// <mode> <type> <object> <size>\t<path>
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			return nil, fmt.Errorf("%s: git ls-tree: bad line %q", repo, line)
+		}
+		f := strings.Fields(line[:i])
+		if len(f) != 4 {
+			return nil, fmt.Errorf("%s: git ls-tree: bad line %q", repo, line)
+		}
+		if f[1] != "blob" || f[0] != "100644" && f[0] != "100755" {
+			continue
+		}
+		size, err := strconv.ParseInt(f[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: git ls-tree: bad line %q", repo, line)
+		}
+		files = append(files, File{Path: line[i+1:], Hash: f[2], Size: size})
+	}
+	return files, nil
+}
+
+// Commit returns the object name of the commit that rev names in the
+// repository repo, so that the revision can be read as it is now even
+// if it is a branch that moves on later.
+func Commit(repo, rev string) (string, error) {
+	if err := checkRev(repo, rev); err != nil {
+		return "", err
+	}
+	out, err := run(repo, "rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// A BlobReader reads blobs from a repository using a single
+// git cat-file process.  It must not be used concurrently.
+type BlobReader struct {
+	repo string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+	err  error // error talking to the process, which stops it being used
+}
+
+// NewBlobReader returns a BlobReader for the repository repo.
+func NewBlobReader(repo string) (*BlobReader, error) {
+	cmd := command(repo, "cat-file", "--batch")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: git cat-file: %v", repo, err)
+	}
+	return &BlobReader{repo: repo, cmd: cmd, in: in, out: bufio.NewReaderSize(out, 1<<16)}, nil
+}
+
+// Read returns the contents of the blob with the given object name,
+// which may also be any other name git cat-file accepts for it, such
+// as commit:path.  Once there is an error talking to the git process,
+// Read returns it again.
+func (r *BlobReader) Read(hash string) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if strings.ContainsAny(hash, "\n\x00") {
+		return nil, fmt.Errorf("%s: %q is not a blob", r.repo, hash)
+	}
+	if _, err := fmt.Fprintf(r.in, "%s\n", hash); err != nil {
+		return nil, r.fail(err)
+	}
+	// <object> <type> <size>\n<contents>\n or <object> missing\n
+	head, err := r.out.ReadString('\n')
+	if err != nil {
+		return nil, r.fail(err)
+	}
+	f := strings.Fields(head)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("%s: %s is not a blob", r.repo, hash)
+	}
+	size, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		return nil, r.fail(fmt.Errorf("bad header %q", head))
+	}
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(r.out, data); err != nil {
+		return nil, r.fail(err)
+	}
+	if f[1] != "blob" {
+		return nil, fmt.Errorf("%s: %s is not a blob", r.repo, hash)
+	}
+	return data[:size], nil
+}
+
+// fail records and returns an error talking to the git process.
+func (r *BlobReader) fail(err error) error {
+	r.err = fmt.Errorf("%s: git cat-file: %v", r.repo, err)
+	return r.err
+}
+
+// Close stops the git cat-file process.
+func (r *BlobReader) Close() error {
+	r.in.Close()
+	return r.cmd.Wait()
+}
+
+// An Opener opens files by their virtual paths, reading each repository
+// with a single BlobReader.  It opens only the files under the roots
+// pinned to it, which are the revisions that have been indexed, or
+// directories in them; a root can be pinned to the commit it was at,
+// so that the files are read as they were indexed even if the revision
+// is a branch that has moved on.  An Opener can be used by several
+// goroutines at once.
+type Opener struct {
+	mu      sync.Mutex
+	roots   map[string]*root // pinned roots, by virtual path
+	readers map[string]*repoReader
+}
+
+// A root is a pinned root.
+type root struct {
+	repo, rev string
+	commit    string // commit to read the files from, or "" for rev
+}
+
+// A repoReader is the BlobReader of a repository, used by one
+// goroutine at a time.
+type repoReader struct {
+	mu sync.Mutex
+	r  *BlobReader
+}
+
+// Pin makes o open the files under path, the virtual path of a
+// revision or of a directory in one, reading them from commit, or from
+// the revision if commit is "".  It does nothing if path is not a
+// virtual path.
+func (o *Opener) Pin(path, commit string) {
+	repo, rev, _, ok := Split(path)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.roots == nil {
+		o.roots = make(map[string]*root)
+	}
+	o.roots[path] = &root{repo: repo, rev: rev, commit: commit}
+}
+
+// root returns the longest pinned root holding the file name, or nil.
+func (o *Opener) root(name string) *root {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var pin *root
+	n := 0
+	for r, p := range o.roots {
+		if len(r) > n && strings.HasPrefix(name, r) &&
+			(len(name) == len(r) || strings.HasSuffix(r, ":") || name[len(r)] == '/') {
+			pin, n = p, len(r)
+		}
+	}
+	return pin
+}
+
+// Split splits the virtual path name, as Split does, if it is under
+// one of the roots pinned to o.  It does not look in the file system.
+func (o *Opener) Split(name string) (repo, rev, path string, ok bool) {
+	r := o.root(name)
+	if r == nil {
+		return "", "", "", false
+	}
+	return r.repo, r.rev, name[len(Name(r.repo, r.rev, "")):], true
+}
+
+// reader returns the repoReader of the repository repo.
+func (o *Opener) reader(repo string) *repoReader {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.readers == nil {
+		o.readers = make(map[string]*repoReader)
+	}
+	rr := o.readers[repo]
+	if rr == nil {
+		rr = new(repoReader)
+		o.readers[repo] = rr
+	}
+	return rr
+}
+
+// Open opens the file with the virtual path name.
+func (o *Opener) Open(name string) (io.ReadCloser, error) {
+	r := o.root(name)
+	if r == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	commit := r.commit
+	if commit == "" {
+		commit = r.rev
+	}
+	object := commit + ":" + name[len(Name(r.repo, r.rev, "")):]
+	rr := o.reader(r.repo)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.r != nil && rr.r.err != nil {
+		rr.r.Close()
+		rr.r = nil
+	}
+	if rr.r == nil {
+		br, err := NewBlobReader(r.repo)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		rr.r = br
+	}
+	data, err := rr.r.Read(object)
+	if err != nil {
+		if rr.r.err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Close stops the git processes that o has started.
+func (o *Opener) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for repo, rr := range o.readers {
+		rr.mu.Lock()
+		if rr.r != nil {
+			rr.r.Close()
+		}
+		rr.mu.Unlock()
+		delete(o.readers, repo)
+	}
+}
+
+// opener is the Opener used by Open and Pin.
+var opener Opener
+
+// Open opens the file with the virtual path name, as if by an Opener
+// shared by all callers.
+func Open(name string) (io.ReadCloser, error) {
+	return opener.Open(name)
+}
+
+// Pin pins path to commit for Open, as described for Opener.Pin.
+func Pin(path, commit string) {
+	opener.Pin(path, commit)
+}
+
+// SplitPinned splits the virtual path name, as Split does, if it is
+// under one of the roots pinned for Open.
+func SplitPinned(name string) (repo, rev, path string, ok bool) {
+	return opener.Split(name)
+}
@@ -0,0 +1,238 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeRepo creates a repository in dir with two commits, the first
+// tagged v1 and the second on the branch main, and a bare clone of it
+// in dir/bare.git.  It skips the test if there is no git command.
+func makeRepo(t *testing.T, dir string) (work, bare string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git command")
+	}
+	work = filepath.Join(dir, "work")
+	bare = filepath.Join(dir, "bare.git")
+	git := func(args ...string) {
+		cmd := command(work, args...)
+		cmd.Env = append(cmd.Env,
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	write := func(name, data string) {
+		name = filepath.Join(work, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(work, 0777)
+	git("init", "-q")
+	git("checkout", "-q", "-b", "main")
+	write("a.b", "a.b v1\n")
+	write("a/x.go", "package x\n")
+	write("bin", "bin\x00ary\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "one")
+	git("tag", "v1")
+	write("a.b", "a.b v2\n")
+	if err := os.Symlink("a.b", filepath.Join(work, "link")); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "two")
+	git("clone", "-q", "--bare", ".", bare)
+	return work, bare
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	work, bare := makeRepo(t, dir)
+
+	for _, repo := range []string{work, bare} {
+		if !IsRepo(repo) {
+			t.Errorf("IsRepo(%s) = false", repo)
+		}
+		r, err := NewBlobReader(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct{ rev, want string }{
+			{"main", "a.b=a.b v2 a/x.go=package x bin=bin\x00ary"},
+			{"v1", "a.b=a.b v1 a/x.go=package x bin=bin\x00ary"},
+		} {
+			files, err := Files(repo, tt.rev)
+			if err != nil {
+				t.Fatalf("Files(%s, %s): %v", repo, tt.rev, err)
+			}
+			Pin(Name(repo, tt.rev, ""), "")
+			var got []string
+			for _, f := range files {
+				data, err := r.Read(f.Hash)
+				if err != nil {
+					t.Fatalf("Read(%s): %v", f.Path, err)
+				}
+				if int64(len(data)) != f.Size {
+					t.Errorf("%s: size %d, read %d bytes", f.Path, f.Size, len(data))
+				}
+				got = append(got, f.Path+"="+strings.TrimSpace(string(data)))
+
+				rc, err := Open(Name(repo, tt.rev, f.Path))
+				if err != nil {
+					t.Fatalf("Open(%s): %v", Name(repo, tt.rev, f.Path), err)
+				}
+				opened, _ := ioutil.ReadAll(rc)
+				rc.Close()
+				if string(opened) != string(data) {
+					t.Errorf("Open(%s) read %q, want %q", Name(repo, tt.rev, f.Path), opened, data)
+				}
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("Files(%s, %s) = %q, want %q", repo, tt.rev, strings.Join(got, " "), tt.want)
+			}
+		}
+		if _, err := r.Read(strings.Repeat("0", 40)); err == nil {
+			t.Errorf("Read(missing) succeeded")
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if _, err := Files(repo, "nosuchrev"); err == nil {
+			t.Errorf("Files(%s, nosuchrev) succeeded", repo)
+		}
+		if _, err := Open(Name(repo, "v1", "link")); !os.IsNotExist(err) {
+			t.Errorf("Open(link): %v, want not exist", err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, bare := makeRepo(t, dir)
+	os.Mkdir(filepath.Join(dir, "u@x"), 0777)
+
+	for _, tt := range []struct {
+		name, repo, rev, path string
+	}{
+		{bare + "@main:a/x.go", bare, "main", "a/x.go"},
+		{bare + "@HEAD@{0}:a@b:c", bare, "HEAD@{0}", "a@b:c"},
+		{bare + "@v1:", bare, "v1", ""},
+		{bare + "@:a", "", "", ""},
+		{filepath.Join(dir, "u@x") + ":y", "", "", ""},
+		{filepath.Join(dir, "work") + "/a@main:x", "", "", ""},
+		{bare + "@--output=x:a", "", "", ""},
+	} {
+		repo, rev, path, ok := Split(tt.name)
+		if repo != tt.repo || rev != tt.rev || path != tt.path || ok != (tt.repo != "") {
+			t.Errorf("Split(%q) = %q, %q, %q, %v, want %q, %q, %q", tt.name, repo, rev, path, ok, tt.repo, tt.rev, tt.path)
+		}
+	}
+}
+
+func TestOpener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, bare := makeRepo(t, dir)
+
+	v1, err := Commit(bare, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := Commit(bare, "main~1"); c != v1 || err != nil {
+		t.Errorf("Commit(main~1) = %q, %v, want %q", c, err, v1)
+	}
+	if c, err := Commit(bare, "nosuchrev"); err == nil {
+		t.Errorf("Commit(nosuchrev) = %q, want error", c)
+	}
+	// A revision is never taken for an option.
+	out := filepath.Join(dir, "out")
+	if c, err := Commit(bare, "--output="+out); err == nil {
+		t.Errorf("Commit(--output) = %q, want error", c)
+	}
+	if _, err := Files(bare, "--output="+out); err == nil {
+		t.Errorf("Files(--output) succeeded")
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("git wrote %s", out)
+	}
+
+	read := func(o *Opener, name string) string {
+		rc, err := o.Open(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				t.Errorf("Open(%s): %v", name, err)
+			}
+			return "missing"
+		}
+		defer rc.Close()
+		data, _ := ioutil.ReadAll(rc)
+		return strings.TrimSpace(string(data))
+	}
+	var o Opener
+	defer o.Close()
+	for _, tt := range []struct {
+		pin, commit string
+		name, want  string
+	}{
+		{"main:", "", "main:a.b", "a.b v2"},
+		// A tree is not a file, and reading it leaves
+		// the process ready for the next file.
+		{"", "", "main:a", "missing"},
+		{"", "", "main:nosuchfile", "missing"},
+		{"", "", "main:a/x.go", "package x"},
+		// Only the files under pinned roots are opened.
+		{"", "", "HEAD:link", "missing"},
+		// The pinned root is read from its commit,
+		// and other revisions are not.
+		{"main:", v1, "main:a.b", "a.b v1"},
+		{"", "", "main:link", "missing"},
+		{"HEAD:", "", "HEAD:link", "a.b"},
+		{"HEAD:a", v1, "HEAD:a.b", "a.b v2"},
+		{"HEAD:a", v1, "HEAD:a/x.go", "package x"},
+	} {
+		if tt.pin != "" {
+			o.Pin(bare+"@"+tt.pin, tt.commit)
+		}
+		if have := read(&o, bare+"@"+tt.name); have != tt.want {
+			t.Errorf("Open(%s) after pinning %s = %q, want %q", tt.name, tt.pin, have, tt.want)
+		}
+	}
+
+	// Split finds the names under the pinned roots only.
+	for _, tt := range []struct {
+		name, rev, path string
+	}{
+		{bare + "@HEAD:a/x.go", "HEAD", "a/x.go"},
+		{bare + "@main:", "main", ""},
+		{bare + "@v1:a.b", "", ""},
+		{bare + "x@main:a", "", ""},
+	} {
+		repo, rev, path, ok := o.Split(tt.name)
+		if tt.rev == "" && ok || tt.rev != "" && (repo != bare || rev != tt.rev || path != tt.path || !ok) {
+			t.Errorf("Split(%q) = %q, %q, %q, %v, want %q, %q, %q", tt.name, repo, rev, path, ok, bare, tt.rev, tt.path)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ignore decides which files to skip while walking a tree,
+// using the patterns of .gitignore files and, as described in rules.go,
+// ordered include and exclude rules.
+//
+// A Matcher holds the patterns that apply in one directory of the
+// tree.  Its patterns come from the files named by Files in that
+// directory and its parents, and, in the top directory of a git
+// repository, from .git/info/exclude.  As in git, a pattern in a
+// deeper directory takes precedence over one in a parent, a later
+// pattern takes precedence over an earlier one, and the patterns of
+// .gitignore files outside a git repository do not apply inside it.
+// The patterns of the other files apply across repositories.
+//
+// Patterns follow gitignore(5): blank lines and lines beginning with #
+// are ignored; ! negates a pattern; a trailing / makes a pattern match
+// only directories; a pattern containing a / is anchored to the
+// directory holding the file, and one without matches a name at any
+// depth; *, ? and [...] match within a path element, and ** matches
+// any number of directories.  A file in an ignored directory cannot
+// be included again by a negated pattern, since a walk does not
+// visit the directory.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files lists the names of the files read for patterns in each
+// directory, from lowest precedence to highest.
+var Files = []string{".gitignore", ".ignore", ".csearchignore"}
+
+// A Matcher reports which entries of a directory are ignored.
+type Matcher struct {
+	parent   *Matcher
+	name     string    // name of the directory in parent
+	repo     bool      // whether the directory holds a git repository
+	patterns []pattern // in order of increasing precedence
+}
+
+// A pattern is a single line of an ignore file.
+type pattern struct {
+	re      *regexp.Regexp // matches the path relative to the file's directory
+	negate  bool           // whether a match includes the file
+	dirOnly bool           // whether the pattern matches only directories
+	git     bool           // whether it is from .gitignore or .git/info/exclude
+}
+
+// New returns the Matcher for the directory root.  If root is inside
+// a git repository, the patterns from the directories between the top
+// of the repository and root apply as well.  The error, if any, is
+// from reading an ignore file; the Matcher is still usable.
+func New(root string) (*Matcher, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// Find the top of the repository holding root, if any.
+	dirs := []string{abs}
+	for d := abs; !isRepo(d); {
+		parent := filepath.Dir(d)
+		if parent == d {
+			dirs = dirs[:1]
+			break
+		}
+		d = parent
+		dirs = append(dirs, d)
+	}
+
+	var m *Matcher
+	var firstErr error
+	for i := len(dirs) - 1; i >= 0; i-- {
+		var err error
+		m, err = m.Enter(filepath.Base(dirs[i]), dirs[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return m, firstErr
+}
+
+// Enter returns the Matcher for the subdirectory elem of the
+// directory of m, whose ignore files are read from dir.  The two
+// differ when the subdirectory is a symbolic link.  The error, if
+// any, is from reading an ignore file; the Matcher is still usable.
+func (m *Matcher) Enter(elem, dir string) (*Matcher, error) {
+	c := &Matcher{parent: m, name: elem, repo: isRepo(dir)}
+	var firstErr error
+	read := func(file string, git bool) {
+		if err := c.read(file, git); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, ".git")); err == nil && fi.IsDir() {
+		read(filepath.Join(dir, ".git", "info", "exclude"), true)
+	}
+	for _, name := range Files {
+		read(filepath.Join(dir, name), name == ".gitignore")
+	}
+	return c, firstErr
+}
+
+// isRepo reports whether dir is the top directory of a git repository.
+// In a submodule or worktree, .git is a file.
+func isRepo(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// read adds the patterns in file to m.
+func (m *Matcher) read(file string, git bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		p, ok, err := parse(s.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if ok {
+			p.git = git
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	return s.Err()
+}
+
+// Match reports whether the entry elem of the directory of m is
+// ignored.  isDir says whether it is a directory.
+func (m *Matcher) Match(elem string, isDir bool) bool {
+	rel := elem
+	git := true
+	for ; m != nil; m = m.parent {
+		for i := len(m.patterns) - 1; i >= 0; i-- {
+			p := &m.patterns[i]
+			if p.git && !git || p.dirOnly && !isDir {
+				continue
+			}
+			if p.re.MatchString(rel) {
+				return !p.negate
+			}
+		}
+		if m.repo {
+			git = false
+		}
+		rel = m.name + "/" + rel
+	}
+	return false
+}
+
+// Compile returns a regular expression matching the slash-separated
+// paths matched by the glob pattern pat, which is anchored at the
+// start of the path if anchored is true and may otherwise match any
+// final sequence of path elements.  In pat, * and ? match within a
+// path element, [...] matches a character class, which [!...] negates,
+// \ quotes the next character, and ** matches any number of path
+// elements when it is a whole element.
+func Compile(pat string, anchored bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pat[i:], "**") &&
+			(i == 0 || pat[i-1] == '/') && (i+2 == len(pat) || pat[i+2] == '/'):
+			if i+2 == len(pat) {
+				// Everything, or everything inside the
+				// directory before it.
+				b.WriteString(".*")
+			} else {
+				// Zero or more directories.
+				b.WriteString("(?:.*/)?")
+				i++
+			}
+			i++
+		case c == '*':
+			for i+1 < len(pat) && pat[i+1] == '*' {
+				i++
+			}
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			class, n, ok := compileClass(pat[i:])
+			if !ok {
+				return nil, fmt.Errorf("unterminated [ in %q", pat)
+			}
+			b.WriteString(class)
+			i += n - 1
+		case c == '\\':
+			if i+1 == len(pat) {
+				return nil, fmt.Errorf("trailing \\ in %q", pat)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compileClass translates the character class at the start of pat
+// into a regular expression.  It returns the expression, the length
+// of the class in pat, and whether the class is terminated.
+func compileClass(pat string) (string, int, bool) {
+	var b strings.Builder
+	b.WriteString("[")
+	i := 1
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		b.WriteString("^/")
+		i++
+	}
+	for start := i; i < len(pat); i++ {
+		c := pat[i]
+		switch {
+		case c == ']' && i > start:
+			b.WriteString("]")
+			return b.String(), i + 1, true
+		case c == '\\' && i+1 < len(pat):
+			i++
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		case c == '-':
+			b.WriteString("-")
+		default:
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	return "", 0, false
+}
+
+// parse parses a line of an ignore file.
+// It returns ok == false for blank lines and comments.
+func parse(line string) (p pattern, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	if strings.HasPrefix(line, "#") {
+		return p, false, nil
+	}
+	// Trailing spaces are ignored unless quoted with \.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false, nil
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if p.re, err = Compile(line, anchored); err != nil {
+		return p, false, err
+	}
+	return p, true, nil
+}
@@ -0,0 +1,188 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var compileTests = []struct {
+	pat      string
+	anchored bool
+	match    []string
+	noMatch  []string
+}{
+	{"foo", false, []string{"foo", "a/foo", "a/b/foo"}, []string{"foox", "xfoo", "foo/a"}},
+	{"foo", true, []string{"foo"}, []string{"a/foo"}},
+	{"*.o", false, []string{"x.o", "a/b/.o"}, []string{"x.o/y", "x.obj"}},
+	{"a/*.o", true, []string{"a/x.o"}, []string{"a/b/x.o", "b/a/x.o"}},
+	{"f?o", false, []string{"foo", "d/fxo"}, []string{"fo", "f/o"}},
+	{"[a-c]x", false, []string{"ax", "cx"}, []string{"dx", "/x"}},
+	{"[!a-c]x", false, []string{"dx"}, []string{"ax", "a//x"}},
+	{"[]]x", false, []string{"]x"}, []string{"x"}},
+	{`\*x`, false, []string{"*x"}, []string{"ax"}},
+	{"**/foo", true, []string{"foo", "a/foo", "a/b/foo"}, []string{"afoo"}},
+	{"a/**", true, []string{"a/b", "a/b/c"}, []string{"a", "b/a/c"}},
+	{"a/**/b", true, []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"a/xb", "ab"}},
+	{"a**b", true, []string{"ab", "axxb"}, []string{"a/b"}},
+	{"**", true, []string{"a", "a/b"}, nil},
+	{"third_party/**/test/*.json", true, []string{"third_party/test/x.json", "third_party/a/b/test/x.json"}, []string{"third_party/test/a/x.json", "x/third_party/test/x.json"}},
+}
+
+func TestCompile(t *testing.T) {
+	for _, tt := range compileTests {
+		re, err := Compile(tt.pat, tt.anchored)
+		if err != nil {
+			t.Errorf("Compile(%q, %v): %v", tt.pat, tt.anchored, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if !re.MatchString(s) {
+				t.Errorf("Compile(%q, %v) does not match %q", tt.pat, tt.anchored, s)
+			}
+		}
+		for _, s := range tt.noMatch {
+			if re.MatchString(s) {
+				t.Errorf("Compile(%q, %v) matches %q", tt.pat, tt.anchored, s)
+			}
+		}
+	}
+	for _, pat := range []string{"[ab", `ab\`} {
+		if _, err := Compile(pat, false); err == nil {
+			t.Errorf("Compile(%q) succeeded", pat)
+		}
+	}
+}
+
+// writeTree creates the files in the map, with the given contents,
+// under dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// walk walks the tree at root as cindex does, returning
+// the slash-separated names of the files not ignored.
+func walk(t *testing.T, root string) []string {
+	m, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	matchers := map[string]*Matcher{root: m}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		m := matchers[filepath.Dir(path)]
+		if m.Match(info.Name(), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if matchers[path], err = m.Enter(info.Name(), path); err != nil {
+				t.Error(err)
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files
+}
+
+func TestMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"repo/.git/HEAD":         "",
+		"repo/.git/info/exclude": "*.tmp\n",
+		"repo/.gitignore": join(
+			"# comment",
+			"",
+			"*.o",
+			"!keep.o",
+			"build/",
+			"/top",
+			"docs/*.html",
+			"trailing  ",
+			`\#hash`,
+			`\!bang`,
+		),
+		"repo/a.go":               "",
+		"repo/a.o":                "",
+		"repo/keep.o":             "",
+		"repo/x.tmp":              "",
+		"repo/top":                "",
+		"repo/sub/top":            "",
+		"repo/sub/build":          "", // a file, not a directory
+		"repo/build/out.go":       "",
+		"repo/docs/a.html":        "",
+		"repo/docs/deep/a.html":   "",
+		"repo/trailing":           "",
+		"repo/#hash":              "",
+		"repo/!bang":              "",
+		"repo/sub/.gitignore":     "!a.o\nlocal\n",
+		"repo/sub/a.o":            "",
+		"repo/sub/local":          "",
+		"repo/sub/x.tmp":          "",
+		"repo/nested/.git":        "gitdir: elsewhere\n",
+		"repo/nested/a.o":         "",
+		"repo/nested/b.tmp":       "",
+		"repo/nested/.ignore":     "b.tmp\n",
+		"repo/.csearchignore":     "*.go\n!sub/**\n",
+		"repo/sub/z.go":           "",
+		"repo/sub/.csearchignore": "",
+	})
+	repo := filepath.Join(dir, "repo")
+	want := []string{
+		".csearchignore",
+		".git/HEAD",
+		".git/info/exclude",
+		".gitignore",
+		"docs/deep/a.html",
+		"keep.o",
+		"nested/.git",
+		"nested/.ignore",
+		"nested/a.o",
+		"sub/.csearchignore",
+		"sub/.gitignore",
+		"sub/a.o",
+		"sub/build",
+		"sub/top",
+		"sub/x.tmp", // included again by !sub/**
+		"sub/z.go",
+	}
+	if got := walk(t, repo); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("walk(repo) =\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+
+	// The patterns from the top of the repository apply
+	// when walking a subdirectory.
+	want = []string{".csearchignore", ".gitignore", "a.o", "build", "top", "x.tmp", "z.go"}
+	if got := walk(t, filepath.Join(repo, "sub")); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("walk(repo/sub) = %v, want %v", got, want)
+	}
+}
+
+func join(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
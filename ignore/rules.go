@@ -0,0 +1,144 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ignore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Include and exclude rules.
+//
+// Rules is an ordered list of rules, each of which includes or
+// excludes the files or directories whose slash-separated paths,
+// relative to the root of the tree being walked, match a pattern:
+//
+//	# comment
+//	exclude third_party/**/test/*.json
+//	exclude **
+//	include services/**/*.go
+//	include services/**/*.proto
+//	exclude build/
+//	exclude re:(^|/)gen_[^/]*\.go$
+//
+// "+" and "-" may be written for include and exclude.  The last rule
+// that matches a path decides whether it is included; a path that no
+// rule matches is included.
+//
+// A pattern is a glob, as in a .gitignore file, or a regular expression
+// following "re:".  A glob ending in / applies only to directories, and
+// any other glob only to files; a glob containing another / is matched
+// against the whole path, and a glob without one against the final
+// elements of the path.  A regular expression is matched against the
+// paths of files and the paths, followed by /, of directories, and
+// matches anywhere in them unless it is anchored.
+//
+// An excluded directory is not walked, so nothing in it can be included.
+// The rules above, for example, index only the .go and .proto files
+// under services, and do not walk any directory named build.
+
+// Rules is an ordered list of include and exclude rules.
+// A nil *Rules excludes nothing.
+type Rules struct {
+	lines []string
+	rules []rule
+}
+
+// A rule is a single include or exclude rule.
+type rule struct {
+	include  bool
+	re       *regexp.Regexp
+	dirOnly  bool // whether the rule applies only to directories
+	fileOnly bool // whether the rule applies only to files
+}
+
+// ParseRules parses the rules in text, one to a line.
+// Blank lines and lines beginning with # are ignored.
+func ParseRules(text string) (*Rules, error) {
+	r := new(Rules)
+	for i, line := range strings.Split(text, "\n") {
+		if err := r.Add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return r, nil
+}
+
+// Add parses a single rule and adds it after the others.
+// It ignores blank lines and comments.
+func (r *Rules) Add(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	var ru rule
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return fmt.Errorf("missing pattern in rule %q", line)
+	}
+	switch line[:i] {
+	case "include", "+":
+		ru.include = true
+	case "exclude", "-":
+	default:
+		return fmt.Errorf("rule %q is not include or exclude", line)
+	}
+	pat := strings.TrimSpace(line[i:])
+	var err error
+	if strings.HasPrefix(pat, "re:") {
+		ru.re, err = regexp.Compile(pat[len("re:"):])
+	} else {
+		ru.dirOnly = strings.HasSuffix(pat, "/")
+		ru.fileOnly = !ru.dirOnly
+		pat = strings.TrimRight(pat, "/")
+		if pat == "" {
+			return fmt.Errorf("missing pattern in rule %q", line)
+		}
+		anchored := strings.Contains(pat, "/")
+		ru.re, err = Compile(strings.TrimPrefix(pat, "/"), anchored)
+	}
+	if err != nil {
+		return err
+	}
+	r.lines = append(r.lines, line)
+	r.rules = append(r.rules, ru)
+	return nil
+}
+
+// Lines returns the rules added to r, as written.
+func (r *Rules) Lines() []string {
+	if r == nil {
+		return nil
+	}
+	return r.lines
+}
+
+// Excluded reports whether the rules exclude the file or directory with
+// the slash-separated path rel, relative to the root of the tree.
+// isDir says whether it is a directory.
+func (r *Rules) Excluded(rel string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	relDir := ""
+	for i := len(r.rules) - 1; i >= 0; i-- {
+		ru := &r.rules[i]
+		if isDir && ru.fileOnly || !isDir && ru.dirOnly {
+			continue
+		}
+		s := rel
+		if isDir && !ru.dirOnly {
+			// A regular expression.
+			if relDir == "" {
+				relDir = rel + "/"
+			}
+			s = relDir
+		}
+		if ru.re.MatchString(s) {
+			return !ru.include
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ignore
+
+import (
+	"testing"
+)
+
+var exampleRules = `
+# comment
+exclude third_party/**/test/*.json
+exclude **
+include services/**/*.go
++ services/**/*.proto
+- build/
+exclude re:(^|/)gen_[^/]*\.go$
+`
+
+var rulesTests = []struct {
+	rel      string
+	isDir    bool
+	excluded bool
+}{
+	{"README", false, true},
+	{"main.go", false, true},
+	{"services", true, false},
+	{"services/a/b.go", false, false},
+	{"services/a/b.proto", false, false},
+	{"services/a/b.json", false, true},
+	{"services/a/gen_b.go", false, true},
+	{"services/build", true, true},
+	{"services/build", false, true},
+	{"services/build.go", false, false},
+	{"third_party", true, false},
+	{"third_party/x/test", true, false},
+	{"gen_x.go", true, false}, // re: is matched against gen_x.go/
+}
+
+func TestRules(t *testing.T) {
+	r, err := ParseRules(exampleRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.Lines()); n != 6 {
+		t.Errorf("len(Lines()) = %d, want 6", n)
+	}
+	for _, tt := range rulesTests {
+		if excluded := r.Excluded(tt.rel, tt.isDir); excluded != tt.excluded {
+			t.Errorf("Excluded(%q, %v) = %v, want %v", tt.rel, tt.isDir, excluded, tt.excluded)
+		}
+	}
+
+	var none *Rules
+	if none.Excluded("a", false) || none.Lines() != nil {
+		t.Errorf("nil Rules excludes files")
+	}
+
+	for _, bad := range []string{"exclude", "keep *.go", "include re:(", "exclude /"} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("ParseRules(%q) succeeded", bad)
+		}
+	}
+}
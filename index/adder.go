@@ -0,0 +1,361 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/waddyano/codesearch/archive"
+)
+
+// Adding files in parallel.
+//
+// Reading a file and collecting its trigrams is most of the work of
+// indexing it, and it depends only on the file.  An Adder hands the
+// files queued with AddFile to several goroutines, each with its own
+// trigram set, to do that part.  A single goroutine then adds the
+// results to the IndexWriter in the order in which the files were
+// queued, assigning file IDs as AddFile would have, so the index is
+// the same as if the files had been added one at a time.
+//
+// Each file is handed to a reader and queued for the committer at the
+// same time; the committer waits for the file at the head of its queue
+// to be read.  The length of that queue bounds the number of files
+// that have been read but not yet added.  The files in an archive are
+// handed to the committer as they are read, and at most
+// archiveBufSize bytes of them are held until they can be added.
+
+// An Adder adds files to an IndexWriter using several goroutines.
+type Adder struct {
+	// Done, if not nil, is called after each file queued with
+	// AddFile has been added or skipped, in the order in which
+	// they were queued.
+	Done func(name string, added bool)
+
+	ix       *IndexWriter
+	read     chan *addJob // files to be read
+	commit   chan *addJob // files to be added, in order
+	finished chan bool
+}
+
+// An addJob is a file queued with Adder.AddFile, AddData or
+// AddArchive, or a file in an archive.
+type addJob struct {
+	rootNo  int
+	name    string
+	archive bool      // whether the file is an archive
+	inline  bool      // whether the contents are data, from AddData
+	data    []byte    // contents of the file
+	done    chan bool // closed once the file has been read
+
+	members chan *addJob // files of an archive to add, in walk order
+
+	fi       os.FileInfo
+	ok       bool   // whether to add the file
+	reuse    bool   // whether the old index has the file unchanged
+	size     int64  // size read
+	sum      []byte // hash of the file
+	trigrams []uint32
+	content  []byte // compressed contents, with StoreContents
+	err      error  // from a corrupt old index
+}
+
+// NewAdder returns an Adder that reads files using n goroutines.
+// Each goroutine that reads a file needs a trigram set of 64MB,
+// so n should be no more than the number of CPUs.
+// Until its Wait method returns, ix must not be used directly.
+func (ix *IndexWriter) NewAdder(n int) *Adder {
+	if n < 1 {
+		n = 1
+	}
+	a := &Adder{
+		ix:       ix,
+		read:     make(chan *addJob, n),
+		commit:   make(chan *addJob, 4*n),
+		finished: make(chan bool),
+	}
+	for i := 0; i < n; i++ {
+		go a.reader()
+	}
+	go a.committer()
+	return a
+}
+
+// AddFile queues the file with the given name to be added to the index
+// as if by IndexWriter.AddFile.  It blocks if too many files are queued.
+func (a *Adder) AddFile(rootNo int, name string) {
+	j := &addJob{rootNo: rootNo, name: name, done: make(chan bool)}
+	a.commit <- j
+	a.read <- j
+}
+
+// AddData queues the file with the given name and contents to be added
+// to the index as if by IndexWriter.Add.
+func (a *Adder) AddData(rootNo int, name string, data []byte) {
+	j := &addJob{rootNo: rootNo, name: name, inline: true, data: data, done: make(chan bool)}
+	a.commit <- j
+	a.read <- j
+}
+
+// AddArchive queues the archive with the given name to be added to
+// the index as if by IndexWriter.AddArchive.
+func (a *Adder) AddArchive(rootNo int, name string) {
+	j := &addJob{rootNo: rootNo, name: name, archive: true, members: make(chan *addJob), done: make(chan bool)}
+	a.commit <- j
+	a.read <- j
+}
+
+// Wait waits for the queued files to be added and stops the Adder.
+// Errors writing the index are reported by the IndexWriter's Err and
+// Flush methods.
+func (a *Adder) Wait() {
+	close(a.read)
+	close(a.commit)
+	<-a.finished
+}
+
+// reader reads the files queued for reading.  It gets its fileReader
+// when it is first given a file, and returns it when the Adder stops.
+func (a *Adder) reader() {
+	var r *fileReader
+	for j := range a.read {
+		if r == nil {
+			r = fileReaders.Get().(*fileReader)
+		}
+		a.readJob(r, j)
+		close(j.done)
+	}
+	if r != nil {
+		fileReaders.Put(r)
+	}
+}
+
+func (a *Adder) readJob(r *fileReader, j *addJob) {
+	ix := a.ix
+	defer catch(&j.err)
+	if j.archive {
+		defer close(j.members)
+		ix.readArchive(r, j.rootNo, j.name, func(m *addJob) { j.members <- m })
+		return
+	}
+	if j.inline {
+		if ix.readFile(r, j.rootNo, j.name, bytes.NewReader(j.data), int64(len(j.data))) {
+			j.read(r)
+		}
+		j.data = nil
+		return
+	}
+	fi, err := os.Stat(j.name)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	j.fi = fi
+	if ix.old != nil {
+		if _, ok := ix.unchanged(j.rootNo, j.name, fi); ok {
+			j.reuse = true
+			return
+		}
+	}
+	f, err := os.Open(j.name)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer f.Close()
+	if ix.readFile(r, j.rootNo, j.name, f, fi.Size()) {
+		j.read(r)
+	}
+}
+
+// read records in j the file just read by r.
+func (j *addJob) read(r *fileReader) {
+	j.ok = true
+	j.size = r.n
+	j.sum = r.hash.Sum(nil)
+	j.trigrams = append([]uint32(nil), r.trigram.Dense()...)
+	j.content = r.content
+}
+
+// mtime returns the modification time of the file read by j,
+// which is zero for a file added by AddData.
+func (j *addJob) mtime() time.Time {
+	if j.fi == nil {
+		return time.Time{}
+	}
+	return j.fi.ModTime()
+}
+
+// committer adds the files that have been read, in order.
+// The files of an archive are added while it is being read.
+func (a *Adder) committer() {
+	for j := range a.commit {
+		if !j.archive {
+			<-j.done
+		}
+		added := a.add(j)
+		if a.Done != nil {
+			a.Done(j.name, added)
+		}
+	}
+	close(a.finished)
+}
+
+// add adds the file read by j to the index.
+func (a *Adder) add(j *addJob) bool {
+	ix := a.ix
+	if j.archive {
+		ok := ix.checkName(j.name)
+		n := 0
+		for m := range j.members {
+			if ok = ok && ix.addMember(m); ok {
+				n++
+			}
+		}
+		<-j.done
+		if j.err != nil && ix.err == nil {
+			ix.err = j.err
+		}
+		return n > 0
+	}
+	if j.err != nil && ix.err == nil {
+		ix.err = j.err
+	}
+	if !ix.checkName(j.name) {
+		return false
+	}
+	switch {
+	case j.reuse:
+		// The file may still have to be read if reusing
+		// it would take the old files out of order.
+		return ix.AddFile(j.rootNo, j.name)
+	case j.ok:
+		ix.addTrigrams(j.rootNo, j.name, j.mtime(), j.size, j.sum, j.trigrams, j.content)
+		return true
+	}
+	return false
+}
+
+// archiveBufSize bounds the total size of the files of an archive
+// that readArchive holds at once.
+var archiveBufSize int64 = 64 << 20
+
+// errArchiveRead stops a walk of an archive once the files
+// wanted from it have been read.
+var errArchiveRead = errors.New("archive read")
+
+// readArchive reads the files in the archive with the given name,
+// calling add with a job, read, for each one to be added, in walk
+// order.  An archive can have the same name more than once; the first
+// one wins, as in archive.Open.  The files are read in the order in
+// which the archive stores them and held until they can be added in
+// walk order, so if they come to more than archiveBufSize bytes, the
+// archive is read again for each run of them, in walk order, that
+// fits.  It logs errors reading the archive using package log.
+func (ix *IndexWriter) readArchive(r *fileReader, rootNo int, name string, add func(*addJob)) {
+	read := func(member string, fi os.FileInfo, f io.Reader) *addJob {
+		j := &addJob{rootNo: rootNo, name: archive.Join(name, member), fi: fi}
+		if !ix.readFile(r, rootNo, j.name, f, fi.Size()) {
+			return nil
+		}
+		j.read(r)
+		return j
+	}
+
+	// The files of the archive, with the jobs of those read
+	// on the first pass, by their position in the archive.
+	type member struct {
+		name string
+		size int64
+		pos  int
+	}
+	var members []member
+	var jobs []*addJob
+	var held int64
+	err := archive.Walk(name, func(m string, fi os.FileInfo, f io.Reader) error {
+		members = append(members, member{archive.Join(name, m), fi.Size(), len(members)})
+		if held <= archiveBufSize {
+			held += fi.Size()
+			jobs = append(jobs, read(m, fi, f))
+			if held > archiveBufSize {
+				jobs = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+	}
+	sort.SliceStable(members, func(i, k int) bool {
+		return comparePaths(members[i].name, members[k].name) < 0
+	})
+	n := 0
+	for _, m := range members {
+		if n == 0 || members[n-1].name != m.name {
+			members[n] = m
+			n++
+		}
+	}
+	members = members[:n]
+	if held <= archiveBufSize {
+		for _, m := range members {
+			if j := jobs[m.pos]; j != nil {
+				add(j)
+			}
+		}
+		return
+	}
+
+	for len(members) > 0 {
+		size, last := members[0].size, members[0].pos
+		k := 1
+		for ; k < len(members) && size+members[k].size <= archiveBufSize; k++ {
+			size += members[k].size
+			if members[k].pos > last {
+				last = members[k].pos
+			}
+		}
+		run := make(map[int]*addJob)
+		for _, m := range members[:k] {
+			run[m.pos] = nil
+		}
+		pos := 0
+		err := archive.Walk(name, func(m string, fi os.FileInfo, f io.Reader) error {
+			if pos > last {
+				return errArchiveRead
+			}
+			if _, ok := run[pos]; ok {
+				run[pos] = read(m, fi, f)
+			}
+			pos++
+			return nil
+		})
+		if err != nil && err != errArchiveRead {
+			log.Print(err)
+			return
+		}
+		for _, m := range members[:k] {
+			if j := run[m.pos]; j != nil {
+				add(j)
+			}
+		}
+		members = members[k:]
+	}
+}
+
+// addMember adds a file of an archive read by readArchive,
+// reporting false if it could not be added.
+func (ix *IndexWriter) addMember(j *addJob) bool {
+	if !ix.checkName(j.name) {
+		return false
+	}
+	ix.addTrigrams(j.rootNo, j.name, j.mtime(), j.size, j.sum, j.trigrams, j.content)
+	return true
+}
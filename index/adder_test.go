@@ -0,0 +1,231 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addDir indexes the files in dir using an Adder with n readers,
+// reusing the files in old, and returns the index file and the
+// names passed to Done.
+func addDir(t *testing.T, dir string, n int, old *Index) (string, []string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	ix := Create(f.Name())
+	ix.AddPaths([]string{dir})
+	if old != nil {
+		ix.Reuse(old)
+	}
+	var done []string
+	a := ix.NewAdder(n)
+	a.Done = func(name string, added bool) {
+		done = append(done, name)
+	}
+	for _, fi := range infos {
+		a.AddFile(0, filepath.Join(dir, fi.Name()))
+	}
+	// Not a file.
+	a.AddFile(0, filepath.Join(dir, "missing"))
+	a.Wait()
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name(), done
+}
+
+func TestAdder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	files := manyFiles("", 500, func(i int) string {
+		return strings.Repeat(fmt.Sprintf("file %d\n", i), i%50)
+	})
+	files["binary"] = "\x00\x01\x02"
+	serial, _ := writeDir(t, dir, files, t1, nil)
+	defer os.Remove(serial)
+	parallel, done := addDir(t, dir, 8, nil)
+	defer os.Remove(parallel)
+	checkSameIndex(t, "parallel index", parallel, serial)
+	if len(done) != len(files)+1 || done[0] != filepath.Join(dir, "binary") || done[len(done)-1] != filepath.Join(dir, "missing") {
+		t.Errorf("Done called for %d files, from %s to %s", len(done), done[0], done[len(done)-1])
+	}
+
+	// Reusing unchanged files.
+	old := Open(serial)
+	changed := map[string]string{"f100": "changed\n"}
+	serial2, _ := writeDir(t, dir, changed, t2, old)
+	defer os.Remove(serial2)
+	parallel2, _ := addDir(t, dir, 8, old)
+	defer os.Remove(parallel2)
+	old.Close()
+	checkSameIndex(t, "parallel index with reuse", parallel2, serial2)
+}
+
+// checkSameIndex checks that the index files have the same content.
+func checkSameIndex(t *testing.T, what, file, want string) {
+	t.Helper()
+	data1, _ := ioutil.ReadFile(file)
+	data2, _ := ioutil.ReadFile(want)
+	if string(data1) != string(data2) {
+		i := 0
+		for i < len(data1) && i < len(data2) && data1[i] == data2[i] {
+			i++
+		}
+		t.Errorf("%s differs at %d of %d/%d", what, i, len(data1), len(data2))
+	}
+}
+
+func TestAddArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jar := filepath.Join(dir, "a.jar")
+	f, err := os.Create(jar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	for _, m := range []struct{ name, data string }{
+		{"x.z", "hello x.z\n"},
+		{"x/y", "hello x/y\n"},
+		{"bin", "bin\x00ary\n"},
+		{"a", "hello a\n"},
+		{"x/y", "hello again\n"},
+	} {
+		w, _ := z.Create(m.name)
+		io.WriteString(w, m.data)
+	}
+	z.Close()
+	f.Close()
+	// Names less than the archive's members in byte order
+	// but after them in walk order.
+	ioutil.WriteFile(filepath.Join(dir, "a.jar x"), []byte("hello\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "a.jar-"), []byte("hello\n"), 0666)
+	names := []string{"a.jar", "a.jar x", "a.jar-"}
+
+	build := func(out string, parallel bool) {
+		ix := Create(out)
+		ix.AddPaths([]string{dir})
+		a := ix.NewAdder(4)
+		for _, name := range names {
+			name = filepath.Join(dir, name)
+			switch {
+			case strings.HasSuffix(name, ".jar") && parallel:
+				a.AddArchive(0, name)
+			case strings.HasSuffix(name, ".jar"):
+				if n := ix.AddArchive(0, name); n != 3 {
+					t.Errorf("AddArchive added %d files, want 3", n)
+				}
+			case parallel:
+				a.AddFile(0, name)
+			default:
+				ix.AddFile(0, name)
+			}
+		}
+		a.Wait()
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if problems, err := Verify(out); err != nil || len(problems) != 0 {
+			t.Errorf("Verify = %v, %v, want no problems", problems, err)
+		}
+	}
+	serial := filepath.Join(dir, "serial")
+	parallel := filepath.Join(dir, "parallel")
+	build(serial, false)
+	build(parallel, true)
+	checkSameIndex(t, "parallel index", parallel, serial)
+
+	// An archive too large to hold is read again for each
+	// run of its files that fits.
+	defer func(size int64) { archiveBufSize = size }(archiveBufSize)
+	for _, size := range []int64{0, 10, 20} {
+		archiveBufSize = size
+		small := filepath.Join(dir, "small")
+		build(small, false)
+		checkSameIndex(t, fmt.Sprintf("index holding %d bytes", size), small, serial)
+		build(small, true)
+		checkSameIndex(t, fmt.Sprintf("parallel index holding %d bytes", size), small, serial)
+	}
+
+	ix := Open(serial)
+	var got []string
+	for id := 0; id < ix.numName; id++ {
+		got = append(got, strings.TrimPrefix(ix.Name(uint32(id)), dir+"/"))
+	}
+	if want := "a.jar!/a a.jar!/x/y a.jar!/x.z a.jar x a.jar-"; strings.Join(got, " ") != want {
+		t.Errorf("names = %q, want %q", strings.Join(got, " "), want)
+	}
+	// The first x/y wins.
+	if l := ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{"gai"}}); len(l) != 0 {
+		t.Errorf("PostingQuery(gai) = %v, want []", l)
+	}
+	ix.Close()
+
+	// Removing the archive removes the files in it.
+	if n, err := Remove(filepath.Join(dir, "removed"), serial, []string{jar}); n != 3 || err != nil {
+		t.Errorf("Remove(a.jar) = %d, %v, want 3, nil", n, err)
+	}
+}
+
+func TestAddData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := "/repo@main:"
+	files := []struct{ name, data string }{
+		{"a", "hello a\n"},
+		{"bin", "bin\x00ary\n"},
+		{"empty", ""},
+		{"x/y", "hello x/y\n"},
+	}
+	build := func(out string, parallel bool) {
+		ix := Create(out)
+		ix.AddPaths([]string{root, "/repo@v1:"})
+		a := ix.NewAdder(4)
+		for _, f := range files {
+			if parallel {
+				a.AddData(0, root+f.name, []byte(f.data))
+			} else {
+				ix.Add(0, root+f.name, strings.NewReader(f.data), int64(len(f.data)))
+			}
+		}
+		a.Wait()
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serial := filepath.Join(dir, "serial")
+	parallel := filepath.Join(dir, "parallel")
+	build(serial, false)
+	build(parallel, true)
+	checkSameIndex(t, "parallel index", parallel, serial)
+
+	// A root ending in a colon holds the names that begin with it.
+	if n, err := Remove(filepath.Join(dir, "removed"), serial, []string{root}); n != 3 || err != nil {
+		t.Errorf("Remove(%s) = %d, %v, want 3, nil", root, n, err)
+	}
+}
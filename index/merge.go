@@ -23,20 +23,39 @@ package index
 //	25-34 maps to 40-49
 //
 // The number of ranges will be at most the combined number of paths.
-// Also during the merge, write the name index to a temporary file as usual.
+// Also during the merge, write the name index and file info to temporary files as usual.
+//
+// The posting lists hold documents (see read.go), which are mapped too:
+// an A document maps to the first of its files that C keeps, which is
+// not the document's own file if that was discarded.  Then the order
+// of A's documents in C may differ from their order in A, and A's
+// posting lists have to be sorted again as they are read.
+//
+// The stored contents (see read.go) are those of the documents, so C
+// stores an A document's content with the file it maps to.
 //
 // Now merge the posting lists (this is why they begin with the trigram).
 // During the merge, translate the docid numbers to the new C docid space.
 // Also during the merge, write the posting list index to a temporary file as usual.
 //
-// Copy the name index and posting list index into C's index and write the trailer.
+// Copy the name index, posting list index and file info into C's index
+// and write the section checksums and the trailer.
 // Rename C's index onto the new index.
+//
+// MergeMany merges any number of indexes the same way, each one newer
+// than the ones before it: the name lists of all of them are merged
+// together, a name being dropped if a later index has it or claims a
+// path containing it, and so are the posting lists.  The files that
+// have been removed from an index (see remove.go) are dropped too,
+// so "merging" a single index compacts it.
 
 import (
-	"encoding/binary"
-	"fmt"
-	"os"
+	"errors"
+	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/waddyano/codesearch/archive"
 )
 
 // An idrange records that the half-open interval [lo, hi) maps to [new, new+hi-lo).
@@ -44,219 +63,486 @@ type idrange struct {
 	lo, hi, new uint32
 }
 
+// addRange records in m that old maps to new, extending the last range if possible.
+func addRange(m []idrange, old, new uint32) []idrange {
+	if n := len(m); n > 0 && m[n-1].hi == old && m[n-1].new+(old-m[n-1].lo) == new {
+		m[n-1].hi++
+		return m
+	}
+	return append(m, idrange{old, old + 1, new})
+}
+
+// A rootMap records how a root of a source index is expressed
+// in the merged index: as root number root (1-based, as stored
+// in the name list), with prefix prepended to each relative name.
+type rootMap struct {
+	root   uint32
+	prefix string
+}
+
 type postIndex struct {
 	tri    uint32
 	count  uint32
-	offset uint32
+	offset uint64
 }
 
 // Merge creates a new index in the file dst that corresponds to merging
 // the two indices src1 and src2.  If both src1 and src2 claim responsibility
 // for a path, src2 is assumed to be newer and is given preference.
-func Merge(dst, src1, src2 string) {
-	ix1 := Open(src1)
-	defer ix1.Close()
-	ix2 := Open(src2)
-	defer ix2.Close()
-	paths1 := ix1.Paths()
-	paths2 := ix2.Paths()
-
-	// Build docid maps.
-	var i1, i2, new uint32
-	var map1, map2 []idrange
-	for _, path := range paths2 {
-		// Determine range shadowed by this path.
-		old := i1
-		for i1 < uint32(ix1.numName) && ix1.Name(i1) < path {
-			i1++
-		}
-		lo := i1
-		limit := path[:len(path)-1] + string(path[len(path)-1]+1)
-		for i1 < uint32(ix1.numName) && ix1.Name(i1) < limit {
-			i1++
-		}
-		hi := i1
+// If Merge returns an error, dst is left as it was.
+func Merge(dst, src1, src2 string) error {
+	return new(Merger).Merge(dst, src1, src2)
+}
 
-		// Record range before the shadow.
-		if old < lo {
-			map1 = append(map1, idrange{old, lo, new})
-			new += lo - old
-		}
+// MergeMany is like Merge but merges any number of indexes,
+// each of which is assumed to be newer than the ones before it:
+// a file is taken from the last index that has it or that claims
+// responsibility for a path containing it.  Files that have been
+// removed from an index are dropped.  Merging a single index
+// compacts it, rewriting its posting lists without the files
+// that have been removed.
+func MergeMany(dst string, srcs ...string) error {
+	return new(Merger).MergeMany(dst, srcs...)
+}
 
-		// Determine range defined by this path.
-		// Because we are iterating over the ix2 paths,
-		// there can't be gaps, so it must start at i2.
-		if i2 < uint32(ix2.numName) && ix2.Name(i2) < path {
-			panic(fmt.Sprintf("merge: inconsistent index %s %s", ix2.Name(i2), path))
-		}
-		lo = i2
-		for i2 < uint32(ix2.numName) && ix2.Name(i2) < limit {
-			i2++
-		}
-		hi = i2
-		if lo < hi {
-			map2 = append(map2, idrange{lo, hi, new})
-			new += hi - lo
+// A Merger merges indexes like Merge and MergeMany, with options.
+// The zero Merger is ready to use.
+type Merger struct {
+	// TempDir is the directory for the temporary files, other than
+	// the one that becomes the merged index.  If it is empty, the
+	// default directory for temporary files is used.
+	TempDir string
+}
+
+// Merge is like the Merge function but uses the options of m.
+func (m *Merger) Merge(dst, src1, src2 string) error {
+	return m.MergeMany(dst, src1, src2)
+}
+
+// MergeMany is like the MergeMany function but uses the options of m.
+func (m *Merger) MergeMany(dst string, srcs ...string) (err error) {
+	if len(srcs) == 0 {
+		return errors.New("merge: no indexes")
+	}
+	ixs := make([]*Index, len(srcs))
+	for k, src := range srcs {
+		ix, err := OpenE(src)
+		if err != nil {
+			return err
 		}
+		defer ix.Close()
+		ixs[k] = ix
 	}
+	defer catch(&err)
 
-	if i1 < uint32(ix1.numName) {
-		map1 = append(map1, idrange{i1, uint32(ix1.numName), new})
-		new += uint32(ix1.numName) - i1
+	// Merged list of paths.  A path inside another one is
+	// already covered by it and is dropped; the names under
+	// it are renumbered to the enclosing root.
+	var paths []string
+	for _, ix := range ixs {
+		paths = mergePaths(paths, ix.paths)
+	}
+	roots := make([][]rootMap, len(ixs))
+	for k, ix := range ixs {
+		roots[k] = mapRoots(ix.paths, paths)
+	}
+
+	// Build docid maps.  All the name lists are in walk order, so they
+	// can be merged like sorted lists, dropping the names that are
+	// shadowed by a later index and the files that have been removed.
+	maps := make([][]idrange, len(ixs))
+	next := make([]uint32, len(ixs)) // next docid in each index
+	names := make([]string, len(ixs))
+	advance := func(k int) {
+		if next[k]++; next[k] < uint32(ixs[k].numName) {
+			names[k] = ixs[k].name(next[k])
+		}
+	}
+	for k, ix := range ixs {
+		if ix.numName > 0 {
+			names[k] = ix.name(0)
+		}
 	}
-	if i2 < uint32(ix2.numName) {
-		panic("merge: inconsistent index")
+	var new uint32
+	for {
+		// The first name in walk order, from the last
+		// index that has it.
+		k := -1
+		for j, ix := range ixs {
+			if next[j] < uint32(ix.numName) && (k < 0 || comparePaths(names[j], names[k]) <= 0) {
+				k = j
+			}
+		}
+		if k < 0 {
+			break
+		}
+		name := names[k]
+		if !ixs[k].deleted(next[k]) && !shadowed(name, ixs[k+1:]) {
+			maps[k] = addRange(maps[k], next[k], new)
+			new++
+		}
+		for j := 0; j < k; j++ {
+			if next[j] < uint32(ixs[j].numName) && comparePaths(names[j], name) == 0 {
+				// Replaced by index k.
+				advance(j)
+			}
+		}
+		advance(k)
 	}
 	numName := new
 
-	ix3 := bufCreate(dst)
+	ix3, err := bufCreate(dst)
+	if err != nil {
+		return err
+	}
+	defer ix3.remove()
 	ix3.writeString(magic)
+	sect := sectionWriter{out: ix3}
 
 	// Merged list of paths.
-	pathData := ix3.offset()
-	mi1 := 0
-	mi2 := 0
-	last := "\x00" // not a prefix of anything
-	for mi1 < len(paths1) || mi2 < len(paths2) {
-		var p string
-		if mi2 >= len(paths2) || mi1 < len(paths1) && paths1[mi1] <= paths2[mi2] {
-			p = paths1[mi1]
-			mi1++
-		} else {
-			p = paths2[mi2]
-			mi2++
-		}
-		if strings.HasPrefix(p, last) {
-			continue
-		}
-		last = p
+	sect.start(sectionPaths)
+	for _, p := range paths {
 		ix3.writeString(p)
 		ix3.writeString("\x00")
 	}
 	ix3.writeString("\x00")
 
 	// Merged list of names.
-	nameData := ix3.offset()
-	nameIndexFile := bufCreate("")
+	nameData := sect.start(sectionNames)
+	nameIndexFile, err := bufTemp(m.TempDir)
+	if err != nil {
+		return err
+	}
+	defer nameIndexFile.remove()
+	fileInfoFile, err := bufTemp(m.TempDir)
+	if err != nil {
+		return err
+	}
+	defer fileInfoFile.remove()
+	var noInfo [fileInfoSize]byte
+
+	// The new document of each old document, or ^0.
+	docMap := make([][]uint32, len(ixs))
+	for k, ix := range ixs {
+		docMap[k] = make([]uint32, ix.numName)
+		for i := range docMap[k] {
+			docMap[k][i] = ^uint32(0)
+		}
+	}
+	docs := make([]uint32, 0, numName) // document of each new file
+	numCopies := 0
+
+	// The stored contents, if any index has them.
+	var contentFile, contentEndsFile *bufWriter
+	for _, ix := range ixs {
+		if ix.contents != 0 && contentFile == nil {
+			if contentFile, err = bufTemp(m.TempDir); err != nil {
+				return err
+			}
+			defer contentFile.remove()
+			if contentEndsFile, err = bufTemp(m.TempDir); err != nil {
+				return err
+			}
+			defer contentEndsFile.remove()
+		}
+	}
+	writeName := func(ix *Index, roots []rootMap, id uint32) {
+		root, name := ix.rootNoAndName(id)
+		if root > 0 {
+			if int(root) > len(roots) {
+				ix.corrupt(ix.nameOffset(id))
+			}
+			m := roots[root-1]
+			root = m.root
+			name = m.prefix + name
+		}
+		nameIndexFile.writeUint64(ix3.offset() - nameData)
+		ix3.writeUvarint(root)
+		ix3.writeString(name)
+		ix3.writeString("\x00")
+		if ix.fileInfo != 0 {
+			fileInfoFile.write(ix.slice(ix.fileInfo+uint64(id)*fileInfoSize, fileInfoSize))
+		} else {
+			fileInfoFile.write(noInfo[:])
+		}
+	}
 	new = 0
-	mi1 = 0
-	mi2 = 0
+	mi := make([]int, len(ixs)) // next range in each map
 	for new < numName {
-		if mi1 < len(map1) && map1[mi1].new == new {
-			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
-				root1, name := ix1.RootNoAndName(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
-				// need to map to possible new root
-				ix3.writeUvarint(root1)
-				ix3.writeString(name)
-				ix3.writeString("\x00")
-				new++
+		k := 0
+		for k < len(ixs) && (mi[k] >= len(maps[k]) || maps[k][mi[k]].new != new) {
+			k++
+		}
+		if k == len(ixs) {
+			return errInconsistent
+		}
+		for i := maps[k][mi[k]].lo; i < maps[k][mi[k]].hi; i++ {
+			writeName(ixs[k], roots[k], i)
+			doc := ixs[k].doc(i)
+			var content []byte
+			if docMap[k][doc] == ^uint32(0) {
+				docMap[k][doc] = new
+				content = ixs[k].contentData(doc)
+			} else {
+				numCopies++
 			}
-			mi1++
-		} else if mi2 < len(map2) && map2[mi2].new == new {
-			for i := map2[mi2].lo; i < map2[mi2].hi; i++ {
-				root2, name := ix2.RootNoAndName(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
-				// need to map to possible new root
-				ix3.writeUvarint(root2)
-				ix3.writeString(name)
-				ix3.writeString("\x00")
-				new++
+			docs = append(docs, docMap[k][doc])
+			if contentFile != nil {
+				contentFile.write(content)
+				contentEndsFile.writeUint64(contentFile.offset())
 			}
-			mi2++
-		} else {
-			panic("merge: inconsistent index")
+			new++
 		}
+		mi[k]++
 	}
-	if new*4 != nameIndexFile.offset() {
-		panic("merge: inconsistent index")
+	if uint64(new)*8 != nameIndexFile.offset() {
+		return errInconsistent
 	}
-	nameIndexFile.writeUint32(ix3.offset())
+	// Terminating empty name, as written by IndexWriter.Flush.
+	nameIndexFile.writeUint64(ix3.offset() - nameData)
+	ix3.writeUvarint(0)
+	ix3.writeString("\x00")
 
 	// Merged list of posting lists.
-	postData := ix3.offset()
-	var r1 postMapReader
-	var r2 postMapReader
+	sect.start(sectionPosts)
+	r := make([]postMapReader, len(ixs))
+	for k, ix := range ixs {
+		r[k].init(ix, docMap[k])
+	}
 	var w postDataWriter
-	r1.init(ix1, map1)
-	r2.init(ix2, map2)
-	w.init(ix3)
+	if err := w.init(ix3, m.TempDir); err != nil {
+		return err
+	}
+	defer w.postIndexFile.remove()
+	var cur []*postMapReader // readers positioned at trigram t
 	for {
-		if r1.trigram < r2.trigram {
-			w.trigram(r1.trigram)
-			for r1.nextId() {
-				w.fileid(r1.fileid)
-			}
-			r1.nextTrigram()
-			w.endTrigram()
-		} else if r2.trigram < r1.trigram {
-			w.trigram(r2.trigram)
-			for r2.nextId() {
-				w.fileid(r2.fileid)
+		t := ^uint32(0)
+		for k := range r {
+			if r[k].trigram < t {
+				t = r[k].trigram
 			}
-			r2.nextTrigram()
-			w.endTrigram()
-		} else {
-			if r1.trigram == ^uint32(0) {
-				break
+		}
+		if t == ^uint32(0) {
+			break
+		}
+		cur = cur[:0]
+		for k := range r {
+			if r[k].trigram == t {
+				r[k].nextId()
+				cur = append(cur, &r[k])
 			}
-			w.trigram(r1.trigram)
-			r1.nextId()
-			r2.nextId()
-			for r1.fileid < ^uint32(0) || r2.fileid < ^uint32(0) {
-				if r1.fileid < r2.fileid {
-					w.fileid(r1.fileid)
-					r1.nextId()
-				} else if r2.fileid < r1.fileid {
-					w.fileid(r2.fileid)
-					r2.nextId()
-				} else {
-					panic("merge: inconsistent index")
+		}
+		w.trigram(t)
+		for {
+			// The smallest new docid among the readers.
+			var min *postMapReader
+			for _, rk := range cur {
+				if min == nil || rk.fileid < min.fileid {
+					min = rk
+				} else if rk.fileid == min.fileid && rk.fileid != ^uint32(0) {
+					return errInconsistent
 				}
 			}
-			r1.nextTrigram()
-			r2.nextTrigram()
-			w.endTrigram()
+			if min.fileid == ^uint32(0) {
+				break
+			}
+			w.fileid(min.fileid)
+			min.nextId()
 		}
+		for _, rk := range cur {
+			rk.nextTrigram()
+		}
+		w.endTrigram()
 	}
+	// Terminating empty list, as written by IndexWriter.mergePost.
+	w.trigram(1<<24 - 1)
+	w.endTrigram()
 
 	// Name index
-	nameIndex := ix3.offset()
+	sect.start(sectionNameIndex)
 	copyFile(ix3, nameIndexFile)
 
 	// Posting list index
-	postIndex := ix3.offset()
+	sect.start(sectionPostIndex)
 	copyFile(ix3, w.postIndexFile)
 
-	ix3.writeUint32(pathData)
-	ix3.writeUint32(nameData)
-	ix3.writeUint32(postData)
-	ix3.writeUint32(nameIndex)
-	ix3.writeUint32(postIndex)
-	ix3.writeString(trailerMagic)
-	ix3.flush()
-	ix3.finish().Close()
-
-	os.Remove(nameIndexFile.name)
-	os.Remove(w.postIndexFile.name)
+	// File info
+	sect.start(sectionFileInfo)
+	copyFile(ix3, fileInfoFile)
+
+	// Documents
+	if numCopies > 0 {
+		writeDocs(&sect, docs)
+	}
+
+	// Contents
+	if contentFile != nil {
+		sect.start(sectionContents)
+		copyFile(ix3, contentFile)
+		copyFile(ix3, contentEndsFile)
+	}
+
+	// Path options, from the last index with each path.
+	opts := make([]string, len(paths))
+	for _, ix := range ixs {
+		for i, o := range ix.readPathOptions() {
+			for j, p := range paths {
+				if p == ix.paths[i] {
+					opts[j] = o
+				}
+			}
+		}
+	}
+	writePathOptions(&sect, opts)
+
+	sect.finish()
+	return ix3.commit(dst)
+}
+
+// shadowed reports whether name is inside one of the paths
+// of the indexes later, which take precedence.
+func shadowed(name string, later []*Index) bool {
+	for _, ix := range later {
+		if inPaths(name, ix.paths) {
+			return true
+		}
+	}
+	return false
+}
+
+var errInconsistent = errors.New("merge: inconsistent index")
+
+// mergePaths merges the path lists p1 and p2, which are in walk
+// order, dropping duplicates and paths inside an earlier path.
+func mergePaths(p1, p2 []string) []string {
+	var paths []string
+	add := func(p string) {
+		if !inPaths(p, paths) {
+			paths = append(paths, p)
+		}
+	}
+	i, j := 0, 0
+	for i < len(p1) || j < len(p2) {
+		if j >= len(p2) || i < len(p1) && comparePaths(p1[i], p2[j]) <= 0 {
+			add(p1[i])
+			i++
+		} else {
+			add(p2[j])
+			j++
+		}
+	}
+	return paths
+}
+
+// mapRoots returns, for each path in old, where its names
+// belong in the merged path list paths.
+func mapRoots(old, paths []string) []rootMap {
+	m := make([]rootMap, len(old))
+	for i, p := range old {
+		for j, q := range paths {
+			if hasPathPrefix(p, q) {
+				m[i] = rootMap{uint32(j + 1), p[len(q):]}
+				break
+			}
+		}
+	}
+	return m
+}
+
+// inPaths reports whether name is one of paths or inside one of them.
+func inPaths(name string, paths []string) bool {
+	for _, p := range paths {
+		if hasPathPrefix(name, p) {
+			return true
+		}
+	}
+	return false
 }
 
+// hasPathPrefix reports whether name is dir or a file
+// or directory inside dir, or a file in the archive dir.
+// A dir ending in a colon, such as the repo@rev: of a git
+// revision, holds every name that begins with it.
+func hasPathPrefix(name, dir string) bool {
+	if len(name) < len(dir) || name[:len(dir)] != dir {
+		return false
+	}
+	return len(name) == len(dir) || len(dir) > 0 && (isSeparator(dir[len(dir)-1]) || dir[len(dir)-1] == ':') ||
+		isSeparator(name[len(dir)]) || strings.HasPrefix(name[len(dir):], archive.Sep)
+}
+
+func isSeparator(c byte) bool {
+	return c == '/' || c == filepath.Separator
+}
+
+// ComparePaths compares two file names in the order of the name
+// list of an index, which is the order in which files must be added
+// to an IndexWriter.  It returns -1, 0 or +1.
+func ComparePaths(a, b string) int {
+	return comparePaths(a, b)
+}
+
+// comparePaths compares two file names in the order in which
+// filepath.Walk produces them, which is the order of the name list:
+// element by element, so a path separator sorts before any other byte.
+// The files in an archive follow the archive, so archive.Sep sorts as
+// a pair of separators.
+func comparePaths(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := pathByte(a, i), pathByte(b, i)
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return +1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return +1
+	}
+	return 0
+}
+
+// pathByte returns the byte at s[i] as comparePaths sees it.
+func pathByte(s string, i int) byte {
+	if isSeparator(s[i]) || strings.HasPrefix(s[i:], archive.Sep) {
+		return 0
+	}
+	return s[i]
+}
+
+// A postMapReader reads the posting lists of an index being merged,
+// translating the documents in them to new file IDs.
 type postMapReader struct {
 	ix      *Index
-	idmap   []idrange
+	docMap  []uint32 // new file ID of each document, or ^0
+	sorted  bool     // whether docMap keeps the documents in order
 	triNum  uint32
 	trigram uint32
-	count   uint32
-	offset  uint32
-	d       []byte
-	oldid   uint32
+	offset  uint64
+	post    postReader
 	fileid  uint32
+	buf     []uint32 // the new file IDs of the list, if not sorted
 	i       int
 }
 
-func (r *postMapReader) init(ix *Index, idmap []idrange) {
+func (r *postMapReader) init(ix *Index, docMap []uint32) {
 	r.ix = ix
-	r.idmap = idmap
+	r.docMap = docMap
+	r.sorted = true
+	last := uint32(0)
+	for _, id := range docMap {
+		if id != ^uint32(0) {
+			if id < last {
+				r.sorted = false
+				break
+			}
+			last = id
+		}
+	}
 	r.trigram = ^uint32(0)
 	r.load()
 }
@@ -267,46 +553,55 @@ func (r *postMapReader) nextTrigram() {
 }
 
 func (r *postMapReader) load() {
-	if r.triNum >= uint32(r.ix.numPost) {
-		r.trigram = ^uint32(0)
-		r.count = 0
-		r.fileid = ^uint32(0)
-		return
+	var count uint32
+	if r.triNum < uint32(r.ix.numPost) {
+		r.trigram, count, r.offset = r.ix.listAt(r.triNum)
 	}
-	r.trigram, r.count, r.offset = r.ix.listAt(r.triNum * postEntrySize)
-	if r.count == 0 {
+	if r.triNum >= uint32(r.ix.numPost) || r.trigram == 1<<24-1 {
+		// The terminating empty list is written separately.
+		r.trigram = ^uint32(0)
 		r.fileid = ^uint32(0)
 		return
 	}
-	r.d = r.ix.slice(r.ix.postData+r.offset, -1)
-	r.oldid = ^uint32(0)
+	r.post = postReader{}
+	r.post.initAt(r.ix, int(count), r.offset, nil)
+	r.fileid = ^uint32(0)
 	r.i = 0
+	if !r.sorted {
+		r.buf = r.buf[:0]
+		for r.mapNext() {
+			r.buf = append(r.buf, r.fileid)
+		}
+		sort.Slice(r.buf, func(i, j int) bool { return r.buf[i] < r.buf[j] })
+	}
 }
 
 func (r *postMapReader) nextId() bool {
-	for r.count > 0 {
-		r.count--
-		delta64, n := binary.Uvarint(r.d)
-		delta := uint32(delta64)
-		if n <= 0 || delta == 0 {
-			corrupt()
-		}
-		r.d = r.d[n:]
-		r.oldid += delta
-		for r.i < len(r.idmap) && r.idmap[r.i].hi <= r.oldid {
+	if !r.sorted {
+		if r.i < len(r.buf) {
+			r.fileid = r.buf[r.i]
 			r.i++
+			return true
 		}
-		if r.i >= len(r.idmap) {
-			r.count = 0
-			break
+		r.fileid = ^uint32(0)
+		return false
+	}
+	return r.mapNext()
+}
+
+// mapNext reads the next document in the posting list
+// that maps to a new file ID.
+func (r *postMapReader) mapNext() bool {
+	for r.post.next() {
+		oldid := r.post.fileid
+		if oldid >= uint32(len(r.docMap)) {
+			r.post.corrupt()
 		}
-		if r.oldid < r.idmap[r.i].lo {
-			continue
+		if id := r.docMap[oldid]; id != ^uint32(0) {
+			r.fileid = id
+			return true
 		}
-		r.fileid = r.idmap[r.i].new + r.oldid - r.idmap[r.i].lo
-		return true
 	}
-
 	r.fileid = ^uint32(0)
 	return false
 }
@@ -314,38 +609,35 @@ func (r *postMapReader) nextId() bool {
 type postDataWriter struct {
 	out           *bufWriter
 	postIndexFile *bufWriter
-	buf           [10]byte
-	base          uint32
-	count, offset uint32
-	last          uint32
+	enc           postEncoder
+	base          uint64
 	t             uint32
 }
 
-func (w *postDataWriter) init(out *bufWriter) {
+// init starts writing posting lists to out, with the posting list
+// index in a temporary file in dir (see bufTemp).
+func (w *postDataWriter) init(out *bufWriter, dir string) (err error) {
 	w.out = out
-	w.postIndexFile = bufCreate("")
+	w.postIndexFile, err = bufTemp(dir)
 	w.base = out.offset()
+	return err
 }
 
 func (w *postDataWriter) trigram(t uint32) {
-	w.offset = w.out.offset()
-	w.count = 0
 	w.t = t
-	w.last = ^uint32(0)
+	w.enc.init(w.out)
 }
 
 func (w *postDataWriter) fileid(id uint32) {
-	w.out.writeUvarint(id - w.last)
-	w.last = id
-	w.count++
+	w.enc.add(id)
 }
 
 func (w *postDataWriter) endTrigram() {
-	if w.count == 0 {
+	if w.enc.empty() && w.t != 1<<24-1 {
 		return
 	}
-	w.out.writeUvarint(0)
+	count, offset := w.enc.finish()
 	w.postIndexFile.writeTrigram(w.t)
-	w.postIndexFile.writeUint32(w.count)
-	w.postIndexFile.writeUint32(w.offset - w.base)
+	w.postIndexFile.writeUint32(count)
+	w.postIndexFile.writeUint64(offset - w.base)
 }
@@ -7,8 +7,13 @@
 package index
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -54,7 +59,9 @@ func TestMerge(t *testing.T) {
 	buildIndex(t, out1, mergePaths1, mergeFiles1)
 	buildIndex(t, out2, mergePaths2, mergeFiles2)
 
-	Merge(out3, out1, out2)
+	if err := Merge(out3, out1, out2); err != nil {
+		t.Fatal(err)
+	}
 
 	ix1 := Open(out1)
 	ix2 := Open(out2)
@@ -102,3 +109,442 @@ func TestMerge(t *testing.T) {
 	check(ix3, "now", 3, 4, 6)
 	check(ix3, "pot", 4, 5, 7)
 }
+
+var mergePaths3 = []string{
+	"/a/y",
+	"/c",
+}
+
+var mergeFiles3 = map[string]string{
+	"/a/y":  "world peace",
+	"/c/zz": "all done now",
+}
+
+func TestMergeMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(file(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	buildRootIndex(t, file("1"), mergePaths1, mergeFiles1)
+	buildRootIndex(t, file("2"), mergePaths2, mergeFiles2)
+	buildRootIndex(t, file("3"), mergePaths3, mergeFiles3)
+
+	// Merging all three at once is the same as merging them in turn.
+	if err := MergeMany(file("123"), file("1"), file("2"), file("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Merge(file("12"), file("1"), file("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Merge(file("12+3"), file("12"), file("3")); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := read("123"), read("12+3"); have != want {
+		t.Errorf("MergeMany(1, 2, 3):\nhave %q\nwant %q", have, want)
+	}
+
+	ix := Open(file("123"))
+	var names []string
+	for i := 0; i < ix.numName; i++ {
+		names = append(names, ix.Name(uint32(i)))
+	}
+	want := []string{"/a/x", "/a/y", "/b/www", "/b/xx", "/b/yy", "/c/zz", "/cc"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("MergeMany(1, 2, 3) names = %v, want %v", names, want)
+	}
+	if l := ix.PostingList(tri('w', 'o', 'r')); !equalList(l, []uint32{0, 1, 2}) {
+		t.Errorf("PostingList(wor) = %v, want [0 1 2]", l)
+	}
+	ix.Close()
+
+	// Merging a single index compacts it.
+	if _, err := Remove(file("rm"), file("1"), []string{"/b", "/c/de"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeMany(file("compact"), file("rm")); err != nil {
+		t.Fatal(err)
+	}
+	buildRootIndex(t, file("kept"), mergePaths1, map[string]string{
+		"/a/x":  mergeFiles1["/a/x"],
+		"/a/y":  mergeFiles1["/a/y"],
+		"/c/ab": mergeFiles1["/c/ab"],
+	})
+	if have, want := read("compact"), read("kept"); have != want {
+		t.Errorf("MergeMany(rm):\nhave %q\nwant %q", have, want)
+	}
+
+	if err := MergeMany(file("none")); err == nil {
+		t.Errorf("MergeMany() succeeded")
+	}
+}
+
+// buildRootIndex is like buildIndex but adds each file relative
+// to the first path containing it, as cindex does, and in the
+// order cindex's walk would produce.
+func buildRootIndex(t *testing.T, out string, paths []string, fileData map[string]string) {
+	ix := Create(out)
+	ix.AddPaths(paths)
+	var files []string
+	for name := range fileData {
+		files = append(files, name)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return comparePaths(files[i], files[j]) < 0
+	})
+	for _, name := range files {
+		rootNo := -1
+		for i, p := range paths {
+			if hasPathPrefix(name, p) {
+				rootNo = i
+				break
+			}
+		}
+		r := strings.NewReader(fileData[name])
+		ix.Add(rootNo, name, r, int64(r.Len()))
+	}
+	ix.Flush()
+	ix.Close()
+}
+
+func manyFiles(dir string, n int, text func(i int) string) map[string]string {
+	m := make(map[string]string)
+	for i := 0; i < n; i++ {
+		m[fmt.Sprintf("%s/f%03d", dir, i)] = text(i)
+	}
+	return m
+}
+
+var mergeRoundTripTests = []struct {
+	paths1 []string
+	files1 map[string]string
+	paths2 []string
+	files2 map[string]string
+	paths  []string // merged paths
+	files  map[string]string
+}{
+	{
+		mergePaths1, mergeFiles1,
+		mergePaths2, mergeFiles2,
+		[]string{"/a", "/b", "/c", "/cc"},
+		map[string]string{
+			"/a/x":   "hello world",
+			"/a/y":   "goodbye world",
+			"/b/www": "world wide indeed",
+			"/b/xx":  "no, not now",
+			"/b/yy":  "first potatoes, now liberty?",
+			"/c/ab":  "give me all the potatoes",
+			"/c/de":  "or give me death now",
+			"/cc":    "come to the aid of his potatoes",
+		},
+	},
+	{
+		// A new path inside an existing one is renumbered to the outer root.
+		[]string{"/a"}, map[string]string{"/a/x": "hello world", "/a/sub/y": "goodbye world"},
+		[]string{"/a/sub"}, map[string]string{"/a/sub/z": "wide world"},
+		[]string{"/a"}, map[string]string{"/a/x": "hello world", "/a/sub/z": "wide world"},
+	},
+	{
+		// Names sort element by element, not byte by byte.
+		[]string{"/p"}, map[string]string{"/p/foo.go": "package foo", "/p/foo/x.go": "package x"},
+		[]string{"/p/foo"}, map[string]string{"/p/foo/y.go": "package y"},
+		[]string{"/p"}, map[string]string{"/p/foo.go": "package foo", "/p/foo/y.go": "package y"},
+	},
+	{
+		// Long runs and large gaps in the posting lists.
+		[]string{"/r"}, manyFiles("/r", 700, func(i int) string {
+			if i%50 == 0 {
+				return "common and rare"
+			}
+			return "common"
+		}),
+		[]string{"/r/f100", "/r/f150"}, map[string]string{"/r/f100": "common", "/r/f150": "rare only"},
+		[]string{"/r"}, manyFiles("/r", 700, func(i int) string {
+			if i%50 == 0 && i != 100 {
+				if i == 150 {
+					return "rare only"
+				}
+				return "common and rare"
+			}
+			return "common"
+		}),
+	},
+}
+
+func TestMergeRoundTrip(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	f4, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	defer os.Remove(f4.Name())
+
+	for i, tt := range mergeRoundTripTests {
+		buildRootIndex(t, f1.Name(), tt.paths1, tt.files1)
+		buildRootIndex(t, f2.Name(), tt.paths2, tt.files2)
+		if err := Merge(f3.Name(), f1.Name(), f2.Name()); err != nil {
+			t.Fatal(err)
+		}
+		buildRootIndex(t, f4.Name(), tt.paths, tt.files)
+
+		merged, err := ioutil.ReadFile(f3.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := ioutil.ReadFile(f4.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(merged, full) {
+			t.Errorf("#%d: merged index differs from full build:\nmerged: %q\nfull:   %q", i, merged, full)
+			continue
+		}
+
+		ix := Open(f3.Name())
+		var names []string
+		for id := 0; id < ix.numName; id++ {
+			names = append(names, ix.Name(uint32(id)))
+		}
+		for _, name := range names {
+			if _, ok := tt.files[name]; !ok {
+				t.Errorf("#%d: unexpected name %s in merged index", i, name)
+			}
+		}
+		if len(names) != len(tt.files) {
+			t.Errorf("#%d: merged index has %d names, want %d", i, len(names), len(tt.files))
+		}
+		ix.Close()
+	}
+}
+
+func TestMergeDocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	build := func(out string, paths []string, fileData map[string]string) {
+		ix := Create(out)
+		ix.Dedup = true
+		ix.AddPaths(paths)
+		var files []string
+		for name := range fileData {
+			files = append(files, name)
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return comparePaths(files[i], files[j]) < 0
+		})
+		for _, name := range files {
+			r := strings.NewReader(fileData[name])
+			ix.Add(0, name, r, int64(r.Len()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if problems, err := Verify(out); err != nil || len(problems) != 0 {
+			t.Errorf("Verify(%s) = %v, %v, want no problems", out, problems, err)
+		}
+	}
+	// query returns the names of the files that may contain s.
+	query := func(index, s string) string {
+		ix := Open(index)
+		defer ix.Close()
+		var names []string
+		for _, id := range ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{s}}) {
+			names = append(names, ix.Name(id))
+		}
+		return strings.Join(names, " ")
+	}
+	check := func(index string, tests ...string) {
+		if problems, err := Verify(index); err != nil || len(problems) != 0 {
+			t.Errorf("Verify(%s) = %v, %v, want no problems", index, problems, err)
+		}
+		for i := 0; i < len(tests); i += 2 {
+			if have := query(index, tests[i]); have != tests[i+1] {
+				t.Errorf("%s: query %q = %q, want %q", filepath.Base(index), tests[i], have, tests[i+1])
+			}
+		}
+	}
+
+	// /r/c is a copy of /a/a, as are /r/a and /r/e; /r/b is not.
+	build(file("1"), []string{"/"}, map[string]string{
+		"/a/a": "hello zz\n",
+		"/r/a": "hello zz\n",
+		"/r/b": "other zz\n",
+		"/r/c": "hello zz\n",
+		"/r/e": "hello zz\n",
+	})
+	ix := Open(file("1"))
+	if ix.docs == 0 || ix.Doc(3) != 0 || ix.Doc(2) != 2 {
+		t.Errorf("Doc(3), Doc(2) = %d, %d, want 0, 2", ix.Doc(3), ix.Doc(2))
+	}
+	if l := ix.PostingList(tri('z', 'z', '\n')); !equalList(l, []uint32{0, 2}) {
+		t.Errorf("PostingList(zz\\n) = %v, want [0 2]", l)
+	}
+	if l := ix.PostingQuery(&Query{Op: QAll}); len(l) != 5 {
+		t.Errorf("PostingQuery(all) = %v, want 5 files", l)
+	}
+	ix.Close()
+	check(file("1"),
+		"hel", "/a/a /r/a /r/c /r/e",
+		"zz\n", "/a/a /r/a /r/b /r/c /r/e",
+		"oth", "/r/b")
+
+	// Removing a document leaves its copies.
+	if _, err := Remove(file("rm"), file("1"), []string{"/a", "/r/a"}); err != nil {
+		t.Fatal(err)
+	}
+	check(file("rm"), "hel", "/r/c /r/e")
+
+	// Compacting it makes the next copy the document, which comes
+	// after /r/b, so the posting lists have to be sorted again.
+	if err := MergeMany(file("compact"), file("rm")); err != nil {
+		t.Fatal(err)
+	}
+	check(file("compact"),
+		"hel", "/r/c /r/e",
+		"zz\n", "/r/b /r/c /r/e")
+	build(file("kept"), []string{"/"}, map[string]string{
+		"/r/b": "other zz\n",
+		"/r/c": "hello zz\n",
+		"/r/e": "hello zz\n",
+	})
+	if have, want := read(t, file("compact")), read(t, file("kept")); have != want {
+		t.Errorf("MergeMany(rm):\nhave %q\nwant %q", have, want)
+	}
+
+	// A newer index replacing the document does the same.
+	build(file("2"), []string{"/a", "/r/a"}, map[string]string{
+		"/a/a": "bye zz\n",
+	})
+	if err := Merge(file("12"), file("1"), file("2")); err != nil {
+		t.Fatal(err)
+	}
+	check(file("12"),
+		"hel", "/r/c /r/e",
+		"zz\n", "/a/a /r/b /r/c /r/e",
+		"bye", "/a/a")
+}
+
+// read returns the contents of file.
+func read(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMergeContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	build := func(out, root string, store bool, files ...string) {
+		ix := Create(out)
+		ix.Dedup = true
+		ix.StoreContents = store
+		ix.AddPaths([]string{root})
+		for i := 0; i < len(files); i += 2 {
+			r := strings.NewReader(files[i+1])
+			ix.Add(0, files[i], r, int64(r.Len()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// check checks that the index set at path has the contents
+	// given for each name, "-" meaning none.
+	check := func(path string, contents ...string) {
+		if problems, err := Verify(path); err != nil || len(problems) != 0 {
+			t.Errorf("Verify(%s) = %v, %v, want no problems", path, problems, err)
+		}
+		s, err := OpenSet(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for i := 0; i < len(contents); i += 2 {
+			data, ok, err := s.ContentsE(contents[i])
+			want := contents[i+1]
+			if err != nil || ok != (want != "-") || ok && string(data) != want {
+				t.Errorf("%s: Contents(%s) = %q, %v, %v, want %q", filepath.Base(path), contents[i], data, ok, err, want)
+			}
+		}
+	}
+
+	// /b/a and /b/c are copies of /a/a.
+	build(file("1"), "/", true,
+		"/a/a", "hello",
+		"/a/b", "other",
+		"/b/a", "hello",
+		"/b/c", "hello")
+	check(file("1"), "/a/a", "hello", "/a/b", "other", "/b/a", "hello", "/b/c", "hello", "/b/x", "-")
+
+	// Removing /a/a leaves the content of its copies, and
+	// compacting the index moves it to the next copy.
+	if _, err := Remove(file("rm"), file("1"), []string{"/a/a"}); err != nil {
+		t.Fatal(err)
+	}
+	check(file("rm"), "/a/a", "-", "/b/a", "hello", "/b/c", "hello")
+	if err := MergeMany(file("compact"), file("rm")); err != nil {
+		t.Fatal(err)
+	}
+	check(file("compact"), "/a/a", "-", "/a/b", "other", "/b/a", "hello", "/b/c", "hello")
+
+	// Files merged from an index without contents have none.
+	build(file("2"), "/c", false,
+		"/c/a", "hello",
+		"/c/b", "new")
+	if err := MergeMany(file("merged"), file("1"), file("2")); err != nil {
+		t.Fatal(err)
+	}
+	check(file("merged"), "/a/a", "hello", "/b/c", "hello", "/c/a", "-", "/c/b", "-")
+}
+
+func TestMergeSiblingRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	// /r/a-c sorts before /r/a/b as bytes, but after it in walk order.
+	buildRootIndex(t, file("1"), []string{"/r/a-c"}, map[string]string{"/r/a-c/f": "hello f"})
+	buildRootIndex(t, file("2"), []string{"/r/a/b"}, map[string]string{"/r/a/b/g": "hello g"})
+	for _, srcs := range [][]string{{file("1"), file("2")}, {file("2"), file("1")}} {
+		if err := MergeMany(file("merged"), srcs...); err != nil {
+			t.Fatal(err)
+		}
+		if problems, err := Verify(file("merged")); err != nil || len(problems) != 0 {
+			t.Errorf("Verify(merged) = %v, %v, want no problems", problems, err)
+		}
+		ix := Open(file("merged"))
+		var names []string
+		for _, id := range ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{"hel"}}) {
+			names = append(names, ix.Name(id))
+		}
+		if have, want := strings.Join(ix.Paths(), " "), "/r/a/b /r/a-c"; have != want {
+			t.Errorf("Paths() = %q, want %q", have, want)
+		}
+		if have, want := strings.Join(names, " "), "/r/a/b/g /r/a-c/f"; have != want {
+			t.Errorf("names = %q, want %q", have, want)
+		}
+		ix.Close()
+	}
+}
@@ -7,6 +7,7 @@
 package index
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"reflect"
@@ -14,26 +15,27 @@ import (
 	"unsafe"
 )
 
-func mmapFile(f *os.File) mmapData {
+func mmapFile(f *os.File) (mmapData, error) {
 	st, err := f.Stat()
 	if err != nil {
-		log.Fatal(err)
+		return mmapData{}, err
 	}
 	size := st.Size()
 	if int64(int(size+4095)) != size+4095 {
-		log.Fatalf("%s: too large for mmap", f.Name())
+		return mmapData{}, fmt.Errorf("%s: too large for mmap", f.Name())
 	}
 	if size == 0 {
-		return mmapData{f, nil, 0}
+		return mmapData{f, nil, 0}, nil
 	}
 	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, uint32(size>>32), uint32(size), nil)
 	if err != nil {
-		log.Fatalf("CreateFileMapping %s: %v", f.Name(), err)
+		return mmapData{}, fmt.Errorf("CreateFileMapping %s: %v", f.Name(), err)
 	}
 
 	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, 0)
 	if err != nil {
-		log.Fatalf("MapViewOfFile %s: %v", f.Name(), err)
+		syscall.CloseHandle(h)
+		return mmapData{}, fmt.Errorf("MapViewOfFile %s: %v", f.Name(), err)
 	}
 
 	var data []byte
@@ -43,20 +45,16 @@ func mmapFile(f *os.File) mmapData {
 	sh.Len = int(size)
 	sh.Cap = int(size)
 
-	return mmapData{f, data, uintptr(h)}
+	return mmapData{f, data, uintptr(h)}, nil
 }
 
 func unmmapFile(mm *mmapData) {
 	err := syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&mm.d[0])))
 	if err != nil {
-		log.Fatal(err)
+		log.Println("unmmapFile:", err)
 	}
 	err2 := syscall.CloseHandle(syscall.Handle(mm.h))
 	if err2 != nil {
-		log.Fatal(err2)
-	}
-	err3 := mm.f.Close()
-	if err3 != nil {
-		log.Fatal(err3)
+		log.Println("unmmapFile:", err2)
 	}
 }
@@ -10,47 +10,123 @@ package index
 //
 // An index stored on disk has the format:
 //
-//	"csearch index 1\n"
+//	"csearch index 4\n"
 //	list of paths
 //	list of names
 //	list of posting lists
 //	name index
 //	posting list index
+//	file info (optional)
+//	documents (optional)
+//	contents (optional)
+//	path options (optional)
+//	tombstones (optional)
+//	checksums (optional)
 //	trailer
 //
-// The list of paths is a sorted sequence of NUL-terminated file or directory names.
+// The list of paths is a sequence of NUL-terminated file or directory names,
+// sorted in walk order like the list of names.
 // The index covers the file trees rooted at those paths.
 // The list ends with an empty name ("\x00").
 //
-// The list of names is a sorted sequence of NUL-terminated file names.
-// The initial entry in the list corresponds to file #0,
+// The list of names is a sequence of file names, in the order in which
+// the file trees are walked.  Each name is a varint root number followed
+// by a NUL-terminated name.  Root number 0 means the name is stored in full;
+// root number n means the name is relative to the n'th path in the list
+// of paths.  The initial entry in the list corresponds to file #0,
 // the next to file #1, and so on.  The list ends with an
-// empty name ("\x00").
+// empty name ("\x00\x00").
 //
 // The list of posting lists are a sequence of posting lists.
-// Each posting list has the form:
+// A posting list of at most 256 file IDs is a delta list: a sequence of
+// varints describing the file IDs containing the trigram, ending with a zero.
+// A varint n > 31 is a delta of n-30 from the previous file ID
+// and a varint 1 <= n <= 31 is a run of n file IDs, each one
+// greater than the previous.  The first delta is taken from -1.
+// For example, the list [3,34,2,0] encodes the file ID list
+// 0, 1, 2, 6, 7, 8.  The list [0] would encode the empty file ID list,
+// but empty posting lists are usually not recorded at all.
+// The list of posting lists ends with an entry for trigram
+// "\xff\xff\xff" consisting of a single zero.
 //
-//	trigram [3]
-//	deltas [v]...
+// A longer posting list is split into blocks of 256 file IDs (the last
+// block may be shorter) so that searches can skip the blocks that cannot
+// contain the file IDs they are looking for.  It has the form:
+//
+//	block payloads...
+//	skip table
+//
+// Each block payload is an encoding byte followed by the delta list
+// of the file IDs in the block, without the terminating zero, with the
+// first delta taken from one less than the block's first file ID.
+// Encoding 0 stores the delta list as is and encoding 1 compresses it
+// with s2.  The skip table has an entry for each block:
+//
+//	first file ID [4]
+//	offset of the end of the block payload [4]
+//
+// with the payload offsets relative to the start of the first block.
+//
+// The optional file info section has a record for each name in
+// the list of names except the final empty one, describing the file
+// as it was when it was indexed:
+//
+//	modification time in nanoseconds since 1970 [8]
+//	size [8]
+//	SHA-256 hash of the content [32]
+//
+// A modification time of 0 means it is not known, and a record
+// that is all zeros means nothing is known about the file.
+//
+// The optional documents section maps each name in the list of names
+// to a document, identified by a file ID [4]: the ID of the first file
+// in the list with the same content.  Only documents appear in the
+// posting lists, so the trigrams of identical files are recorded once,
+// and a search that finds a document finds all its files.  Without
+// the section, each file is its own document.
 //
-// The trigram gives the 3 byte trigram that this list describes.  The
-// delta list is a sequence of varint-encoded deltas between file
-// IDs, ending with a zero delta.  For example, the delta list [2,5,1,1,0]
-// encodes the file ID list 1, 6, 7, 8.  The delta list [0] would
-// encode the empty file ID list, but empty posting lists are usually
-// not recorded at all.  The list of posting lists ends with an entry
-// with trigram "\xff\xff\xff" and a delta list consisting a single zero.
+// The optional contents section stores the content of the documents,
+// so that searches can read the files as they were when they were
+// indexed.  It has the form:
+//
+//	compressed contents...
+//	content table
+//
+// Each document's content is compressed with s2.  The content table
+// has an entry for each name in the list of names except the final
+// empty one: the offset [8], relative to the start of the section, of
+// the end of the file's compressed content, which begins where that of
+// the file before it ends.  A file whose content is empty in this
+// sense has none stored: it is not a document, or was indexed without
+// its content.
+//
+// The optional path options section has a NUL-terminated string for
+// each path in the list of paths, in the same order: the options with
+// which the program that built the index indexed the path, which the
+// index package does not interpret.  An empty string means none.
+//
+// The optional tombstones section lists the files that have been
+// removed from the index since it was written, as an increasing
+// sequence of file IDs [4].  Searches do not return them, and
+// merging the index drops them.
+//
+// The optional checksums section has a CRC-32C checksum [4] (Castagnoli
+// polynomial) for each section listed in the trailer, in trailer order,
+// with 0 for a section that is not present and for the checksums
+// section itself.
 //
 // The indexes enable efficient random access to the lists.  The name
-// index is a sequence of 4-byte big-endian values listing the byte
+// index is a sequence of 8-byte big-endian values listing the byte
 // offset in the name list where each name begins.  The posting list
 // index is a sequence of index entries describing each successive
 // posting list.  Each index entry has the form:
 //
 //	trigram [3]
 //	file count [4]
-//	offset [4]
+//	offset [8]
 //
+// The offset is that of the delta list or, for a block-encoded list,
+// of its skip table.
 // Index entries are only written for the non-empty posting lists,
 // so finding the posting list for a specific trigram requires a
 // binary search over the posting list index.  In practice, the majority
@@ -59,72 +135,388 @@ package index
 //
 // The trailer has the form:
 //
-//	offset of path list [4]
-//	offset of name list [4]
-//	offset of posting lists [4]
-//	offset of name index [4]
-//	offset of posting list index [4]
-//	"\ncsearch trailr\n"
+//	offset of path list [8]
+//	offset of name list [8]
+//	offset of posting lists [8]
+//	offset of name index [8]
+//	offset of posting list index [8]
+//	offset of file info [8]
+//	offset of checksums [8]
+//	offset of tombstones [8]
+//	offset of path options [8]
+//	offset of documents [8]
+//	offset of contents [8]
+//	offsets of any further sections [8]...
+//	number of section offsets [4]
+//	"\ncsearch trail4\n"
+//
+// Each section ends where the next one in the file begins.  Readers
+// ignore sections they do not know about, and an offset of 0 marks
+// an optional section that is not present.
+//
+// Version 3 indexes ("csearch index 3\n", "\ncsearch trail3\n") store
+// every posting list as a delta list, and the file count in their
+// posting list index is the number of varints in the list.
+// Version 2 indexes ("csearch index 2\n") are like version 3 ones but
+// use 4-byte offsets everywhere and have a trailer of exactly the
+// five offsets followed by "\ncsearch trail2\n".
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/klauspost/compress/s2"
 	"github.com/pierrec/lz4"
 )
 
 const (
-	magic        = "csearch index 2\n"
-	trailerMagic = "\ncsearch trail2\n"
+	magic        = "csearch index 4\n"
+	trailerMagic = "\ncsearch trail4\n"
+)
+
+// formats lists the index versions that can be read.
+var formats = []struct {
+	version             int
+	magic, trailerMagic string
+}{
+	{4, magic, trailerMagic},
+	{3, "csearch index 3\n", "\ncsearch trail3\n"},
+	{2, "csearch index 2\n", "\ncsearch trail2\n"},
+}
+
+// Encodings of the blocks of a block-encoded posting list.
+const (
+	blockRaw = 0
+	blockS2  = 1
 )
 
 // An Index implements read-only access to a trigram index.
 type Index struct {
-	Verbose   bool
-	data      mmapData
-	pathData  uint32
-	nameData  uint32
-	postData  uint32
-	nameIndex uint32
-	postIndex uint32
-	numName   int
-	numPost   int
+	Verbose       bool
+	file          string
+	data          mmapData
+	version       int
+	offsetSize    uint64   // size of offsets in name index, posting list index and trailer
+	postEntrySize uint64   // size of a posting list index entry
+	sections      []uint64 // section offsets from the trailer
+	trailer       uint64   // offset of the trailer
+	pathData      uint64
+	nameData      uint64
+	postData      uint64
+	nameIndex     uint64
+	postIndex     uint64
+	fileInfo      uint64 // 0 if the index has no file info
+	tombstones    uint64 // 0 if no files have been removed
+	pathOptions   uint64 // 0 if no path has options
+	docs          uint64 // 0 if each file is its own document
+	contents      uint64 // 0 if the index does not store file contents
+	numName       int
+	numDeleted    int
+	numPost       int
+	paths         []string   // cached result of Paths, for Name
+	copies        *copyTable // files of each document, for withCopies
+}
+
+// A copyTable lists the other files of each document that has
+// more than one, once it is needed.  If the documents section is
+// corrupt, err records why, for every call that needs the table.
+type copyTable struct {
+	once  sync.Once
+	files map[uint32][]uint32
+	err   error
+}
+
+// The sections of an index, in trailer order.  Only the first
+// numRequiredSections are present in every index.
+const (
+	sectionPaths = iota
+	sectionNames
+	sectionPosts
+	sectionNameIndex
+	sectionPostIndex
+	sectionFileInfo
+	sectionChecksums
+	sectionTombstones
+	sectionPathOptions
+	sectionDocs
+	sectionContents
+	numSections
+
+	numRequiredSections = sectionFileInfo
+)
+
+// castagnoli is the CRC-32C table used for section checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// fileInfoSize is the size of a file info record.
+const fileInfoSize = 8 + 8 + sha256.Size
+
+// A CorruptError reports that an index file is corrupt.
+type CorruptError struct {
+	File    string
+	Section string // section of the index holding the bad data
+	Offset  uint64 // offset of the bad data in the file
+	Msg     string // what is wrong, if known
 }
 
-const postEntrySize = 3 + 4 + 4
+func (e *CorruptError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("corrupt index %s: %s at offset %d: %s", e.File, e.Section, e.Offset, e.Msg)
+	}
+	return fmt.Sprintf("corrupt index %s: bad %s at offset %d", e.File, e.Section, e.Offset)
+}
+
+// sectionTitles names the sections, for errors.
+var sectionTitles = [numSections]string{
+	"path list",
+	"name list",
+	"posting lists",
+	"name index",
+	"posting list index",
+	"file info",
+	"checksums",
+	"tombstones",
+	"path options",
+	"documents",
+	"contents",
+}
 
+// corrupt reports that the index data at offset off is corrupt,
+// by panicking with a *CorruptError.  The exported methods turn
+// the panic into an error (see catch) or a call to log.Fatal
+// (see fatal).
+func (ix *Index) corrupt(off uint64) {
+	panic(ix.corruptError(off))
+}
+
+// corruptError returns a CorruptError for the data at offset off.
+func (ix *Index) corruptError(off uint64) *CorruptError {
+	e := &CorruptError{File: ix.file, Section: "header", Offset: off}
+	start := uint64(0)
+	for i, s := range ix.sections {
+		if s != 0 && s <= off && s >= start && i < len(sectionTitles) {
+			e.Section, start = sectionTitles[i], s
+		}
+	}
+	if ix.trailer != 0 && off >= ix.trailer {
+		e.Section = "trailer"
+	}
+	return e
+}
+
+// catch recovers from a panic caused by corrupt, setting *err
+// to the CorruptError.  It must be called by a deferred call.
+func catch(err *error) {
+	if e := recover(); e != nil {
+		ce, ok := e.(*CorruptError)
+		if !ok {
+			panic(e)
+		}
+		*err = ce
+	}
+}
+
+// fatal is like catch but calls log.Fatal with the CorruptError.
+func fatal() {
+	if e := recover(); e != nil {
+		ce, ok := e.(*CorruptError)
+		if !ok {
+			panic(e)
+		}
+		log.Fatal(ce)
+	}
+}
+
+// Open opens the index in file.  It calls log.Fatal if the file
+// cannot be read or is not a valid index.  Open does not check the
+// section checksums; see OpenChecked.
 func Open(file string) *Index {
-	mm := mmap(file)
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
-		corrupt()
-	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: mm}
-	ix.pathData = ix.uint32(n)
-	ix.nameData = ix.uint32(n + 4)
-	ix.postData = ix.uint32(n + 8)
-	ix.nameIndex = ix.uint32(n + 12)
-	ix.postIndex = ix.uint32(n + 16)
-	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	ix, err := OpenE(file)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return ix
 }
 
+// OpenE is like Open but returns an error instead.  The methods of the
+// returned Index call log.Fatal if they find that the index is corrupt,
+// except for those whose names end in E, such as NameE and
+// PostingQueryE, which return an error.
+func OpenE(file string) (ix *Index, err error) {
+	mm, err := mmap(file)
+	if err != nil {
+		return nil, err
+	}
+	ix = &Index{file: file, data: mm}
+	defer func() {
+		if err != nil {
+			ix.Close()
+			ix = nil
+		}
+	}()
+	defer catch(&err)
+	d := mm.d
+	for _, f := range formats {
+		if len(d) >= len(f.magic)+len(f.trailerMagic) && string(d[:len(f.magic)]) == f.magic && string(d[len(d)-len(f.trailerMagic):]) == f.trailerMagic {
+			ix.version = f.version
+			break
+		}
+	}
+	switch {
+	case ix.version >= 3:
+		ix.offsetSize = 8
+		k := uint64(len(d) - len(trailerMagic) - 4)
+		ix.trailer = k
+		nsect := uint64(ix.uint32(k))
+		if nsect < numRequiredSections || nsect*8 > k {
+			ix.corrupt(k)
+		}
+		ix.trailer = k - nsect*8
+		for i := uint64(0); i < nsect; i++ {
+			ix.sections = append(ix.sections, ix.uint64(ix.trailer+8*i))
+		}
+	case ix.version == 2:
+		ix.offsetSize = 4
+		if len(d) < len(trailerMagic)+numRequiredSections*4 {
+			ix.corrupt(0)
+		}
+		ix.trailer = uint64(len(d) - len(trailerMagic) - numRequiredSections*4)
+		for i := uint64(0); i < numRequiredSections; i++ {
+			ix.sections = append(ix.sections, uint64(ix.uint32(ix.trailer+4*i)))
+		}
+	default:
+		ix.corrupt(0)
+	}
+	ix.postEntrySize = 3 + 4 + ix.offsetSize
+	ix.pathData = ix.sections[sectionPaths]
+	ix.nameData = ix.sections[sectionNames]
+	ix.postData = ix.sections[sectionPosts]
+	ix.nameIndex = ix.sections[sectionNameIndex]
+	ix.postIndex = ix.sections[sectionPostIndex]
+	if ix.postIndex < ix.nameIndex || ix.sectionEnd(ix.postIndex) > ix.trailer {
+		ix.corrupt(ix.trailer)
+	}
+	ix.numName = int((ix.postIndex-ix.nameIndex)/ix.offsetSize) - 1
+	ix.numPost = int((ix.sectionEnd(ix.postIndex) - ix.postIndex) / ix.postEntrySize)
+	ix.fileInfo = ix.section(sectionFileInfo)
+	if ix.fileInfo != 0 && ix.sectionEnd(ix.fileInfo)-ix.fileInfo < uint64(ix.numName)*fileInfoSize {
+		ix.corrupt(ix.fileInfo)
+	}
+	ix.tombstones = ix.section(sectionTombstones)
+	if ix.tombstones != 0 {
+		size := ix.sectionEnd(ix.tombstones) - ix.tombstones
+		if size%4 != 0 || size/4 > uint64(ix.numName) {
+			ix.corrupt(ix.tombstones)
+		}
+		ix.numDeleted = int(size / 4)
+	}
+	ix.pathOptions = ix.section(sectionPathOptions)
+	ix.docs = ix.section(sectionDocs)
+	if ix.docs != 0 && ix.sectionEnd(ix.docs)-ix.docs != uint64(ix.numName)*4 {
+		ix.corrupt(ix.docs)
+	}
+	ix.contents = ix.section(sectionContents)
+	if ix.contents != 0 && ix.sectionEnd(ix.contents)-ix.contents < uint64(ix.numName)*8 {
+		ix.corrupt(ix.contents)
+	}
+	ix.copies = new(copyTable)
+	ix.paths = ix.readPaths()
+	return ix, nil
+}
+
+// OpenChecked is like OpenE but also checks the section checksums,
+// if the index has them, which means reading the whole file.
+func OpenChecked(file string) (ix *Index, err error) {
+	ix, err = OpenE(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ix.Close()
+			ix = nil
+		}
+	}()
+	defer catch(&err)
+	if bad := ix.badChecksums(); len(bad) > 0 {
+		return ix, bad[0]
+	}
+	return ix, nil
+}
+
+// badChecksums returns an error for each section whose data does not
+// match the checksum recorded for it.
+func (ix *Index) badChecksums() []*CorruptError {
+	sums := ix.section(sectionChecksums)
+	if sums == 0 {
+		return nil
+	}
+	n := (ix.sectionEnd(sums) - sums) / 4
+	var bad []*CorruptError
+	for i := 0; i < int(n) && i < len(ix.sections); i++ {
+		s := ix.sections[i]
+		if s == 0 || s == sums {
+			continue
+		}
+		end := ix.sectionEnd(s)
+		if s > end {
+			ix.corrupt(ix.trailer + uint64(i)*ix.offsetSize)
+		}
+		want := ix.uint32(sums + 4*uint64(i))
+		if got := crc32.Checksum(ix.slice(s, int(end-s)), castagnoli); got != want {
+			e := ix.corruptError(s)
+			e.Msg = fmt.Sprintf("checksum %08x, want %08x", got, want)
+			bad = append(bad, e)
+		}
+	}
+	return bad
+}
+
+// section returns the offset of the given section,
+// or 0 if the index does not have it.
+func (ix *Index) section(i int) uint64 {
+	if i >= len(ix.sections) {
+		return 0
+	}
+	return ix.sections[i]
+}
+
+// sectionEnd returns the end of the section starting at off,
+// which is the start of the next section or of the trailer.
+func (ix *Index) sectionEnd(off uint64) uint64 {
+	end := ix.trailer
+	for _, s := range ix.sections {
+		if s > off && s < end {
+			end = s
+		}
+	}
+	return end
+}
+
 type DumpOptions struct {
 	Names bool
 	Posts bool
 }
 
 func (ix *Index) Dump(options *DumpOptions) {
+	defer fatal()
 	fmt.Printf("pathData %d\n", ix.pathData)
-	for i, p := range ix.Paths() {
+	opts := ix.readPathOptions()
+	for i, p := range ix.readPaths() {
+		if opts[i] != "" {
+			fmt.Printf("  %d %s %s\n", i, p, opts[i])
+			continue
+		}
 		fmt.Printf("  %d %s\n", i, p)
 	}
 	fmt.Printf("nameData %d\n", ix.nameData)
@@ -133,15 +525,20 @@ func (ix *Index) Dump(options *DumpOptions) {
 	fmt.Printf("postIndex %d\n", ix.postIndex)
 	fmt.Printf("numName %d\n", ix.numName)
 	fmt.Printf("numPost %d\n", ix.numPost)
+	fmt.Printf("numDeleted %d\n", ix.numDeleted)
 	fmt.Printf("name size %d\n", ix.postData-ix.nameData)
 	fmt.Printf("post size %d\n", ix.nameIndex-ix.postData)
 	if options.Names {
 		for i := 0; i < ix.numName; i++ {
-			off := ix.nameData + ix.uint32(ix.nameIndex+4*uint32(i))
+			off := ix.nameData + ix.offsetAt(ix.nameIndex+ix.offsetSize*uint64(i))
 			s := ix.slice(off, -1)
 			rootNo, n := binary.Uvarint(s)
 			str := s[n:]
 			end := bytes.IndexByte(str, '\x00')
+			if doc := ix.doc(uint32(i)); doc != uint32(i) {
+				fmt.Printf("name %d offset %d end %d root %d %s doc %d\n", i, off, end, rootNo, str[:end], doc)
+				continue
+			}
 			fmt.Printf("name %d offset %d end %d root %d %s\n", i, off, end, rootNo, str[:end])
 		}
 	}
@@ -151,34 +548,62 @@ func (ix *Index) Dump(options *DumpOptions) {
 }
 
 // slice returns the slice of index data starting at the given byte offset.
-// If n >= 0, the slice must have length at least n and is truncated to length n.
-func (ix *Index) slice(off uint32, n int) []byte {
-	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
-		corrupt()
+// If n >= 0, the slice must have length at least n and is truncated to length n;
+// if n is -1, it runs to the end of the data.  Any other n is a corrupt length.
+// The bounds are checked before any conversion to int, so that no offset
+// or length in a corrupt index can wrap around.
+func (ix *Index) slice(off uint64, n int) []byte {
+	size := uint64(len(ix.data.d))
+	if off > size || n < -1 || n >= 0 && uint64(n) > size-off {
+		ix.corrupt(off)
 	}
 	if n < 0 {
-		return ix.data.d[o:]
+		return ix.data.d[off:]
 	}
-	return ix.data.d[o : o+n]
+	return ix.data.d[off : off+uint64(n)]
 }
 
 // uint32 returns the uint32 value at the given offset in the index data.
-func (ix *Index) uint32(off uint32) uint32 {
+func (ix *Index) uint32(off uint64) uint32 {
 	return binary.BigEndian.Uint32(ix.slice(off, 4))
 }
 
+// uint64 returns the uint64 value at the given offset in the index data.
+func (ix *Index) uint64(off uint64) uint64 {
+	return binary.BigEndian.Uint64(ix.slice(off, 8))
+}
+
+// offsetAt returns the offset stored at off in the index data,
+// which is 4 or 8 bytes long depending on the index version.
+func (ix *Index) offsetAt(off uint64) uint64 {
+	if ix.offsetSize == 4 {
+		return uint64(ix.uint32(off))
+	}
+	return ix.uint64(off)
+}
+
 // uvarint returns the varint value at the given offset in the index data.
-func (ix *Index) uvarint(off uint32) uint32 {
+func (ix *Index) uvarint(off uint64) uint32 {
 	v, n := binary.Uvarint(ix.slice(off, -1))
 	if n <= 0 {
-		corrupt()
+		ix.corrupt(off)
 	}
 	return uint32(v)
 }
 
 // Paths returns the list of indexed paths.
 func (ix *Index) Paths() []string {
+	defer fatal()
+	return ix.readPaths()
+}
+
+// PathsE is like Paths but returns an error if the index is corrupt.
+func (ix *Index) PathsE() (paths []string, err error) {
+	defer catch(&err)
+	return ix.readPaths(), nil
+}
+
+func (ix *Index) readPaths() []string {
 	off := ix.pathData
 	var x []string
 	for {
@@ -187,66 +612,326 @@ func (ix *Index) Paths() []string {
 			break
 		}
 		x = append(x, string(s))
-		off += uint32(len(s) + 1)
+		off += uint64(len(s) + 1)
 	}
 	return x
 }
 
+// PathOptions returns the options recorded for each of the paths
+// returned by Paths, in the same order; see IndexWriter.SetPathOptions.
+func (ix *Index) PathOptions() []string {
+	defer fatal()
+	return ix.readPathOptions()
+}
+
+func (ix *Index) readPathOptions() []string {
+	opts := make([]string, len(ix.paths))
+	if ix.pathOptions == 0 {
+		return opts
+	}
+	off, end := ix.pathOptions, ix.sectionEnd(ix.pathOptions)
+	for i := range opts {
+		if off >= end {
+			ix.corrupt(off)
+		}
+		s := ix.str(off)
+		opts[i] = string(s)
+		off += uint64(len(s) + 1)
+	}
+	if off != end {
+		ix.corrupt(off)
+	}
+	return opts
+}
+
 // Name returns the name corresponding to the given fileid.
 func (ix *Index) Name(fileid uint32) string {
-	off := ix.uint32(ix.nameIndex + 4*fileid)
-	s := ix.slice(ix.nameData+off, -1)
-	rootNo, n := binary.Uvarint(s)
+	defer fatal()
+	return ix.name(fileid)
+}
+
+// NameE is like Name but returns an error if the index is corrupt.
+func (ix *Index) NameE(fileid uint32) (name string, err error) {
+	defer catch(&err)
+	return ix.name(fileid), nil
+}
+
+func (ix *Index) name(fileid uint32) string {
+	rootNo, name := ix.rootNoAndName(fileid)
 	if rootNo == 0 {
-		return string(ix.str(ix.nameData + off + uint32(n)))
+		return name
 	}
-	return ix.Paths()[rootNo-1] + string(ix.str(ix.nameData+off+uint32(n)))
+	if int(rootNo) > len(ix.paths) {
+		ix.corrupt(ix.nameOffset(fileid))
+	}
+	return ix.paths[rootNo-1] + name
 }
 
+// RootNoAndName returns the root number and the name, relative
+// to that root, stored for the given fileid.
 func (ix *Index) RootNoAndName(fileid uint32) (uint32, string) {
-	off := ix.uint32(ix.nameIndex + 4*fileid)
-	s := ix.slice(ix.nameData+off, -1)
+	defer fatal()
+	return ix.rootNoAndName(fileid)
+}
+
+// RootNoAndNameE is like RootNoAndName but returns an error
+// if the index is corrupt.
+func (ix *Index) RootNoAndNameE(fileid uint32) (rootNo uint32, name string, err error) {
+	defer catch(&err)
+	rootNo, name = ix.rootNoAndName(fileid)
+	return rootNo, name, nil
+}
+
+func (ix *Index) rootNoAndName(fileid uint32) (uint32, string) {
+	off := ix.nameOffset(fileid)
+	s := ix.slice(off, -1)
 	rootNo, n := binary.Uvarint(s)
-	return uint32(rootNo), string(ix.str(ix.nameData + off + uint32(n)))
+	if n <= 0 {
+		ix.corrupt(off)
+	}
+	return uint32(rootNo), string(ix.str(off + uint64(n)))
+}
+
+// nameOffset returns the offset of the name of the given fileid.
+func (ix *Index) nameOffset(fileid uint32) uint64 {
+	return ix.nameData + ix.offsetAt(ix.nameIndex+ix.offsetSize*uint64(fileid))
+}
+
+// Doc returns the document of the given fileid: the ID of the first
+// file in the index with the same content, which may be fileid itself.
+func (ix *Index) Doc(fileid uint32) uint32 {
+	defer fatal()
+	return ix.doc(fileid)
+}
+
+// DocE is like Doc but returns an error if the index is corrupt.
+func (ix *Index) DocE(fileid uint32) (doc uint32, err error) {
+	defer catch(&err)
+	return ix.doc(fileid), nil
+}
+
+func (ix *Index) doc(fileid uint32) uint32 {
+	if ix.docs == 0 {
+		return fileid
+	}
+	if fileid >= uint32(ix.numName) {
+		ix.corrupt(ix.docs)
+	}
+	off := ix.docs + 4*uint64(fileid)
+	doc := ix.uint32(off)
+	if doc > fileid {
+		ix.corrupt(off)
+	}
+	return doc
+}
+
+// withCopies returns the list of documents with the other files
+// of each document added, in increasing order.
+func (ix *Index) withCopies(list []uint32) []uint32 {
+	if ix.docs == 0 {
+		return list
+	}
+	ix.copies.once.Do(func() {
+		defer catch(&ix.copies.err)
+		files := make(map[uint32][]uint32)
+		for id := uint32(0); id < uint32(ix.numName); id++ {
+			if doc := ix.doc(id); doc != id {
+				files[doc] = append(files[doc], id)
+			}
+		}
+		ix.copies.files = files
+	})
+	if ix.copies.err != nil {
+		panic(ix.copies.err)
+	}
+	var out []uint32
+	for _, doc := range list {
+		out = append(out, doc)
+		out = append(out, ix.copies.files[doc]...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// HasContents reports whether the index stores the content
+// of its files (see IndexWriter.StoreContents).
+func (ix *Index) HasContents() bool {
+	return ix.contents != 0
+}
+
+// Contents returns the content of the given fileid as it was when
+// the file was indexed.  It returns false if the index does not
+// store it.
+func (ix *Index) Contents(fileid uint32) ([]byte, bool) {
+	defer fatal()
+	return ix.readContents(fileid)
+}
+
+// ContentsE is like Contents but returns an error
+// if the index is corrupt.
+func (ix *Index) ContentsE(fileid uint32) (data []byte, ok bool, err error) {
+	defer catch(&err)
+	data, ok = ix.readContents(fileid)
+	return data, ok, nil
+}
+
+func (ix *Index) readContents(fileid uint32) ([]byte, bool) {
+	start, end := ix.contentRange(ix.doc(fileid))
+	if start == end {
+		return nil, false
+	}
+	data, err := s2.Decode(nil, ix.slice(start, int(end-start)))
+	if err != nil {
+		ix.corrupt(start)
+	}
+	return data, true
+}
+
+// contentData returns the compressed content stored for the
+// given fileid, or nil if there is none.
+func (ix *Index) contentData(fileid uint32) []byte {
+	start, end := ix.contentRange(fileid)
+	if start == end {
+		return nil
+	}
+	return ix.slice(start, int(end-start))
 }
 
-func (ix *Index) str(off uint32) []byte {
+// contentRange returns the offsets of the start and end of the
+// compressed content stored for the given fileid, which are the
+// same if there is none.
+func (ix *Index) contentRange(fileid uint32) (start, end uint64) {
+	if ix.contents == 0 {
+		return 0, 0
+	}
+	if fileid >= uint32(ix.numName) {
+		ix.corrupt(ix.contents)
+	}
+	table := ix.contentTable()
+	off := table + 8*uint64(fileid)
+	end = ix.contents + ix.uint64(off)
+	start = ix.contents
+	if fileid > 0 {
+		start += ix.uint64(off - 8)
+	}
+	if start > end || end > table {
+		ix.corrupt(off)
+	}
+	return start, end
+}
+
+// contentTable returns the offset of the content table.
+func (ix *Index) contentTable() uint64 {
+	return ix.sectionEnd(ix.contents) - 8*uint64(ix.numName)
+}
+
+// lookup returns the ID of the file with the given name, if it
+// is in the index and has not been removed.  The names must be in
+// walk order, as they are in the indexes that store file contents.
+func (ix *Index) lookup(name string) (uint32, bool) {
+	i := sort.Search(ix.numName, func(i int) bool {
+		return comparePaths(ix.name(uint32(i)), name) >= 0
+	})
+	if i < ix.numName && ix.name(uint32(i)) == name && !ix.deleted(uint32(i)) {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// A FileInfo describes an indexed file as it was when it was indexed.
+type FileInfo struct {
+	ModTime time.Time // zero if not known
+	Size    int64
+	Hash    [sha256.Size]byte // SHA-256 of the file content
+}
+
+// FileInfo returns the information recorded for the given fileid.
+// It returns false if the index does not record any for the file.
+func (ix *Index) FileInfo(fileid uint32) (FileInfo, bool) {
+	defer fatal()
+	return ix.fileInfoAt(fileid)
+}
+
+// FileInfoE is like FileInfo but returns an error
+// if the index is corrupt.
+func (ix *Index) FileInfoE(fileid uint32) (fi FileInfo, ok bool, err error) {
+	defer catch(&err)
+	fi, ok = ix.fileInfoAt(fileid)
+	return fi, ok, nil
+}
+
+func (ix *Index) fileInfoAt(fileid uint32) (FileInfo, bool) {
+	var fi FileInfo
+	if ix.fileInfo == 0 {
+		return fi, false
+	}
+	if fileid >= uint32(ix.numName) {
+		ix.corrupt(ix.fileInfo)
+	}
+	b := ix.slice(ix.fileInfo+uint64(fileid)*fileInfoSize, fileInfoSize)
+	if allZero(b) {
+		return fi, false
+	}
+	if t := int64(binary.BigEndian.Uint64(b)); t != 0 {
+		fi.ModTime = time.Unix(0, t)
+	}
+	fi.Size = int64(binary.BigEndian.Uint64(b[8:]))
+	copy(fi.Hash[:], b[16:])
+	return fi, true
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (ix *Index) str(off uint64) []byte {
 	str := ix.slice(off, -1)
 	i := bytes.IndexByte(str, '\x00')
 	if i < 0 {
-		corrupt()
+		ix.corrupt(off)
 	}
 	return str[:i]
 }
 
-// listAt returns the index list entry at the given offset.
-func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
-	d := ix.slice(ix.postIndex+off, postEntrySize)
+// postEntry decodes the posting list index entry d.
+func (ix *Index) postEntry(d []byte) (trigram, count uint32, offset uint64) {
 	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
 	count = binary.BigEndian.Uint32(d[3:])
-	offset = binary.BigEndian.Uint32(d[3+4:])
+	if ix.offsetSize == 4 {
+		offset = uint64(binary.BigEndian.Uint32(d[3+4:]))
+	} else {
+		offset = binary.BigEndian.Uint64(d[3+4:])
+	}
 	return
 }
 
+// listAt returns the i'th posting list index entry.
+func (ix *Index) listAt(i uint32) (trigram, count uint32, offset uint64) {
+	return ix.postEntry(ix.slice(ix.postIndex+uint64(i)*ix.postEntrySize, int(ix.postEntrySize)))
+}
+
 func (ix *Index) dumpPosting() {
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
-	spaceSize := uint32(0)
+	spaceSize := uint64(0)
 	ht := make([]int, 65536)
 	totorig := 0
 	tots2 := 0
 	totlz4 := 0
 	totrun := 0
 	for i := 0; i < ix.numPost; i++ {
-		j := i * postEntrySize
-		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
-		count := int(binary.BigEndian.Uint32(d[j+3:]))
-		offset := binary.BigEndian.Uint32(d[j+3+4:])
-		size := uint32(0)
+		t, count32, offset := ix.listAt(uint32(i))
+		count := int(count32)
+		start := ix.listStart(count32, offset)
+		end := ix.nameIndex - ix.postData
 		if i != ix.numPost-1 {
-			size = binary.BigEndian.Uint32(d[j+postEntrySize+3+4:]) - offset
-		} else {
-			size = ix.nameIndex - ix.postData - offset
+			_, nextCount, nextOffset := ix.listAt(uint32(i + 1))
+			end = ix.listStart(nextCount, nextOffset)
 		}
+		size := end - start
 		fmt.Printf("%#x: %d at %d - size %d\n", t, count, offset, size)
 		w := 0
 		for b := 0; b < 3; b++ {
@@ -261,14 +946,13 @@ func (ix *Index) dumpPosting() {
 			fmt.Printf("spacey!!!!!!! %d\n", spaceSize)
 		}
 
-		postd := ix.slice(ix.postData+offset, -1)
-		fileid := ^uint32(0)
+		var r postReader
+		r.initAt(ix, count, offset, nil)
 		run := 0
 		used := 0
-		for k := 0; k < count; k++ {
-			delta64, n := binary.Uvarint(postd)
-			used += n
-			if delta64 == 1 {
+		for last := ^uint32(0); r.next(); last = r.fileid {
+			used++
+			if r.fileid == last+1 {
 				run++
 			} else {
 				if run > 5 {
@@ -277,15 +961,13 @@ func (ix *Index) dumpPosting() {
 				}
 				run = 0
 			}
-			postd = postd[n:]
-			fileid = fileid + uint32(delta64)
 			if count == 1 {
-				fmt.Printf("del %d n %d file id %d\n", delta64, n, fileid)
+				fmt.Printf("file id %d\n", r.fileid)
 			}
 		}
-		encoded := s2.Encode(nil, ix.slice(ix.postData+offset, int(size)))
+		encoded := s2.Encode(nil, ix.slice(ix.postData+start, int(size)))
 		lz4encoded := make([]byte, lz4.CompressBlockBound(int(size)))
-		sz, _ := lz4.CompressBlock(ix.slice(ix.postData+offset, int(size)), lz4encoded, ht)
+		sz, _ := lz4.CompressBlock(ix.slice(ix.postData+start, int(size)), lz4encoded, ht)
 		totorig += int(size)
 		if int(size) < len(encoded) {
 			tots2 += int(size)
@@ -306,39 +988,50 @@ func (ix *Index) dumpPosting() {
 	fmt.Printf("post sizes %d s2 %d lz4 %d totrun %d\n", totorig, tots2, totlz4, totrun)
 }
 
-func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
+func (ix *Index) findList(trigram uint32) (count int, offset uint64) {
 	// binary search
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
+	size := int(ix.postEntrySize)
+	d := ix.slice(ix.postIndex, size*ix.numPost)
 	i := sort.Search(ix.numPost, func(i int) bool {
-		i *= postEntrySize
+		i *= size
 		t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
 		return t >= trigram
 	})
 	if i >= ix.numPost {
 		return 0, 0
 	}
-	i *= postEntrySize
-	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
+	t, n, offset := ix.postEntry(d[i*size:])
 	if t != trigram {
 		return 0, 0
 	}
-	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
-	return
+	return int(n), offset
 }
 
 type postReader struct {
 	ix       *Index
 	count    int
 	runCount int
-	offset   uint32
+	offset   uint64
 	fileid   uint32
 	d        []byte
 	restrict []uint32
+
+	// For block-encoded lists.
+	skip   []byte // skip table
+	data   []byte // block payloads
+	nblock int    // number of blocks
+	block  int    // current block
+	buf    []byte // decompressed block
 }
 
 func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) {
 	count, offset := ix.findList(trigram)
+	r.initAt(ix, count, offset, restrict)
+}
+
+// initAt prepares r to read the posting list with the given
+// count and offset, as recorded in the posting list index.
+func (r *postReader) initAt(ix *Index, count int, offset uint64, restrict []uint32) {
 	if count == 0 {
 		return
 	}
@@ -347,32 +1040,128 @@ func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) {
 	r.runCount = 0
 	r.offset = offset
 	r.fileid = ^uint32(0)
-	r.d = ix.slice(ix.postData+offset, -1)
 	r.restrict = restrict
+	r.skip = nil
+	if !ix.blockList(uint32(count)) {
+		r.d = ix.slice(ix.postData+offset, -1)
+		return
+	}
+	r.nblock = (count + postBlockSize - 1) / postBlockSize
+	r.skip = ix.slice(ix.postData+offset, 8*r.nblock)
+	size := uint64(r.blockEnd(r.nblock - 1))
+	if size > offset {
+		r.corrupt()
+	}
+	r.data = ix.slice(ix.postData+offset-size, int(size))
+	r.block = -1
+	r.d = nil
+}
+
+// corrupt reports that the posting list being read is corrupt.
+func (r *postReader) corrupt() {
+	r.ix.corrupt(r.ix.postData + r.offset)
+}
+
+// blockList reports whether a posting list of count file IDs is block-encoded.
+func (ix *Index) blockList(count uint32) bool {
+	return ix.version >= 4 && count > postBlockSize
+}
+
+// listStart returns the offset at which the bytes of the posting list
+// with the given count and index offset start: for a block-encoded
+// list, the payloads come before the skip table.
+func (ix *Index) listStart(count uint32, offset uint64) uint64 {
+	if !ix.blockList(count) {
+		return offset
+	}
+	nblock := uint64(count+postBlockSize-1) / postBlockSize
+	size := uint64(ix.uint32(ix.postData + offset + 8*(nblock-1) + 4))
+	if size > offset {
+		ix.corrupt(ix.postData + offset)
+	}
+	return offset - size
+}
+
+func (r *postReader) blockFirst(i int) uint32 {
+	return binary.BigEndian.Uint32(r.skip[8*i:])
+}
+
+func (r *postReader) blockEnd(i int) uint32 {
+	return binary.BigEndian.Uint32(r.skip[8*i+4:])
+}
+
+// loadBlock makes block i the current block.
+// It returns false if there is no such block.
+func (r *postReader) loadBlock(i int) bool {
+	if i >= r.nblock {
+		return false
+	}
+	start := uint32(0)
+	if i > 0 {
+		start = r.blockEnd(i - 1)
+	}
+	end := r.blockEnd(i)
+	if start >= end || int(end) > len(r.data) {
+		r.corrupt()
+	}
+	p := r.data[start:end]
+	switch p[0] {
+	case blockRaw:
+		r.d = p[1:]
+	case blockS2:
+		n, err := s2.DecodedLen(p[1:])
+		if err != nil {
+			r.corrupt()
+		}
+		if n > cap(r.buf) {
+			r.buf = make([]byte, n)
+		}
+		r.d, err = s2.Decode(r.buf[:cap(r.buf)], p[1:])
+		if err != nil {
+			r.corrupt()
+		}
+	default:
+		r.corrupt()
+	}
+	r.block = i
+	r.fileid = r.blockFirst(i) - 1
+	r.runCount = 0
+	return true
+}
+
+// seekBlock skips ahead to the block that would contain fileid,
+// if that is past the current block.  Skipped file IDs are all
+// smaller than fileid.
+func (r *postReader) seekBlock(fileid uint32) {
+	if r.skip == nil || r.block+1 >= r.nblock || r.blockFirst(r.block+1) > fileid {
+		return
+	}
+	first := r.block + 1
+	i := sort.Search(r.nblock-first, func(i int) bool {
+		return r.blockFirst(first+i) > fileid
+	})
+	r.loadBlock(first + i - 1)
 }
 
 func (r *postReader) numFilesEstimate() int {
 	return int(r.count + r.count/4)
 }
 
+// next advances to the next file ID in the list, skipping
+// those not in r.restrict.  It reports whether there is one.
 func (r *postReader) next() bool {
-	for r.count > 0 || r.runCount > 0 {
+	for r.ix != nil {
+		if r.restrict != nil {
+			if len(r.restrict) == 0 {
+				break
+			}
+			r.seekBlock(r.restrict[0])
+		}
 		if r.runCount > 0 {
 			r.fileid += 1
 			r.runCount--
-		} else {
-			r.count--
-			vi, n := binary.Uvarint(r.d)
-			if n <= 0 || vi == 0 {
-				corrupt()
-			}
-			r.d = r.d[n:]
-			if vi <= 31 {
-				r.runCount = int(vi - 1)
-				r.fileid += 1
-			} else {
-				r.fileid += uint32(vi) - 30
-			}
+		} else if !r.decode() {
+			break
 		}
 		if r.restrict != nil {
 			i := 0
@@ -386,18 +1175,52 @@ func (r *postReader) next() bool {
 		}
 		return true
 	}
-	// list should end with terminating 0 delta
-	if r.d != nil && (len(r.d) == 0 || r.d[0] != 0) {
-		corrupt()
-	}
 	r.fileid = ^uint32(0)
 	return false
 }
 
+// decode decodes the next varint of the list, moving on to the
+// next block if necessary.  It returns false at the end of the list.
+func (r *postReader) decode() bool {
+	for len(r.d) == 0 && r.skip != nil {
+		if !r.loadBlock(r.block + 1) {
+			return false
+		}
+	}
+	vi, n := binary.Uvarint(r.d)
+	if n <= 0 {
+		r.corrupt()
+	}
+	if vi == 0 {
+		// Delta lists end with a 0; blocks have no terminator.
+		if r.skip != nil {
+			r.corrupt()
+		}
+		return false
+	}
+	r.d = r.d[n:]
+	if vi <= 31 {
+		r.runCount = int(vi - 1)
+		r.fileid += 1
+	} else {
+		r.fileid += uint32(vi - 30)
+	}
+	return true
+}
+
+// PostingList returns the documents in the posting list for trigram.
 func (ix *Index) PostingList(trigram uint32) []uint32 {
+	defer fatal()
 	return ix.postingList(trigram, nil)
 }
 
+// PostingListE is like PostingList but returns an error
+// if the index is corrupt.
+func (ix *Index) PostingListE(trigram uint32) (list []uint32, err error) {
+	defer catch(&err)
+	return ix.postingList(trigram, nil), nil
+}
+
 func (ix *Index) postingList(trigram uint32, restrict []uint32) []uint32 {
 	var r postReader
 	r.init(ix, trigram, restrict)
@@ -409,16 +1232,30 @@ func (ix *Index) postingList(trigram uint32, restrict []uint32) []uint32 {
 	return x
 }
 
+// PostingAnd returns the documents in list that are also in the
+// posting list for trigram.  It reuses the memory of list.
 func (ix *Index) PostingAnd(list []uint32, trigram uint32) []uint32 {
+	defer fatal()
 	return ix.postingAnd(list, trigram, nil)
 }
 
+// PostingAndE is like PostingAnd but returns an error
+// if the index is corrupt.
+func (ix *Index) PostingAndE(list []uint32, trigram uint32) (and []uint32, err error) {
+	defer catch(&err)
+	return ix.postingAnd(list, trigram, nil), nil
+}
+
 func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []uint32 {
 	var r postReader
 	r.init(ix, trigram, restrict)
 	x := list[:0]
 	i := 0
-	for r.next() {
+	for i < len(list) {
+		r.seekBlock(list[i])
+		if !r.next() {
+			break
+		}
 		fileid := r.fileid
 		for i < len(list) && list[i] < fileid {
 			i++
@@ -431,10 +1268,20 @@ func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []
 	return x
 }
 
+// PostingOr returns the documents in list or in the
+// posting list for trigram.
 func (ix *Index) PostingOr(list []uint32, trigram uint32) []uint32 {
+	defer fatal()
 	return ix.postingOr(list, trigram, nil)
 }
 
+// PostingOrE is like PostingOr but returns an error
+// if the index is corrupt.
+func (ix *Index) PostingOrE(list []uint32, trigram uint32) (or []uint32, err error) {
+	defer catch(&err)
+	return ix.postingOr(list, trigram, nil), nil
+}
+
 func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []uint32 {
 	var r postReader
 	r.init(ix, trigram, restrict)
@@ -456,8 +1303,70 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []u
 	return x
 }
 
+// PostingQuery returns the IDs of the files that may match q,
+// leaving out the files that have been removed from the index.
+// All the files of a document that may match are returned.
 func (ix *Index) PostingQuery(q *Query) []uint32 {
-	return ix.postingQuery(q, nil)
+	defer fatal()
+	return ix.dropDeleted(ix.withCopies(ix.postingQuery(q, nil)))
+}
+
+// PostingQueryE is like PostingQuery but returns an error
+// if the index is corrupt.
+func (ix *Index) PostingQueryE(q *Query) (list []uint32, err error) {
+	defer catch(&err)
+	return ix.dropDeleted(ix.withCopies(ix.postingQuery(q, nil))), nil
+}
+
+// NumDeleted returns the number of files that have been
+// removed from the index.
+func (ix *Index) NumDeleted() int {
+	return ix.numDeleted
+}
+
+// Deleted reports whether the file with the given ID
+// has been removed from the index.
+func (ix *Index) Deleted(fileid uint32) bool {
+	defer fatal()
+	return ix.deleted(fileid)
+}
+
+// DeletedE is like Deleted but returns an error
+// if the index is corrupt.
+func (ix *Index) DeletedE(fileid uint32) (deleted bool, err error) {
+	defer catch(&err)
+	return ix.deleted(fileid), nil
+}
+
+func (ix *Index) deleted(fileid uint32) bool {
+	i := sort.Search(ix.numDeleted, func(i int) bool {
+		return ix.deletedAt(i) >= fileid
+	})
+	return i < ix.numDeleted && ix.deletedAt(i) == fileid
+}
+
+// deletedAt returns the i'th entry in the tombstones.
+func (ix *Index) deletedAt(i int) uint32 {
+	return ix.uint32(ix.tombstones + 4*uint64(i))
+}
+
+// dropDeleted removes the deleted files from list, in place.
+func (ix *Index) dropDeleted(list []uint32) []uint32 {
+	if ix.numDeleted == 0 {
+		return list
+	}
+	out := list[:0]
+	j := 0
+	for _, id := range list {
+		for j < ix.numDeleted && ix.deletedAt(j) < id {
+			j++
+		}
+		if j < ix.numDeleted && ix.deletedAt(j) == id {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
 }
 
 func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
@@ -469,9 +1378,11 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 		if restrict != nil {
 			return restrict
 		}
-		list = make([]uint32, ix.numName)
-		for i := range list {
-			list[i] = uint32(i)
+		list = make([]uint32, 0, ix.numName)
+		for id := uint32(0); id < uint32(ix.numName); id++ {
+			if ix.doc(id) == id {
+				list = append(list, id)
+			}
 		}
 		return list
 	case QAnd:
@@ -533,10 +1444,6 @@ func mergeOr(l1, l2 []uint32) []uint32 {
 	return l
 }
 
-func corrupt() {
-	log.Fatal("corrupt index: remove " + File())
-}
-
 // An mmapData is mmap'ed read-only data from a file.
 type mmapData struct {
 	f *os.File
@@ -545,16 +1452,22 @@ type mmapData struct {
 }
 
 // mmap maps the given file into memory.
-func mmap(file string) mmapData {
+func mmap(file string) (mmapData, error) {
 	f, err := os.Open(file)
 	if err != nil {
-		log.Fatal(err)
+		return mmapData{}, err
+	}
+	mm, err := mmapFile(f)
+	if err != nil {
+		f.Close()
 	}
-	return mmapFile(f)
+	return mm, err
 }
 
 func (ix Index) Close() {
-	unmmapFile(&ix.data)
+	if len(ix.data.d) > 0 {
+		unmmapFile(&ix.data)
+	}
 	ix.data.f.Close()
 }
 
@@ -7,9 +7,18 @@
 package index
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var postFiles = map[string]string{
@@ -49,6 +58,443 @@ func TestTrivialPosting(t *testing.T) {
 	}
 }
 
+func checkTrivialIndex(t *testing.T, ix *Index) {
+	names := []string{"afile4", "f0", "file1", "file3", "file5", "thefile2"}
+	if ix.numName != len(names) {
+		t.Fatalf("numName = %d, want %d", ix.numName, len(names))
+	}
+	for i, name := range names {
+		if n := ix.Name(uint32(i)); n != name {
+			t.Errorf("Name(%d) = %s, want %s", i, n, name)
+		}
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if l := ix.PostingList(tri('y', 'z', 'w')); !equalList(l, []uint32{4}) {
+		t.Errorf("PostingList(yzw) = %v, want [4]", l)
+	}
+}
+
+var oldIndexes = []struct {
+	version int
+	data    string
+}{
+	{2, trivialIndexV2},
+	{3, trivialIndexV3},
+}
+
+func TestReadOldVersions(t *testing.T) {
+	for _, old := range oldIndexes {
+		f, _ := ioutil.TempFile("", "index-test")
+		defer os.Remove(f.Name())
+		f.WriteString(old.data)
+		f.Close()
+
+		ix := Open(f.Name())
+		if ix.version != old.version {
+			t.Errorf("version = %d, want %d", ix.version, old.version)
+		}
+		checkTrivialIndex(t, ix)
+		ix.Close()
+
+		// Merging an old index produces the current version.
+		f2, _ := ioutil.TempFile("", "index-test")
+		f3, _ := ioutil.TempFile("", "index-test")
+		defer os.Remove(f2.Name())
+		defer os.Remove(f3.Name())
+		buildIndex(t, f2.Name(), nil, nil)
+		if err := Merge(f3.Name(), f.Name(), f2.Name()); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(f3.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Old indexes have no file info.
+		want := trivialIndexInfo(strings.Repeat("\x00", 6*fileInfoSize))
+		if string(data) != want {
+			t.Errorf("merged version %d index:\nhave %q\nwant %q", old.version, data, want)
+		}
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2020, 3, 4, 5, 6, 7, 8, time.UTC)
+	var names []string
+	for _, name := range []string{"a", "b"} {
+		name = filepath.Join(dir, name)
+		names = append(names, name)
+		if err := ioutil.WriteFile(name, []byte("hello "+name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	w := Create(f1.Name())
+	w.AddPaths([]string{dir})
+	for _, name := range names {
+		w.AddFile(0, name)
+	}
+	w.Flush()
+	w.Close()
+	buildIndex(t, f2.Name(), nil, map[string]string{"/other": "other"})
+	if err := Merge(f3.Name(), f1.Name(), f2.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{f1.Name(), f3.Name()} {
+		ix := Open(file)
+		for id := uint32(0); id < uint32(ix.numName); id++ {
+			name := ix.Name(id)
+			fi, ok := ix.FileInfo(id)
+			if !ok {
+				t.Errorf("FileInfo(%d) for %s not recorded", id, name)
+				continue
+			}
+			// Add records no modification time.
+			data, wantTime := "hello "+name, mtime
+			if name == "/other" {
+				data, wantTime = "other", time.Time{}
+			}
+			if !fi.ModTime.Equal(wantTime) || fi.Size != int64(len(data)) || fi.Hash != sha256.Sum256([]byte(data)) {
+				t.Errorf("FileInfo(%d) = %v, %d, %x, want %v, %d, %x", id, fi.ModTime, fi.Size, fi.Hash, wantTime, len(data), sha256.Sum256([]byte(data)))
+			}
+		}
+		ix.Close()
+	}
+}
+
+// TestBlockPosting checks posting lists long enough to be
+// split into blocks.
+func TestBlockPosting(t *testing.T) {
+	const n = 1000
+	abc := func(i int) bool { return i*i%7 < 4 }
+	xyz := func(i int) bool { return i%5 == 0 || i > 900 }
+	files := manyFiles("/b", n, func(i int) string {
+		s := "file"
+		if abc(i) {
+			s += " abc"
+		}
+		if xyz(i) {
+			s += " xyz"
+		}
+		return s
+	})
+
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	buildIndex(t, f.Name(), nil, files)
+	ix := Open(f.Name())
+	defer ix.Close()
+
+	var all, wantAbc, wantXyz, wantAnd, wantOr []uint32
+	for i := uint32(0); i < n; i++ {
+		all = append(all, i)
+		a, x := abc(int(i)), xyz(int(i))
+		if a {
+			wantAbc = append(wantAbc, i)
+		}
+		if x {
+			wantXyz = append(wantXyz, i)
+		}
+		if a && x {
+			wantAnd = append(wantAnd, i)
+		}
+		if a || x {
+			wantOr = append(wantOr, i)
+		}
+	}
+	tabc, txyz := tri('a', 'b', 'c'), tri('x', 'y', 'z')
+	if l := ix.PostingList(tri('f', 'i', 'l')); !equalList(l, all) {
+		t.Errorf("PostingList(fil) = %v, want %v", l, all)
+	}
+	if l := ix.PostingList(tabc); !equalList(l, wantAbc) {
+		t.Errorf("PostingList(abc) = %v, want %v", l, wantAbc)
+	}
+	if l := ix.PostingAnd(ix.PostingList(tabc), txyz); !equalList(l, wantAnd) {
+		t.Errorf("PostingList(abc&xyz) = %v, want %v", l, wantAnd)
+	}
+	if l := ix.PostingAnd(ix.PostingList(txyz), tabc); !equalList(l, wantAnd) {
+		t.Errorf("PostingList(xyz&abc) = %v, want %v", l, wantAnd)
+	}
+	if l := ix.PostingOr(ix.PostingList(tabc), txyz); !equalList(l, wantOr) {
+		t.Errorf("PostingList(abc|xyz) = %v, want %v", l, wantOr)
+	}
+	if l := ix.PostingOr(ix.PostingList(txyz), tabc); !equalList(l, wantOr) {
+		t.Errorf("PostingList(xyz|abc) = %v, want %v", l, wantOr)
+	}
+
+	// A restriction that falls in the last block skips the others.
+	restrict := []uint32{3, 950, 999}
+	want := []uint32{950, 999}
+	if l := ix.PostingAnd(restrict, txyz); !equalList(l, want) {
+		t.Errorf("PostingAnd(%v, xyz) = %v, want %v", restrict, l, want)
+	}
+	if l := ix.PostingAnd(nil, tabc); len(l) != 0 {
+		t.Errorf("PostingAnd(nil, abc) = %v, want []", l)
+	}
+}
+
+// TestOpenLarge checks that an index whose sections lie beyond
+// 4GB can be read, by inserting a hole before the posting lists
+// of a small index.
+func TestOpenLarge(t *testing.T) {
+	if testing.Short() || strconv.IntSize < 64 {
+		t.Skip("needs a 64-bit address space")
+	}
+	const hole = 5 << 30
+	data := []byte(trivialIndex)
+	tr := len(data) - len(trailerMagic) - 4 - numSections*8
+	postData := binary.BigEndian.Uint64(data[tr+8*sectionPosts:])
+	for i := sectionPosts; i < numSections; i++ {
+		if off := binary.BigEndian.Uint64(data[tr+8*i:]); off != 0 {
+			binary.BigEndian.PutUint64(data[tr+8*i:], off+hole)
+		}
+	}
+
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data[:postData]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data[postData:], int64(postData)+hole); err != nil {
+		t.Skip("cannot write large sparse file:", err)
+	}
+	f.Close()
+
+	ix := Open(f.Name())
+	checkTrivialIndex(t, ix)
+	ix.Close()
+}
+
+// writeTemp writes data to a new temporary file and returns its name.
+func writeTemp(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(data)
+	f.Close()
+	return f.Name()
+}
+
+// corruptIndex returns trivialIndex with the byte at off replaced by c.
+func corruptIndex(off int, c byte) string {
+	b := []byte(trivialIndex)
+	b[off] = c
+	return string(b)
+}
+
+func checkCorrupt(t *testing.T, what string, err error, section string, off uint64) {
+	t.Helper()
+	ce, ok := err.(*CorruptError)
+	if !ok {
+		t.Errorf("%s: err = %v, want CorruptError", what, err)
+		return
+	}
+	if ce.Section != section || ce.Offset != off {
+		t.Errorf("%s: bad %s at %d, want %s at %d", what, ce.Section, ce.Offset, section, off)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	if _, err := OpenE("/nonexistent/index"); err == nil {
+		t.Errorf("OpenE(nonexistent) succeeded")
+	}
+
+	file := writeTemp(t, "not an index")
+	defer os.Remove(file)
+	_, err := OpenE(file)
+	checkCorrupt(t, "OpenE(garbage)", err, "header", 0)
+
+	// Too many section offsets.
+	file = writeTemp(t, corruptIndex(len(trivialIndex)-len(trailerMagic)-4, 0xff))
+	defer os.Remove(file)
+	_, err = OpenE(file)
+	checkCorrupt(t, "OpenE(bad trailer)", err, "trailer", uint64(len(trivialIndex)-len(trailerMagic)-4))
+
+	// Root number of file 0 out of range.
+	file = writeTemp(t, corruptIndex(17, 9))
+	defer os.Remove(file)
+	ix, err := OpenE(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ix.NameE(0)
+	checkCorrupt(t, "NameE", err, "name list", 17)
+	if name, err := ix.NameE(1); name != "f0" || err != nil {
+		t.Errorf("NameE(1) = %q, %v, want %q, nil", name, err, "f0")
+	}
+	ix.Close()
+
+	// Unterminated varint in the posting list for "\na\n".
+	b := []byte(trivialIndex)
+	for i := 62; i < 72; i++ {
+		b[i] = 0xff
+	}
+	file = writeTemp(t, string(b))
+	defer os.Remove(file)
+	ix, err = OpenE(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ix.PostingQueryE(&Query{Op: QAnd, Trigram: []string{"\na\n"}})
+	checkCorrupt(t, "PostingQueryE", err, "posting lists", 62)
+	ix.Close()
+
+	// A document of a later file in the documents section.  Every
+	// query that needs the files of each document reports it, not
+	// only the one that first reads the section.
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	file = f.Name()
+	defer os.Remove(file)
+	w := Create(file)
+	w.Dedup = true
+	w.AddPaths([]string{"/"})
+	for _, name := range []string{"/a", "/b", "/c"} {
+		w.Add(0, name, strings.NewReader("same"), 4)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ix, err = OpenE(file); err != nil {
+		t.Fatal(err)
+	}
+	off := ix.docs + 4
+	ix.Close()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[off+3] = 2
+	if err := ioutil.WriteFile(file, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ix, err = OpenE(file); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		list, err := ix.PostingQueryE(&Query{Op: QAnd, Trigram: []string{"sam"}})
+		if err == nil {
+			t.Errorf("PostingQueryE #%d = %v, want error", i+1, list)
+		} else {
+			checkCorrupt(t, "PostingQueryE", err, "documents", off)
+		}
+	}
+	ix.Close()
+}
+
+// TestCorruptFuzz mutates an index with every optional section
+// and checks that reading it reports errors rather than panicking.
+func TestCorruptFuzz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough distinct documents sharing trigrams to get block lists,
+	// some copies, stored contents, path options and tombstones.
+	orig := filepath.Join(dir, "orig")
+	ix := Create(orig)
+	ix.Dedup = true
+	ix.StoreContents = true
+	ix.AddPaths([]string{"/r"})
+	ix.SetPathOptions("/r", `{"maxdepth":3}`)
+	for i := 0; i < 600; i++ {
+		text := fmt.Sprintf("common text %d\n", i%500)
+		ix.Add(0, fmt.Sprintf("/r/d%d/f%d", i%7, i), strings.NewReader(text), int64(len(text)))
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if _, err := Remove(src, orig, []string{"/r/d1/f1", "/r/d2/f9"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []*Query{
+		{Op: QAll},
+		{Op: QAnd, Trigram: []string{"com", "ext"}},
+		{Op: QOr, Trigram: []string{"t 1", "t 2"}},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	file := filepath.Join(dir, "index")
+	for i := 0; i < 3000; i++ {
+		b := append([]byte(nil), data...)
+		for n := 1 + rnd.Intn(3); n > 0; n-- {
+			off := rnd.Intn(len(b))
+			if rnd.Intn(2) == 0 || off+8 > len(b) {
+				b[off] = byte(rnd.Intn(256))
+			} else {
+				binary.BigEndian.PutUint64(b[off:], rnd.Uint64())
+			}
+		}
+		if err := ioutil.WriteFile(file, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("mutation %d: panic: %v\n%s", i, e, debug.Stack())
+				}
+			}()
+			readCorrupt(file, queries)
+			Verify(file)
+		}()
+	}
+}
+
+// readCorrupt reads everything it can from the index in file,
+// ignoring the errors.
+func readCorrupt(file string, queries []*Query) {
+	ix, err := OpenE(file)
+	if err != nil {
+		return
+	}
+	defer ix.Close()
+	ix.PathsE()
+	for _, q := range queries {
+		list, err := ix.PostingQueryE(q)
+		if err != nil {
+			continue
+		}
+		for _, id := range list {
+			ix.NameE(id)
+			ix.RootNoAndNameE(id)
+			ix.FileInfoE(id)
+			ix.DocE(id)
+			ix.DeletedE(id)
+			ix.ContentsE(id)
+		}
+	}
+	list, _ := ix.PostingListE(tri('c', 'o', 'm'))
+	list, _ = ix.PostingAndE(list, tri('t', 'e', 'x'))
+	ix.PostingOrE(list, tri('t', ' ', '9'))
+}
+
 func equalList(x, y []uint32) bool {
 	if len(x) != len(y) {
 		return false
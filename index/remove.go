@@ -0,0 +1,70 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "fmt"
+
+// Removing files from an index.
+//
+// Removing a file does not rewrite the posting lists, which would
+// mean renumbering every file after it.  Instead the file's ID is added
+// to the tombstones section, which searches consult to leave it out of
+// their results.  The other sections are copied unchanged, so removing
+// files costs a copy of the index but no reading of the indexed files.
+// The next Merge drops the removed files for good.
+
+// Remove creates a new index in the file dst that is the index src
+// with the files at or under each of paths removed.  It returns the
+// number of files removed.  If Remove returns an error, dst is left
+// as it was.  Only indexes in the current format can have files
+// removed; merge an older index to convert it first.
+func Remove(dst, src string, paths []string) (n int, err error) {
+	ix, err := OpenE(src)
+	if err != nil {
+		return 0, err
+	}
+	defer ix.Close()
+	defer catch(&err)
+	if ix.version != 4 {
+		return 0, fmt.Errorf("%s: cannot remove files from a version %d index", src, ix.version)
+	}
+
+	var deleted []uint32
+	for id := uint32(0); id < uint32(ix.numName); id++ {
+		if ix.deleted(id) {
+			deleted = append(deleted, id)
+		} else if inPaths(ix.name(id), paths) {
+			deleted = append(deleted, id)
+			n++
+		}
+	}
+
+	out, err := bufCreate(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.remove()
+	out.writeString(magic)
+	sect := sectionWriter{out: out}
+	for i := 0; i < numSections; i++ {
+		if i == sectionChecksums || i == sectionTombstones {
+			continue
+		}
+		if off := ix.section(i); off != 0 {
+			sect.start(i)
+			out.write(ix.slice(off, int(ix.sectionEnd(off)-off)))
+		}
+	}
+	if len(deleted) > 0 {
+		sect.start(sectionTombstones)
+		for _, id := range deleted {
+			out.writeUint32(id)
+		}
+	}
+	sect.finish()
+	if err := out.commit(dst); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var removeFiles = map[string]string{
+	"/r/x/file1": "hello world",
+	"/r/x/file2": "hello there",
+	"/r/xy":      "hello again",
+	"/r/z":       "goodbye",
+}
+
+func TestRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	buildIndex(t, file("all"), []string{"/r"}, removeFiles)
+	n, err := Remove(file("rm1"), file("all"), []string{"/r/x"})
+	if err != nil || n != 2 {
+		t.Fatalf("Remove(/r/x) = %d, %v, want 2, nil", n, err)
+	}
+	n, err = Remove(file("rm2"), file("rm1"), []string{"/r/x/file1", "/r/z"})
+	if err != nil || n != 1 {
+		t.Fatalf("Remove(/r/x/file1, /r/z) = %d, %v, want 1, nil", n, err)
+	}
+
+	hello := &Query{Op: QAnd, Trigram: []string{"hel", "llo"}}
+	for _, tt := range []struct {
+		file    string
+		deleted int
+		hello   []uint32
+	}{
+		{"all", 0, []uint32{0, 1, 2}},
+		{"rm1", 2, []uint32{2}},
+		{"rm2", 3, []uint32{2}},
+	} {
+		ix := Open(file(tt.file))
+		if n := ix.NumDeleted(); n != tt.deleted {
+			t.Errorf("%s: NumDeleted() = %d, want %d", tt.file, n, tt.deleted)
+		}
+		if l := ix.PostingQuery(hello); !equalList(l, tt.hello) {
+			t.Errorf("%s: PostingQuery(hello) = %v, want %v", tt.file, l, tt.hello)
+		}
+		// The posting lists themselves are unchanged.
+		if l := ix.PostingList(tri('h', 'e', 'l')); !equalList(l, []uint32{0, 1, 2}) {
+			t.Errorf("%s: PostingList(hel) = %v, want [0 1 2]", tt.file, l)
+		}
+		ix.Close()
+		if problems, err := Verify(file(tt.file)); err != nil || len(problems) != 0 {
+			t.Errorf("%s: Verify = %v, %v, want no problems", tt.file, problems, err)
+		}
+	}
+	ix := Open(file("rm1"))
+	if !ix.Deleted(0) || !ix.Deleted(1) || ix.Deleted(2) || ix.Deleted(3) {
+		t.Errorf("rm1: Deleted(0..3) = %v %v %v %v, want true true false false",
+			ix.Deleted(0), ix.Deleted(1), ix.Deleted(2), ix.Deleted(3))
+	}
+	ix.Close()
+
+	// Merging drops the removed files.
+	buildIndex(t, file("empty"), nil, nil)
+	if err := Merge(file("merged"), file("rm1"), file("empty")); err != nil {
+		t.Fatal(err)
+	}
+	buildIndex(t, file("want"), []string{"/r"}, map[string]string{
+		"/r/xy": removeFiles["/r/xy"],
+		"/r/z":  removeFiles["/r/z"],
+	})
+	merged, _ := ioutil.ReadFile(file("merged"))
+	want, _ := ioutil.ReadFile(file("want"))
+	if string(merged) != string(want) {
+		t.Errorf("merged index:\nhave %q\nwant %q", merged, want)
+	}
+
+	// Old indexes must be merged first.
+	old := writeTemp(t, trivialIndexV3)
+	defer os.Remove(old)
+	if _, err := Remove(file("old"), old, []string{"f0"}); err == nil {
+		t.Errorf("Remove(version 3) succeeded")
+	}
+}
@@ -0,0 +1,478 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Index sets.
+//
+// An index set is several index files ("shards") searched together,
+// each typically covering some of the indexed roots, so that each can
+// be rebuilt on its own and the shards can be searched in parallel.
+// A set is either a directory, whose shards are the files in it with
+// names ending in ShardExt, or a manifest file listing the shards:
+//
+//	csearch index set
+//	shard file name
+//	shard file name
+//	...
+//
+// Relative shard names in a manifest are relative to the directory
+// holding the manifest.  Blank lines and lines beginning with # are
+// ignored.
+//
+// When shards overlap, the newer shard wins: the one listed later in
+// the manifest or, in a directory, the one whose name sorts later,
+// whatever the times of the files.  As when a newer index is merged
+// into an older one, a shard's files under any of the paths of a newer
+// shard are left out of searches, and so is a file whose name a newer
+// shard also returns.  The stored contents of a file and the options
+// recorded for a path are also taken from the newest shard that has
+// them.
+
+// ShardExt is the extension of the shards in an index set directory.
+const ShardExt = ".csi"
+
+// setMagic is the first line of an index set manifest.
+const setMagic = "csearch index set\n"
+
+// A Set is an open index set.
+type Set struct {
+	Verbose bool
+	files   []string
+	shards  []*Index
+	order   []int      // shard numbers, newest first
+	newer   [][]string // for each shard, the paths of the newer shards
+}
+
+// OpenSet opens the index set at path, which may be a directory of
+// shards, a manifest, or a single index file, which is treated as a
+// set of one shard.
+func OpenSet(path string) (*Set, error) {
+	files, err := SetFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Set{files: files}
+	for _, file := range files {
+		ix, err := OpenE(file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, ix)
+	}
+	s.rank()
+	return s, nil
+}
+
+// rank orders the shards newest first, as described above,
+// and records the paths of the shards newer than each one.
+func (s *Set) rank() {
+	s.order = make([]int, len(s.files))
+	for i := range s.order {
+		s.order[i] = len(s.files) - 1 - i
+	}
+	s.newer = make([][]string, len(s.files))
+	var paths []string
+	for _, i := range s.order {
+		s.newer[i] = paths
+		paths = append(paths[:len(paths):len(paths)], s.shards[i].paths...)
+	}
+}
+
+// hidden reports whether the file name in shard i is left out of
+// searches because it is under one of the paths of a newer shard.
+func (s *Set) hidden(i int, name string) bool {
+	for _, p := range s.newer[i] {
+		if hasPathPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// owners returns for each of the given names of the files found in
+// each shard, that are not hidden, the shard whose file is searched.
+func (s *Set) owners(names [][]string) map[string]int {
+	owner := make(map[string]int)
+	for _, i := range s.order {
+		for _, name := range names[i] {
+			if _, dup := owner[name]; !dup && !s.hidden(i, name) {
+				owner[name] = i
+			}
+		}
+	}
+	return owner
+}
+
+// SetFiles returns the names of the index files in the index set
+// at path, as described for OpenSet.
+func SetFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*"+ShardExt))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := bufio.NewReader(f)
+	if head, _ := b.Peek(len(setMagic)); !bytes.Equal(head, []byte(setMagic)) {
+		// An ordinary index.
+		return []string{path}, nil
+	}
+	data, err := ioutil.ReadAll(b)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data[len(setMagic):]), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		files = append(files, line)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: index set lists no shards", path)
+	}
+	return files, nil
+}
+
+// Close closes the shards of the set.
+func (s *Set) Close() {
+	for _, ix := range s.shards {
+		ix.Close()
+	}
+}
+
+// Files returns the names of the shards of the set.
+func (s *Set) Files() []string {
+	return s.files
+}
+
+// Paths returns the list of paths covered by any of the shards,
+// in walk order.
+func (s *Set) Paths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, ix := range s.shards {
+		for _, p := range ix.paths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return comparePaths(paths[i], paths[j]) < 0
+	})
+	return paths
+}
+
+// PathOptions returns the options recorded for each of the paths
+// returned by Paths, in the same order, taking those of a path
+// covered by more than one shard from the newest.
+func (s *Set) PathOptions() []string {
+	opts := make(map[string]string)
+	for k := len(s.order) - 1; k >= 0; k-- {
+		ix := s.shards[s.order[k]]
+		o := ix.PathOptions()
+		for i, p := range ix.paths {
+			opts[p] = o[i]
+		}
+	}
+	paths := s.Paths()
+	list := make([]string, len(paths))
+	for i, p := range paths {
+		list[i] = opts[p]
+	}
+	return list
+}
+
+// PostingQuery returns the names of the files in any of the shards
+// that may match q.  It calls log.Fatal if a shard is corrupt.
+func (s *Set) PostingQuery(q *Query) []string {
+	names, err := s.PostingQueryE(q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return names
+}
+
+// PostingQueryE is like PostingQuery but returns an error
+// if a shard is corrupt.  It queries the shards in parallel
+// and returns the names in shard order, leaving out those
+// that newer shards shadow.
+func (s *Set) PostingQueryE(q *Query) ([]string, error) {
+	results := make([][]string, len(s.shards))
+	err := s.eachShard(func(i int, ix *Index) (err error) {
+		results[i], err = ix.postingNames(q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var owner map[string]int
+	if len(s.shards) > 1 {
+		owner = s.owners(results)
+	}
+	var names []string
+	for i, list := range results {
+		if s.Verbose {
+			log.Printf("%s: post query identified %d possible files", s.files[i], len(list))
+		}
+		for _, name := range list {
+			if owner != nil {
+				if o, ok := owner[name]; !ok || o != i {
+					continue
+				}
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// PostingGroups is like PostingQuery but groups the names of the
+// files that the index records as having the same contents (see
+// IndexWriter.Dedup), so that each group need only be searched once.
+// The groups are in the order of their first names.  Files in
+// different shards are never in the same group.
+func (s *Set) PostingGroups(q *Query) [][]string {
+	groups, err := s.PostingGroupsE(q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return groups
+}
+
+// PostingGroupsE is like PostingGroups but returns an error
+// if a shard is corrupt.
+func (s *Set) PostingGroupsE(q *Query) ([][]string, error) {
+	files, err := s.PostingFileGroupsE(q)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([][]string, len(files))
+	for i, group := range files {
+		groups[i] = make([]string, len(group))
+		for j, f := range group {
+			groups[i][j] = f.Name
+		}
+	}
+	return groups, nil
+}
+
+// A FileRef refers to a file found by a query on a set.  Besides its name,
+// it records where in the set it was found, so that FileContents
+// can read it without looking up the name again.
+type FileRef struct {
+	Name  string
+	shard int
+	id    uint32
+}
+
+// PostingFileGroups is like PostingGroups but returns FileRefs
+// in place of names.
+func (s *Set) PostingFileGroups(q *Query) [][]FileRef {
+	groups, err := s.PostingFileGroupsE(q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return groups
+}
+
+// PostingFileGroupsE is like PostingFileGroups but returns an error
+// if a shard is corrupt.
+func (s *Set) PostingFileGroupsE(q *Query) ([][]FileRef, error) {
+	results := make([][][]FileRef, len(s.shards))
+	err := s.eachShard(func(i int, ix *Index) (err error) {
+		results[i], err = ix.postingGroups(i, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var owner map[string]int
+	if len(s.shards) > 1 {
+		names := make([][]string, len(results))
+		for i, list := range results {
+			for _, group := range list {
+				for _, f := range group {
+					names[i] = append(names[i], f.Name)
+				}
+			}
+		}
+		owner = s.owners(names)
+	}
+	var groups [][]FileRef
+	for i, list := range results {
+		if s.Verbose {
+			log.Printf("%s: post query identified %d possible groups of files", s.files[i], len(list))
+		}
+		if owner == nil {
+			groups = list
+			break
+		}
+		for _, group := range list {
+			var files []FileRef
+			for _, f := range group {
+				if o, ok := owner[f.Name]; ok && o == i {
+					files = append(files, f)
+				}
+			}
+			if len(files) > 0 {
+				groups = append(groups, files)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// HasContents reports whether any shard stores the content
+// of its files (see IndexWriter.StoreContents).
+func (s *Set) HasContents() bool {
+	for _, ix := range s.shards {
+		if ix.HasContents() {
+			return true
+		}
+	}
+	return false
+}
+
+// Contents returns the content of the file with the given name as
+// it was when it was indexed, from the newest shard that has the file
+// and is not shadowed for it, if that shard stores the file's content
+// (see IndexWriter.StoreContents).  It returns false if not.
+// It calls log.Fatal if a shard is corrupt.
+func (s *Set) Contents(name string) ([]byte, bool) {
+	data, ok, err := s.ContentsE(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data, ok
+}
+
+// ContentsE is like Contents but returns an error
+// if a shard is corrupt.
+func (s *Set) ContentsE(name string) (data []byte, ok bool, err error) {
+	for _, i := range s.order {
+		if s.hidden(i, name) {
+			break
+		}
+		var found bool
+		if data, found, ok, err = s.shards[i].namedContents(name); found || err != nil {
+			return data, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// FileContents is like Contents but reads the content of f
+// from the shard in which the query that returned f found it.
+func (s *Set) FileContents(f FileRef) ([]byte, bool) {
+	data, ok, err := s.FileContentsE(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data, ok
+}
+
+// FileContentsE is like FileContents but returns an error
+// if the shard is corrupt.
+func (s *Set) FileContentsE(f FileRef) (data []byte, ok bool, err error) {
+	defer catch(&err)
+	data, ok = s.shards[f.shard].readContents(f.id)
+	return data, ok, nil
+}
+
+// eachShard calls f for each shard in parallel
+// and returns the error of the first shard that fails.
+func (s *Set) eachShard(f func(i int, ix *Index) error) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, ix := range s.shards {
+		wg.Add(1)
+		go func(i int, ix *Index) {
+			defer wg.Done()
+			errs[i] = f(i, ix)
+		}(i, ix)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postingNames returns the names of the files that may match q.
+func (ix *Index) postingNames(q *Query) (names []string, err error) {
+	defer catch(&err)
+	list := ix.dropDeleted(ix.withCopies(ix.postingQuery(q, nil)))
+	names = make([]string, len(list))
+	for i, id := range list {
+		names[i] = ix.name(id)
+	}
+	return names, nil
+}
+
+// postingGroups returns the files that may match q,
+// grouped by document, as found in shard number shard.
+func (ix *Index) postingGroups(shard int, q *Query) (groups [][]FileRef, err error) {
+	defer catch(&err)
+	group := make(map[uint32]int)
+	for _, id := range ix.dropDeleted(ix.withCopies(ix.postingQuery(q, nil))) {
+		doc := ix.doc(id)
+		i, ok := group[doc]
+		if !ok {
+			i = len(groups)
+			group[doc] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], FileRef{Name: ix.name(id), shard: shard, id: id})
+	}
+	return groups, nil
+}
+
+// namedContents reports whether the index has the file with the
+// given name and returns the content stored for it, if any.
+func (ix *Index) namedContents(name string) (data []byte, found, ok bool, err error) {
+	defer catch(&err)
+	id, found := ix.lookup(name)
+	if !found || ix.contents == 0 {
+		return nil, found, false, nil
+	}
+	data, ok = ix.readContents(id)
+	return data, true, ok, nil
+}
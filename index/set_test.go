@@ -0,0 +1,231 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	shards := filepath.Join(dir, "shards")
+	if err := os.Mkdir(shards, 0777); err != nil {
+		t.Fatal(err)
+	}
+	buildRootIndex(t, filepath.Join(shards, "1"+ShardExt), mergePaths1, mergeFiles1)
+	buildRootIndex(t, filepath.Join(shards, "2"+ShardExt), mergePaths2, mergeFiles2)
+	// Not a shard.
+	buildRootIndex(t, filepath.Join(shards, "3"+ShardExt+"~"), mergePaths3, mergeFiles3)
+
+	manifest := join(setMagic, "# comment\n", "shards/2", ShardExt, "\n\n", file("3"), "\n")
+	if err := ioutil.WriteFile(file("manifest"), []byte(manifest), 0666); err != nil {
+		t.Fatal(err)
+	}
+	buildRootIndex(t, file("3"), mergePaths3, mergeFiles3)
+	if err := ioutil.WriteFile(file("empty"), []byte(setMagic), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	now := &Query{Op: QAnd, Trigram: []string{"now"}}
+	for _, tt := range []struct {
+		path  string
+		paths []string
+		now   []string
+	}{
+		{
+			shards,
+			[]string{"/a", "/b", "/c", "/cc"},
+			// /b is in both shards, and the files of
+			// the newer shard 2 shadow those of shard 1.
+			[]string{"/c/de", "/b/xx", "/b/yy"},
+		},
+		{
+			file("manifest"),
+			[]string{"/a/y", "/b", "/c", "/cc"},
+			[]string{"/b/xx", "/b/yy", "/c/zz"},
+		},
+		{
+			file("3"),
+			[]string{"/a/y", "/c"},
+			[]string{"/c/zz"},
+		},
+	} {
+		s, err := OpenSet(tt.path)
+		if err != nil {
+			t.Errorf("OpenSet(%s): %v", tt.path, err)
+			continue
+		}
+		if paths := s.Paths(); strings.Join(paths, " ") != strings.Join(tt.paths, " ") {
+			t.Errorf("OpenSet(%s).Paths() = %v, want %v", tt.path, paths, tt.paths)
+		}
+		names, err := s.PostingQueryE(now)
+		if err != nil || strings.Join(names, " ") != strings.Join(tt.now, " ") {
+			t.Errorf("OpenSet(%s).PostingQueryE(now) = %v, %v, want %v", tt.path, names, err, tt.now)
+		}
+		s.Close()
+	}
+
+	// A shard listed later is newer, whatever the times of the
+	// files, and its recorded options win too.
+	s, err := OpenSet(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := s.PathOptions()
+	s.Close()
+	if opts[1] != "" {
+		t.Errorf("PathOptions() = %q, want no options for /b", opts)
+	}
+	ix := Create(filepath.Join(shards, "1"+ShardExt))
+	ix.AddPaths(mergePaths1)
+	ix.SetPathOptions("/b", "newer")
+	for i, name := range []string{"/b/xx", "/c/de"} {
+		r := strings.NewReader(mergeFiles1[name])
+		ix.Add(i+1, name, r, int64(r.Len()))
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	earlier := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(shards, "2"+ShardExt), earlier, earlier); err != nil {
+		t.Fatal(err)
+	}
+	manifest = join(setMagic, "shards/2", ShardExt, "\n", "shards/1", ShardExt, "\n")
+	if err := ioutil.WriteFile(file("manifest"), []byte(manifest), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		now  string
+		opt  string
+	}{
+		{shards, "/c/de /b/xx /b/yy", ""},
+		{file("manifest"), "/b/xx /c/de", "newer"},
+	} {
+		s, err := OpenSet(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := s.PostingQueryE(now)
+		if err != nil || strings.Join(names, " ") != tt.now {
+			t.Errorf("after rebuilding shard 1: OpenSet(%s).PostingQueryE(now) = %v, %v, want %v", tt.path, names, err, tt.now)
+		}
+		if opts := s.PathOptions(); opts[1] != tt.opt {
+			t.Errorf("after rebuilding shard 1: OpenSet(%s).PathOptions() = %q, want %q for /b", tt.path, opts, tt.opt)
+		}
+		s.Close()
+	}
+
+	if _, err := OpenSet(file("empty")); err == nil {
+		t.Errorf("OpenSet(empty manifest) succeeded")
+	}
+	if _, err := OpenSet(file("missing")); err == nil {
+		t.Errorf("OpenSet(missing) succeeded")
+	}
+}
+
+func TestSetGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	build := func(out string, paths []string, files ...string) {
+		ix := Create(out)
+		ix.Dedup = true
+		ix.StoreContents = true
+		ix.AddPaths(paths)
+		for i := 0; i < len(files); i += 2 {
+			rootNo := -1
+			for j, p := range paths {
+				if hasPathPrefix(files[i], p) {
+					rootNo = j
+				}
+			}
+			r := strings.NewReader(files[i+1])
+			ix.Add(rootNo, files[i], r, int64(r.Len()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(filepath.Join(dir, "1"+ShardExt), []string{"/a", "/b"},
+		"/a/x", "same now",
+		"/a/y", "other now",
+		"/b/x", "same now",
+		"/b/x/gone", "gone",
+		"/b/z", "same now")
+	// /b/x is in both shards, so only its copies in the older
+	// shard are left there.
+	build(filepath.Join(dir, "2"+ShardExt), []string{"/b/x", "/c"},
+		"/b/x", "same now",
+		"/c/q", "same now",
+		"/c/r", "same now")
+
+	s, err := OpenSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	groups, err := s.PostingGroupsE(&Query{Op: QAnd, Trigram: []string{"now"}})
+	var have []string
+	for _, g := range groups {
+		have = append(have, strings.Join(g, ","))
+	}
+	want := "/a/x,/b/z /a/y /b/x,/c/q,/c/r"
+	if err != nil || strings.Join(have, " ") != want {
+		t.Errorf("PostingGroupsE(now) = %v, %v, want %v", have, err, want)
+	}
+
+	// The content of a file under a path of a newer shard
+	// is not found in the older one.
+	for _, tt := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"/a/y", "other now", true},
+		{"/b/x", "same now", true},
+		{"/b/x/gone", "", false},
+	} {
+		data, ok, err := s.ContentsE(tt.name)
+		if string(data) != tt.want || ok != tt.ok || err != nil {
+			t.Errorf("ContentsE(%s) = %q, %v, %v, want %q, %v, nil", tt.name, data, ok, err, tt.want, tt.ok)
+		}
+	}
+
+	// The files found by the query read their stored content
+	// from the shard they were found in.
+	refs, err := s.PostingFileGroupsE(&Query{Op: QAnd, Trigram: []string{"now"}})
+	if err != nil || len(refs) != len(groups) {
+		t.Fatalf("PostingFileGroupsE(now) = %v, %v, want %d groups", refs, err, len(groups))
+	}
+	for i, group := range refs {
+		for j, f := range group {
+			if f.Name != groups[i][j] {
+				t.Errorf("PostingFileGroupsE(now)[%d][%d].Name = %s, want %s", i, j, f.Name, groups[i][j])
+			}
+			data, ok, err := s.FileContentsE(f)
+			want := "same now"
+			if f.Name == "/a/y" {
+				want = "other now"
+			}
+			if string(data) != want || !ok || err != nil {
+				t.Errorf("FileContentsE(%s) = %q, %v, %v, want %q, true, nil", f.Name, data, ok, err, want)
+			}
+		}
+	}
+}
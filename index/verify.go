@@ -0,0 +1,478 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Index verification.
+//
+// Verify checks everything the readers assume about an index (see
+// read.go for the format): that the sections are in order, that the
+// path and name lists are sorted and properly terminated, that the name
+// index points at each name in turn, that the posting list index is
+// sorted by trigram and covers the posting lists exactly, that each
+// file's document is a file no later than it that is its own document,
+// and that each posting list decodes to the number of increasing
+// document IDs recorded for it, that the stored contents are those of
+// documents, in order, and of the sizes recorded for the files, that
+// there are path options for each path, and that the tombstones are
+// increasing file IDs.  Finally it checks the section checksums, so
+// that a checksum mismatch is reported after the more specific
+// problems that explain it.
+
+// maxProblems is the number of problems after which Verify stops.
+const maxProblems = 100
+
+// Verify checks the index in file and returns the problems it finds,
+// at most maxProblems of them.  It returns an error only if the file
+// cannot be read at all.
+func Verify(file string) ([]*CorruptError, error) {
+	ix, err := OpenE(file)
+	if err != nil {
+		if ce, ok := err.(*CorruptError); ok {
+			return []*CorruptError{ce}, nil
+		}
+		return nil, err
+	}
+	defer ix.Close()
+
+	v := &verifier{ix: ix}
+	if !v.run(v.checkSections) {
+		// The offsets of the sections cannot be trusted.
+		return v.problems, nil
+	}
+	v.run(v.checkPaths)
+	v.run(v.checkNames)
+	v.docsOK = v.run(v.checkDocs)
+	v.run(v.checkPosts)
+	v.run(v.checkFileInfo)
+	v.run(v.checkContents)
+	v.run(v.checkPathOptions)
+	v.run(v.checkTombstones)
+	v.run(v.checkChecksums)
+	return v.problems, nil
+}
+
+type verifier struct {
+	ix       *Index
+	problems []*CorruptError
+	docsOK   bool // whether the documents can be checked against
+}
+
+// tooMany is the panic that stops verification after maxProblems.
+type tooMany struct{}
+
+// problem records a problem with the data at offset off.
+func (v *verifier) problem(off uint64, format string, args ...interface{}) {
+	e := v.ix.corruptError(off)
+	e.Msg = fmt.Sprintf(format, args...)
+	v.problems = append(v.problems, e)
+	if len(v.problems) >= maxProblems {
+		panic(tooMany{})
+	}
+}
+
+// run runs check, which stops at the first problem it cannot
+// recover from by panicking.  It reports whether check found
+// no problems.
+func (v *verifier) run(check func()) (ok bool) {
+	if len(v.problems) >= maxProblems {
+		return false
+	}
+	n := len(v.problems)
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+		case tooMany:
+		case *CorruptError:
+			e.Msg = "data out of range"
+			v.problems = append(v.problems, e)
+		default:
+			panic(e)
+		}
+		ok = len(v.problems) == n
+	}()
+	check()
+	return
+}
+
+func (v *verifier) checkSections() {
+	ix := v.ix
+	if ix.pathData != uint64(len(magic)) {
+		v.problem(ix.trailer, "path list starts at %d, want %d", ix.pathData, len(magic))
+	}
+	// The required sections are in trailer order; the
+	// optional ones may be anywhere after them.
+	prev := uint64(0)
+	seen := make(map[uint64]bool)
+	for i, s := range ix.sections {
+		name := "section"
+		if i < len(sectionTitles) {
+			name = sectionTitles[i]
+		}
+		switch {
+		case s == 0 && i < numRequiredSections:
+			v.problem(ix.trailer+uint64(i)*ix.offsetSize, "%s missing", name)
+		case s == 0:
+		case s < prev || s > ix.trailer || seen[s]:
+			v.problem(ix.trailer+uint64(i)*ix.offsetSize, "%s offset %d out of order", name, s)
+		case i < numRequiredSections:
+			prev = s
+		}
+		seen[s] = true
+	}
+}
+
+func (v *verifier) checkPaths() {
+	ix := v.ix
+	off, end := ix.pathData, ix.sectionEnd(ix.pathData)
+	prev := ""
+	for {
+		s := ix.slice(off, int(end-off))
+		i := bytes.IndexByte(s, 0)
+		if i < 0 {
+			v.problem(off, "path list not terminated")
+			return
+		}
+		p := string(s[:i])
+		if p == "" {
+			if extra := len(s) - 1; extra > 0 {
+				v.problem(off+1, "%d bytes after end of path list", extra)
+			}
+			return
+		}
+		if prev != "" && comparePaths(p, prev) <= 0 {
+			v.problem(off, "path %q not after %q", p, prev)
+		}
+		prev = p
+		off += uint64(i + 1)
+	}
+}
+
+func (v *verifier) checkNames() {
+	ix := v.ix
+	if size := ix.postIndex - ix.nameIndex; size%ix.offsetSize != 0 {
+		v.problem(ix.postIndex, "name index size %d is not a multiple of %d", size, ix.offsetSize)
+	}
+	end := ix.sectionEnd(ix.nameData) - ix.nameData
+	pos := uint64(0)
+	prev := ""
+	for i := 0; i <= ix.numName; i++ {
+		idx := ix.nameIndex + ix.offsetSize*uint64(i)
+		if off := ix.offsetAt(idx); off != pos {
+			v.problem(idx, "name index entry %d is %d, want %d", i, off, pos)
+			return
+		}
+		off := ix.nameData + pos
+		s := ix.slice(off, int(end-pos))
+		root, n := binary.Uvarint(s)
+		if n <= 0 {
+			v.problem(off, "bad root number for name %d", i)
+			return
+		}
+		j := bytes.IndexByte(s[n:], 0)
+		if j < 0 {
+			v.problem(off, "name %d not terminated", i)
+			return
+		}
+		name := string(s[n : n+j])
+		pos += uint64(n + j + 1)
+		if i == ix.numName {
+			if root != 0 || name != "" {
+				v.problem(off, "name list not terminated")
+			} else if pos != end {
+				v.problem(ix.nameData+pos, "%d bytes after end of name list", end-pos)
+			}
+			return
+		}
+		if root > uint64(len(ix.paths)) {
+			v.problem(off, "name %d has root %d but there are %d paths", i, root, len(ix.paths))
+			continue
+		}
+		if root > 0 {
+			name = ix.paths[root-1] + name
+		}
+		if i > 0 && comparePaths(name, prev) <= 0 {
+			v.problem(off, "name %d %q not after %q", i, name, prev)
+		}
+		prev = name
+	}
+}
+
+func (v *verifier) checkPosts() {
+	ix := v.ix
+	if size := ix.sectionEnd(ix.postIndex) - ix.postIndex; size%ix.postEntrySize != 0 {
+		v.problem(ix.postIndex+size-size%ix.postEntrySize, "%d bytes after end of posting list index", size%ix.postEntrySize)
+	}
+	end := ix.sectionEnd(ix.postData) - ix.postData
+	pos := uint64(0)
+	prev := int64(-1)
+	for i := 0; i < ix.numPost; i++ {
+		idx := ix.postIndex + uint64(i)*ix.postEntrySize
+		trigram, count, offset := ix.listAt(uint32(i))
+		if int64(trigram) <= prev {
+			v.problem(idx, "trigram %q not after %q", trigramString(trigram), trigramString(uint32(prev)))
+		}
+		prev = int64(trigram)
+		if trigram == 1<<24-1 && count != 0 {
+			v.problem(idx, "terminating posting list has count %d", count)
+		}
+		if offset > end {
+			v.problem(idx, "posting list for %q at %d is past the end", trigramString(trigram), offset)
+			return
+		}
+		if start := ix.listStart(count, offset); start != pos {
+			v.problem(idx, "posting list for %q starts at %d, want %d", trigramString(trigram), start, pos)
+		}
+		pos = v.checkList(idx, trigram, count, offset, end)
+	}
+	if prev != 1<<24-1 {
+		v.problem(ix.sectionEnd(ix.postIndex), "posting list index not terminated")
+	}
+	if pos != end {
+		v.problem(ix.postData+pos, "%d bytes after end of posting lists", end-pos)
+	}
+}
+
+// checkList checks the posting list for trigram, whose index entry
+// at idx records the given count and offset.  It returns the offset
+// at which the list ends, relative to the posting lists.
+func (v *verifier) checkList(idx uint64, trigram, count uint32, offset, end uint64) uint64 {
+	ix := v.ix
+	t := trigramString(trigram)
+	off := ix.postData + offset
+	fileid := ^uint32(0)
+	nid := uint32(0)
+	bad := false
+	first := int64(-1) // first file ID of the current block
+	// add checks the next file ID in the list.
+	add := func(id uint32) {
+		switch {
+		case bad:
+		case id >= uint32(ix.numName):
+			v.problem(off, "posting list for %q has file ID %d but there are %d files", t, id, ix.numName)
+			bad = true
+		case v.docsOK && ix.doc(id) != id:
+			v.problem(off, "posting list for %q has file ID %d, which is not a document", t, id)
+			bad = true
+		case nid > 0 && id <= fileid:
+			v.problem(off, "posting list for %q has file ID %d after %d", t, id, fileid)
+			bad = true
+		}
+		if first >= 0 && int64(id) != first {
+			v.problem(off, "block of posting list for %q starts with file ID %d, want %d", t, id, first)
+		}
+		first = -1
+		fileid = id
+		nid++
+	}
+	// decode decodes the delta list d, returning its length.
+	// If block is true, d has no terminating 0.
+	decode := func(d []byte, block bool) int {
+		nvarint := 0
+		p := 0
+		for p < len(d) {
+			x, n := binary.Uvarint(d[p:])
+			if n <= 0 {
+				v.problem(off, "bad varint in posting list for %q", t)
+				return -1
+			}
+			p += n
+			if x == 0 {
+				if block {
+					v.problem(off, "0 in block of posting list for %q", t)
+					return -1
+				}
+				if nid != count && (ix.version >= 4 || uint32(nvarint) != count) {
+					v.problem(idx, "posting list for %q has %d file IDs, want %d", t, nid, count)
+				}
+				return p
+			}
+			nvarint++
+			if x <= 31 {
+				for ; x > 0; x-- {
+					add(fileid + 1)
+				}
+			} else {
+				add(fileid + uint32(x-30))
+			}
+		}
+		if !block {
+			v.problem(off, "posting list for %q not terminated", t)
+			return -1
+		}
+		return p
+	}
+
+	if !ix.blockList(count) {
+		n := decode(ix.slice(off, int(end-offset)), false)
+		if n < 0 {
+			return end
+		}
+		return offset + uint64(n)
+	}
+
+	nblock := (count + postBlockSize - 1) / postBlockSize
+	skip := ix.slice(off, int(8*nblock))
+	size := uint64(binary.BigEndian.Uint32(skip[8*(nblock-1)+4:]))
+	data := ix.slice(off-size, int(size))
+	start := uint32(0)
+	var buf []byte
+	for b := uint32(0); b < nblock; b++ {
+		blockFirst := binary.BigEndian.Uint32(skip[8*b:])
+		blockEnd := binary.BigEndian.Uint32(skip[8*b+4:])
+		if blockEnd <= start || uint64(blockEnd) > size {
+			v.problem(off+8*uint64(b), "block %d of posting list for %q ends at %d", b, t, blockEnd)
+			break
+		}
+		p := data[start:blockEnd]
+		start = blockEnd
+		switch p[0] {
+		case blockRaw:
+			p = p[1:]
+		case blockS2:
+			var err error
+			if buf, err = s2.Decode(buf[:cap(buf)], p[1:]); err != nil {
+				v.problem(off, "block %d of posting list for %q: %v", b, t, err)
+				return offset + 8*uint64(nblock)
+			}
+			p = buf
+		default:
+			v.problem(off, "block %d of posting list for %q has encoding %d", b, t, p[0])
+			return offset + 8*uint64(nblock)
+		}
+		if nid > 0 && blockFirst <= fileid {
+			v.problem(off+8*uint64(b), "block %d of posting list for %q starts at file ID %d after %d", b, t, blockFirst, fileid)
+			return offset + 8*uint64(nblock)
+		}
+		n0 := nid
+		fileid = blockFirst - 1
+		first = int64(blockFirst)
+		if decode(p, true) < 0 {
+			return offset + 8*uint64(nblock)
+		}
+		want := uint32(postBlockSize)
+		if b == nblock-1 {
+			want = count - postBlockSize*(nblock-1)
+		}
+		if got := nid - n0; got != want {
+			v.problem(off+8*uint64(b), "block %d of posting list for %q has %d file IDs, want %d", b, t, got, want)
+		}
+	}
+	return offset + 8*uint64(nblock)
+}
+
+func (v *verifier) checkFileInfo() {
+	ix := v.ix
+	if ix.fileInfo == 0 {
+		return
+	}
+	size := ix.sectionEnd(ix.fileInfo) - ix.fileInfo
+	if want := uint64(ix.numName) * fileInfoSize; size != want {
+		v.problem(ix.fileInfo, "file info has %d bytes, want %d", size, want)
+	}
+}
+
+func (v *verifier) checkDocs() {
+	ix := v.ix
+	if ix.docs == 0 {
+		return
+	}
+	for id := uint32(0); id < uint32(ix.numName); id++ {
+		off := ix.docs + 4*uint64(id)
+		if doc := ix.uint32(off); doc > id || ix.uint32(ix.docs+4*uint64(doc)) != doc {
+			v.problem(off, "file ID %d has document %d, which is not a document before it", id, doc)
+			return
+		}
+	}
+}
+
+func (v *verifier) checkContents() {
+	ix := v.ix
+	if ix.contents == 0 {
+		return
+	}
+	table := ix.contentTable()
+	prev := uint64(0)
+	for id := uint32(0); id < uint32(ix.numName); id++ {
+		off := table + 8*uint64(id)
+		end := ix.uint64(off)
+		if end < prev || ix.contents+end > table {
+			v.problem(off, "contents of file ID %d end at %d, out of order", id, end)
+			return
+		}
+		if end > prev {
+			start := ix.contents + prev
+			if v.docsOK && ix.doc(id) != id {
+				v.problem(off, "file ID %d has contents but is not a document", id)
+			}
+			n, err := s2.DecodedLen(ix.slice(start, int(end-prev)))
+			if err != nil {
+				v.problem(start, "contents of file ID %d: %v", id, err)
+			} else if fi, ok := ix.fileInfoAt(id); ok && int64(n) != fi.Size {
+				v.problem(start, "contents of file ID %d have %d bytes, want %d", id, n, fi.Size)
+			}
+		}
+		prev = end
+	}
+	if ix.contents+prev != table {
+		v.problem(ix.contents+prev, "%d bytes after end of contents", table-ix.contents-prev)
+	}
+}
+
+func (v *verifier) checkPathOptions() {
+	ix := v.ix
+	if ix.pathOptions == 0 {
+		return
+	}
+	off, end := ix.pathOptions, ix.sectionEnd(ix.pathOptions)
+	n := 0
+	for off < end {
+		i := bytes.IndexByte(ix.slice(off, int(end-off)), '\x00')
+		if i < 0 {
+			v.problem(off, "unterminated path options")
+			return
+		}
+		off += uint64(i + 1)
+		n++
+	}
+	if n != len(ix.paths) {
+		v.problem(ix.pathOptions, "path options for %d paths, want %d", n, len(ix.paths))
+	}
+}
+
+func (v *verifier) checkTombstones() {
+	ix := v.ix
+	for i := 0; i < ix.numDeleted; i++ {
+		id := ix.deletedAt(i)
+		if id >= uint32(ix.numName) || i > 0 && id <= ix.deletedAt(i-1) {
+			v.problem(ix.tombstones+4*uint64(i), "tombstone for file ID %d out of order (%d files)", id, ix.numName)
+			return
+		}
+	}
+}
+
+func (v *verifier) checkChecksums() {
+	ix := v.ix
+	sums := ix.section(sectionChecksums)
+	if sums == 0 {
+		return
+	}
+	if size := ix.sectionEnd(sums) - sums; size%4 != 0 {
+		v.problem(sums, "checksums size %d is not a multiple of 4", size)
+	}
+	for _, e := range ix.badChecksums() {
+		v.problem(e.Offset, "%s", e.Msg)
+	}
+}
+
+func trigramString(t uint32) string {
+	return string([]byte{byte(t >> 16), byte(t >> 8), byte(t)})
+}
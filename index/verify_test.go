@@ -0,0 +1,104 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func verifyData(t *testing.T, data string) []*CorruptError {
+	t.Helper()
+	file := writeTemp(t, data)
+	defer os.Remove(file)
+	problems, err := Verify(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return problems
+}
+
+func TestVerify(t *testing.T) {
+	for _, old := range oldIndexes {
+		if problems := verifyData(t, old.data); len(problems) != 0 {
+			t.Errorf("Verify(version %d) = %v, want no problems", old.version, problems)
+		}
+	}
+
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	buildIndex(t, f.Name(), nil, manyFiles("/v", 1000, func(i int) string {
+		return strings.Repeat("x", i%7) + " file"
+	}))
+	if problems, err := Verify(f.Name()); err != nil || len(problems) != 0 {
+		t.Errorf("Verify(block lists) = %v, %v, want no problems", problems, err)
+	}
+
+	if _, err := Verify("/nonexistent/index"); err == nil {
+		t.Errorf("Verify(nonexistent) succeeded")
+	}
+}
+
+var verifyTests = []struct {
+	what    string
+	off     int
+	c       byte
+	section string
+	at      uint64
+	msg     string
+}{
+	{"unsorted names", 18, 'z', "name list", 25, `name 1 "f0" not after "zfile4"`},
+	{"name index", 103, 9, "name index", 96, "name index entry 1 is 9, want 8"},
+	{"trigram order", 160, 'z', "posting list index", 174, `trigram "\nda" not after "\nzb"`},
+	{"posting count", 150, 2, "posting list index", 144, `posting list for "\na\n" has 1 file IDs, want 2`},
+	{"file ID range", 62, 30 + 9, "posting lists", 62, `posting list for "\na\n" has file ID 8 but there are 6 files`},
+	{"bad header", 0, 'x', "header", 0, ""},
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	for _, tt := range verifyTests {
+		problems := verifyData(t, corruptIndex(tt.off, tt.c))
+		if len(problems) == 0 {
+			t.Errorf("%s: no problems found", tt.what)
+			continue
+		}
+		p := problems[0]
+		if p.Section != tt.section || p.Offset != tt.at || p.Msg != tt.msg {
+			t.Errorf("%s: %s at %d: %q, want %s at %d: %q", tt.what, p.Section, p.Offset, p.Msg, tt.section, tt.at, tt.msg)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	// A different file ID in the posting list for "\na\n"
+	// that is still a valid index.
+	file := writeTemp(t, corruptIndex(62, 30+4))
+	defer os.Remove(file)
+
+	ix, err := OpenE(file)
+	if err != nil {
+		t.Fatalf("OpenE: %v", err)
+	}
+	ix.Close()
+	_, err = OpenChecked(file)
+	checkCorrupt(t, "OpenChecked", err, "posting lists", 62)
+
+	problems, err := Verify(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Section != "posting lists" || !strings.HasPrefix(problems[0].Msg, "checksum ") {
+		t.Errorf("Verify = %v, want one checksum problem in posting lists", problems)
+	}
+
+	file = writeTemp(t, trivialIndex)
+	defer os.Remove(file)
+	ix, err = OpenChecked(file)
+	if err != nil {
+		t.Fatalf("OpenChecked: %v", err)
+	}
+	ix.Close()
+}
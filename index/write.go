@@ -7,13 +7,23 @@
 package index
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
+	"github.com/klauspost/compress/s2"
 	"github.com/waddyano/codesearch/sparse"
 )
 
@@ -26,64 +36,179 @@ import (
 // Instead, we sort and flush the list to a new temporary file each time
 // it reaches its maximum in-memory size, and then at the end we
 // create the final posting lists by merging the temporary files as we
-// read them back in.
+// read them back in.  So that there are never too many temporary files
+// to merge at once, whenever there are MaxSpillFiles of them the newest
+// ones are merged into one, in levels: a file made by merging files of
+// level n has level n+1, and the files merged are those of the lowest
+// level that has more than one, along with any newer ones.
 //
-// It would also be useful to be able to create an index for a subset
-// of the files and then merge that index into an existing one.  This would
-// allow incremental updating of an existing index when a directory changes.
-// But we have not implemented that.
+// To update an existing index, an index of the changed directories can be
+// merged into it (see merge.go).  Rebuilding the index of a directory need
+// not read every file again: given the old index, the writer takes the
+// trigrams of the files that have not changed from the old posting lists.
 
 // An IndexWriter creates an on-disk index corresponding to a set of files.
 type IndexWriter struct {
 	LogSkip bool // log information about skipped files
 	Verbose bool // log status using package log
 
-	trigram *sparse.Set // trigrams for the current file
-	buf     [8]byte     // scratch buffer
+	// Dedup makes files with the same content share a document:
+	// their trigrams are recorded once, for the first of them, and
+	// a search that finds one finds them all.  See read.go.
+	Dedup bool
 
-	paths []string
+	// StoreContents makes the index store the content of each
+	// document, compressed, so that searches can read the files as
+	// they were when they were indexed (see Index.Contents).  It
+	// must be set before the first file is added.
+	StoreContents bool
+
+	file string // index file being written
+	err  error  // first error that made an Add fail
+
+	rd  *fileReader // reader for Add and AddFile; see reader
+	buf [8]byte     // scratch buffer
+
+	paths       []string
+	pathOptions map[string]string // options recorded for each path
+	rootLimits  map[int]Limits    // limits for the files of each root
 
 	nameData   *bufWriter // temp file holding list of names
-	nameLen    uint32     // number of bytes written to nameData
 	nameIndex  *bufWriter // temp file holding name index
 	numName    int        // number of names written
+	fileInfo   *bufWriter // temp file holding file info
 	totalBytes int64
 
+	docs      map[[sha256.Size]byte]uint32 // document of each content hash
+	fileDoc   []uint32                     // document of each file
+	numCopies int                          // files that are not their own document
+
+	contents    *bufWriter // temp file holding compressed contents, with StoreContents
+	contentEnds *bufWriter // temp file holding the content table
+
 	post      []postEntry // list of (trigram, file#) pairs
 	postFile  []*os.File  // flushed post entries
+	postLevel []int       // merge level of each postFile
 	postIndex *bufWriter  // temp file holding posting list index
 
-	inbuf []byte     // input buffer
-	main  *bufWriter // main index file
+	main *bufWriter // main index file
 
+	old       *Index            // index to reuse unchanged files from
+	oldNames  map[string]uint32 // file IDs of the names in old
+	reuse     []uint32          // new file ID + 1 of each old file reused, or 0
+	nextReuse uint32            // lowest old file ID that can be reused next
+	numReused int
+
+	// The limits on what files to index, for the files of the roots
+	// with no limits of their own.  See Limits.
 	MaxFileLen      int64
 	MaxLineLen      int
 	MaxTextTrigrams int
 
 	MaxInvalidUTF8Ratio float64
+
+	// PostBufSize is the size in bytes of the buffer of (trigram, file#)
+	// pairs kept in memory.  Each time it fills, the pairs are sorted
+	// and written to a temporary "spill" file.  Sorting them takes
+	// another buffer of the same size.
+	PostBufSize int
+
+	// TempDir is the directory for the temporary files, other than
+	// the one that becomes the index.  If it is empty, the default
+	// directory for temporary files is used.
+	TempDir string
+
+	// MaxSpillFiles is the number of spill files at which some are
+	// merged into one.  If it is less than 2, they are not merged
+	// until Flush.
+	MaxSpillFiles int
 }
 
-const npost = 64 << 20 / 8 // 64 MB worth of post entries
+const (
+	defaultPostBufSize   = 64 << 20 // 64 MB worth of post entries
+	defaultMaxSpillFiles = 64
+)
 
 // Create returns a new IndexWriter that will write the index to file.
+// It calls log.Fatal if it cannot create its temporary files.
 func Create(file string) *IndexWriter {
-	return &IndexWriter{
-		trigram:             sparse.NewSet(1 << 24),
-		nameData:            bufCreate(""),
-		nameIndex:           bufCreate(""),
-		postIndex:           bufCreate(""),
-		main:                bufCreate(file),
-		post:                make([]postEntry, 0, npost),
-		inbuf:               make([]byte, 16384),
+	ix, err := CreateE(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ix
+}
+
+// CreateE is like Create but returns an error instead.
+//
+// The index is written to a temporary file in the same directory
+// as file, which Flush renames to file once the index is complete.
+// The other temporary files are created in TempDir when the first
+// file is added, so PostBufSize, TempDir and MaxSpillFiles can be
+// set until then.
+func CreateE(file string) (*IndexWriter, error) {
+	ix := &IndexWriter{
+		file:                file,
 		MaxFileLen:          1 << 30,
 		MaxLineLen:          2000,
 		MaxTextTrigrams:     20000,
 		MaxInvalidUTF8Ratio: 0.0,
+		PostBufSize:         defaultPostBufSize,
+		MaxSpillFiles:       defaultMaxSpillFiles,
+	}
+	var err error
+	if ix.main, err = bufCreate(file); err != nil {
+		return nil, err
 	}
+	return ix, nil
 }
 
+// start creates the temporary files for the names, name index,
+// file info, posting list index and contents, if it has not already
+// done so.
+// It records an error in ix.err and reports whether it succeeded.
+func (ix *IndexWriter) start() bool {
+	if ix.nameData != nil || ix.err != nil {
+		return ix.err == nil
+	}
+	temps := []**bufWriter{&ix.nameData, &ix.nameIndex, &ix.fileInfo, &ix.postIndex}
+	if ix.StoreContents {
+		temps = append(temps, &ix.contents, &ix.contentEnds)
+	}
+	for _, b := range temps {
+		if *b, ix.err = bufTemp(ix.TempDir); ix.err != nil {
+			ix.nameData = nil
+			return false
+		}
+	}
+	return true
+}
+
+// Close removes the temporary files used to build the index.
+// If Flush has not been called, no index is written.
 func (ix *IndexWriter) Close() {
-	ix.main.finish().Close()
+	for _, b := range []*bufWriter{ix.nameData, ix.nameIndex, ix.fileInfo, ix.postIndex, ix.contents, ix.contentEnds, ix.main} {
+		if b != nil {
+			b.remove()
+		}
+	}
+	for _, f := range ix.postFile {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	ix.postFile = nil
+	ix.postLevel = nil
+	if ix.rd != nil {
+		fileReaders.Put(ix.rd)
+		ix.rd = nil
+	}
+}
+
+// Err returns the first error that made an Add or AddFile fail,
+// which Flush also returns.  Once there is an error, Add and AddFile
+// add nothing more.
+func (ix *IndexWriter) Err() error {
+	return ix.err
 }
 
 // A postEntry is an in-memory (trigram, file#) pair.
@@ -106,44 +231,305 @@ func (ix *IndexWriter) AddPaths(paths []string) {
 	ix.paths = append(ix.paths, paths...)
 }
 
+// SetPathOptions records options for the given path in the index,
+// where Index.PathOptions returns them.  The index package does not
+// interpret them; they are for the program that builds the index, to
+// index the path the same way the next time.  They must not contain
+// a NUL byte.
+func (ix *IndexWriter) SetPathOptions(path, options string) {
+	if strings.Contains(options, "\x00") {
+		if ix.err == nil {
+			ix.err = fmt.Errorf("%q: path options have NUL byte", path)
+		}
+		return
+	}
+	if ix.pathOptions == nil {
+		ix.pathOptions = make(map[string]string)
+	}
+	ix.pathOptions[path] = options
+}
+
+// Limits are the limits on what files to index.  A file is skipped
+// if it is longer than MaxFileLen bytes, has a line longer than
+// MaxLineLen bytes, has more than MaxTextTrigrams distinct trigrams,
+// or has a ratio of invalid UTF-8 sequences to bytes greater than
+// MaxInvalidUTF8Ratio.
+type Limits struct {
+	MaxFileLen          int64
+	MaxLineLen          int
+	MaxTextTrigrams     int
+	MaxInvalidUTF8Ratio float64
+}
+
+// SetRootLimits sets the limits for the files of the root with the
+// given number, in place of those in the fields of ix.  It must be
+// called before any file is added.
+func (ix *IndexWriter) SetRootLimits(rootNo int, l Limits) {
+	if ix.rootLimits == nil {
+		ix.rootLimits = make(map[int]Limits)
+	}
+	ix.rootLimits[rootNo] = l
+}
+
+// limits returns the limits for the files of the given root.
+func (ix *IndexWriter) limits(rootNo int) Limits {
+	if l, ok := ix.rootLimits[rootNo]; ok {
+		return l
+	}
+	return Limits{ix.MaxFileLen, ix.MaxLineLen, ix.MaxTextTrigrams, ix.MaxInvalidUTF8Ratio}
+}
+
 // AddFile adds the file with the given name (opened using os.Open)
-// to the index.  It logs errors using package log.
-func (ix *IndexWriter) AddFile(rootNo int, name string) bool {
+// to the index.  It logs errors reading the file using package log.
+// Errors writing the index are reported by Err and Flush.
+func (ix *IndexWriter) AddFile(rootNo int, name string) (added bool) {
+	if !ix.checkName(name) {
+		return false
+	}
+	defer catch(&ix.err)
 	fi, err := os.Stat(name)
 	if err != nil {
 		log.Print(err)
 		return false
 	}
+	if ix.reuseFile(rootNo, name, fi) {
+		return true
+	}
 	f, err := os.Open(name)
 	if err != nil {
 		log.Print(err)
 		return false
 	}
 	defer f.Close()
-	return ix.Add(rootNo, name, f, fi.Size())
+	return ix.add(rootNo, name, f, fi.Size(), fi.ModTime())
+}
+
+// AddArchive adds the files in the archive with the given name (see
+// package archive) to the index under their virtual paths, in walk
+// order, and returns the number added.  It reads the archive even if
+// it has not changed since the index passed to Reuse.  It logs errors
+// reading the archive using package log.
+func (ix *IndexWriter) AddArchive(rootNo int, name string) int {
+	if !ix.checkName(name) {
+		return 0
+	}
+	n := 0
+	ok := true
+	ix.readArchive(ix.reader(), rootNo, name, func(j *addJob) {
+		if ok = ok && ix.addMember(j); ok {
+			n++
+		}
+	})
+	return n
+}
+
+// Reuse makes AddFile take the trigrams of a file from old, instead of
+// reading the file, if old records the same modification time and size
+// for it.  The result is the same as reading the files again, provided
+// old was written with the same limits on what files to index.
+// old must not be closed until Flush returns.  If old is corrupt,
+// the error is reported by Err and Flush.
+func (ix *IndexWriter) Reuse(old *Index) {
+	defer catch(&ix.err)
+	ix.old = old
+	ix.oldNames = make(map[string]uint32)
+	if old.fileInfo == 0 {
+		// Nothing to compare with.
+		return
+	}
+	for id := uint32(0); id < uint32(old.numName); id++ {
+		ix.oldNames[old.name(id)] = id
+	}
+	ix.reuse = make([]uint32, old.numName)
+}
+
+// NumReused returns the number of files added using the trigrams
+// recorded in the index passed to Reuse.
+func (ix *IndexWriter) NumReused() int {
+	return ix.numReused
+}
+
+// reuseFile adds the file with the given name and info using the
+// trigrams recorded for it in the old index, if it has not changed.
+// It reports whether it did.
+func (ix *IndexWriter) reuseFile(rootNo int, name string, fi os.FileInfo) bool {
+	// The trigrams are those of the file's old document.  Old
+	// documents are only reused in order, so that the old posting
+	// lists map to lists of increasing new file IDs.  A copy of a
+	// file already added needs no trigrams.
+	id, ok := ix.unchanged(rootNo, name, fi)
+	if !ok {
+		return false
+	}
+	old, _ := ix.old.fileInfoAt(id)
+	doc := ix.old.doc(id)
+	if _, dup := ix.docs[old.Hash]; !dup && doc < ix.nextReuse {
+		return false
+	}
+	if ix.Verbose {
+		log.Printf("reuse %s\n", name)
+	}
+	fileid := ix.addName(rootNo, name)
+	ix.fileInfo.write(ix.old.slice(ix.old.fileInfo+uint64(id)*fileInfoSize, fileInfoSize))
+	var content []byte
+	if ix.addDoc(fileid, old.Hash[:]) {
+		ix.reuse[doc] = fileid + 1
+		ix.nextReuse = doc + 1
+		content = ix.old.contentData(doc)
+	}
+	ix.addContent(content)
+	ix.totalBytes += old.Size
+	ix.numReused++
+	return true
+}
+
+// unchanged reports whether the old index records the same modification
+// time and size for the file with the given name and info as fi, and
+// with StoreContents its content, and if so returns its old file ID.
+// It does not change ix, so it can be called by several goroutines
+// at once.
+func (ix *IndexWriter) unchanged(rootNo int, name string, fi os.FileInfo) (uint32, bool) {
+	id, ok := ix.oldNames[name]
+	if !ok || fi.Size() > ix.limits(rootNo).MaxFileLen {
+		return 0, false
+	}
+	old, ok := ix.old.fileInfoAt(id)
+	if !ok || old.ModTime.IsZero() || !old.ModTime.Equal(fi.ModTime()) || old.Size != fi.Size() {
+		return 0, false
+	}
+	if ix.StoreContents && ix.old.contentData(ix.old.doc(id)) == nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// addReusedPosts adds the (trigram, file#) pairs of the documents
+// reused from the old index.  sortPost only sorts by trigram, so
+// they are kept apart from the pairs of the files that were read.
+func (ix *IndexWriter) addReusedPosts() {
+	if ix.numReused == 0 {
+		return
+	}
+	if len(ix.post) > 0 {
+		ix.flushPost()
+	}
+	for i := 0; i < ix.old.numPost; i++ {
+		trigram, count, offset := ix.old.listAt(uint32(i))
+		if trigram == 1<<24-1 {
+			continue
+		}
+		var r postReader
+		r.initAt(ix.old, int(count), offset, nil)
+		for r.next() {
+			if int(r.fileid) >= len(ix.reuse) {
+				r.corrupt()
+			}
+			id := ix.reuse[r.fileid]
+			if id == 0 {
+				continue
+			}
+			if len(ix.post) >= cap(ix.post) {
+				ix.growPost()
+			}
+			ix.post = append(ix.post, makePostEntry(trigram, id-1))
+		}
+	}
 }
 
 // Add adds the file f to the index under the given name.
-// It logs errors using package log.
+// It logs errors reading f using package log.
+// Errors writing the index are reported by Err and Flush.
 func (ix *IndexWriter) Add(rootNo int, name string, f io.Reader, size int64) bool {
-	if size > ix.MaxFileLen {
+	if !ix.checkName(name) {
+		return false
+	}
+	return ix.add(rootNo, name, f, size, time.Time{})
+}
+
+// checkName reports whether a file with the given name can be added.
+func (ix *IndexWriter) checkName(name string) bool {
+	if !ix.start() {
+		return false
+	}
+	if ix.err == nil && strings.Contains(name, "\x00") {
+		ix.err = fmt.Errorf("%q: file has NUL byte in name", name)
+	}
+	return ix.err == nil
+}
+
+// add adds the file f, last modified at mtime, to the index.
+func (ix *IndexWriter) add(rootNo int, name string, f io.Reader, size int64, mtime time.Time) bool {
+	r := ix.reader()
+	if !ix.readFile(r, rootNo, name, f, size) {
+		return false
+	}
+	ix.addTrigrams(rootNo, name, mtime, r.n, r.hash.Sum(nil), r.trigram.Dense(), r.content)
+	return true
+}
+
+// A fileReader holds what is needed to read a file and collect
+// its trigrams.  Each goroutine reading files needs its own.
+type fileReader struct {
+	trigram *sparse.Set // trigrams of the file
+	hash    hash.Hash   // hash of the file
+	inbuf   []byte      // input buffer
+	n       int64       // size of the file
+	data    []byte      // content of the file, with StoreContents
+	content []byte      // data compressed, with StoreContents
+}
+
+func newFileReader() *fileReader {
+	return &fileReader{
+		trigram: sparse.NewSet(1 << 24),
+		hash:    sha256.New(),
+		inbuf:   make([]byte, 16384),
+	}
+}
+
+// fileReaders holds the fileReaders not in use.  A fileReader's trigram
+// set takes 64MB, so they are only made when a file is to be read and
+// are reused by later IndexWriters and Adders.
+var fileReaders = sync.Pool{
+	New: func() interface{} { return newFileReader() },
+}
+
+// reader returns the fileReader for Add and AddFile,
+// getting one when it is first needed.
+func (ix *IndexWriter) reader() *fileReader {
+	if ix.rd == nil {
+		ix.rd = fileReaders.Get().(*fileReader)
+	}
+	return ix.rd
+}
+
+// readFile reads the file f into r, collecting its trigrams, and
+// reports whether the file is to be indexed: whether it looks like
+// text within the limits for the given root.  It does not change ix,
+// so it can be called by several goroutines at once, each with its
+// own r.
+func (ix *IndexWriter) readFile(r *fileReader, rootNo int, name string, f io.Reader, size int64) bool {
+	lim := ix.limits(rootNo)
+	if size > lim.MaxFileLen {
 		if ix.LogSkip {
 			log.Printf("%s: too long, ignoring\n", name)
 		}
 		return false
 	}
-	ix.trigram.Reset()
+	r.trigram.Reset()
+	r.hash.Reset()
+	r.data = r.data[:0]
+	r.content = nil
 	var (
 		c           = byte(0)
 		i           = 0
-		buf         = ix.inbuf[:0]
+		buf         = r.inbuf[:0]
 		tv          = uint32(0)
 		n           = int64(0)
 		linelen     = 0
 		inv_cnt     = int64(0)
 		b1          = byte(0)
 		b2          = byte(0)
-		max_invalid = int64(float64(size) * ix.MaxInvalidUTF8Ratio)
+		max_invalid = int64(float64(size) * lim.MaxInvalidUTF8Ratio)
 	)
 	for {
 		tv = (tv << 8) & (1<<24 - 1)
@@ -161,6 +547,10 @@ func (ix *IndexWriter) Add(rootNo int, name string, f io.Reader, size int64) boo
 				return false
 			}
 			buf = buf[:n]
+			r.hash.Write(buf)
+			if ix.StoreContents {
+				r.data = append(r.data, buf...)
+			}
 			i = 0
 		}
 		c = buf[i]
@@ -177,7 +567,7 @@ func (ix *IndexWriter) Add(rootNo int, name string, f io.Reader, size int64) boo
 					return false
 				}
 			} else {
-				ix.trigram.Add(tv)
+				r.trigram.Add(tv)
 			}
 		}
 		if (b1 == 0x00 || b2 == 0x00) && n >= 3 {
@@ -186,7 +576,7 @@ func (ix *IndexWriter) Add(rootNo int, name string, f io.Reader, size int64) boo
 			}
 			return false
 		}
-		if linelen++; linelen > ix.MaxLineLen {
+		if linelen++; linelen > lim.MaxLineLen {
 			if ix.LogSkip {
 				log.Printf("%s: skipped. Very long lines (%d)\n", name, linelen)
 			}
@@ -197,96 +587,201 @@ func (ix *IndexWriter) Add(rootNo int, name string, f io.Reader, size int64) boo
 		}
 	}
 	if inv_cnt > 0 {
-		if (float64(inv_cnt) / float64(size)) > ix.MaxInvalidUTF8Ratio {
+		if (float64(inv_cnt) / float64(size)) > lim.MaxInvalidUTF8Ratio {
 			if ix.LogSkip {
 				log.Printf("%s: skipped. High invalid UTF-8 ratio. total: %d invalid: %d ratio: %f\n", name, size, inv_cnt, float64(inv_cnt)/float64(size))
 			}
 			return false
 		}
 	}
-	if ix.trigram.Len() > ix.MaxTextTrigrams {
+	if r.trigram.Len() > lim.MaxTextTrigrams {
 		if ix.LogSkip {
-			log.Printf("%s: skipped. Too many trigrams (%d > %d)\n", name, ix.trigram.Len(), ix.MaxTextTrigrams)
+			log.Printf("%s: skipped. Too many trigrams (%d > %d)\n", name, r.trigram.Len(), lim.MaxTextTrigrams)
 		}
 		return false
 	}
-	ix.totalBytes += n
+	r.n = n
+	if ix.StoreContents {
+		r.content = s2.Encode(nil, r.data)
+	}
+	return true
+}
+
+// addTrigrams adds the file with the given name, modification time,
+// size, hash, trigrams and, with StoreContents, compressed content
+// to the index.
+func (ix *IndexWriter) addTrigrams(rootNo int, name string, mtime time.Time, size int64, sum []byte, trigrams []uint32, content []byte) {
+	ix.totalBytes += size
 
 	if ix.Verbose {
-		log.Printf("%d %d %s\n", n, ix.trigram.Len(), name)
+		log.Printf("%d %d %s\n", size, len(trigrams), name)
 	}
 
 	fileid := ix.addName(rootNo, name)
-	for _, trigram := range ix.trigram.Dense() {
+	ix.addFileInfo(mtime, size, sum)
+	if !ix.addDoc(fileid, sum) {
+		ix.addContent(nil)
+		return
+	}
+	ix.addContent(content)
+	for _, trigram := range trigrams {
 		if len(ix.post) >= cap(ix.post) {
-			ix.flushPost()
+			ix.growPost()
 		}
 		ix.post = append(ix.post, makePostEntry(trigram, fileid))
 	}
-
-	return true
 }
 
-// Flush flushes the index entry to the target file.
-func (ix *IndexWriter) Flush() {
+// Flush writes the index to the file passed to Create and removes
+// the temporary files used to build it.  If it returns an error,
+// the file is left as it was.
+func (ix *IndexWriter) Flush() (err error) {
+	defer ix.Close()
+	defer catch(&err)
+	if !ix.start() {
+		return ix.err
+	}
+	ix.addReusedPosts()
 	ix.addName(-1, "")
 
-	var off [5]uint32
 	ix.main.writeString(magic)
-	off[0] = ix.main.offset()
+	sect := sectionWriter{out: ix.main}
+	sect.start(sectionPaths)
 	for _, p := range ix.paths {
 		ix.main.writeString(p)
 		ix.main.writeString("\x00")
 	}
 	ix.main.writeString("\x00")
-	off[1] = ix.main.offset()
+	sect.start(sectionNames)
 	copyFile(ix.main, ix.nameData)
-	off[2] = ix.main.offset()
-	ix.mergePost(ix.main)
-	off[3] = ix.main.offset()
+	sect.start(sectionPosts)
+	if err := ix.mergePost(ix.main); err != nil {
+		return err
+	}
+	sect.start(sectionNameIndex)
 	copyFile(ix.main, ix.nameIndex)
-	off[4] = ix.main.offset()
+	sect.start(sectionPostIndex)
 	copyFile(ix.main, ix.postIndex)
-	for _, v := range off {
-		ix.main.writeUint32(v)
+	sect.start(sectionFileInfo)
+	copyFile(ix.main, ix.fileInfo)
+	if ix.numCopies > 0 {
+		writeDocs(&sect, ix.fileDoc)
 	}
-	ix.main.writeString(trailerMagic)
-
-	os.Remove(ix.nameData.name)
-	for _, f := range ix.postFile {
-		os.Remove(f.Name())
+	if ix.contents != nil {
+		sect.start(sectionContents)
+		copyFile(ix.main, ix.contents)
+		copyFile(ix.main, ix.contentEnds)
 	}
-	os.Remove(ix.nameIndex.name)
-	os.Remove(ix.postIndex.name)
+	opts := make([]string, len(ix.paths))
+	for i, p := range ix.paths {
+		opts[i] = ix.pathOptions[p]
+	}
+	writePathOptions(&sect, opts)
+	sect.finish()
 
+	for _, b := range []*bufWriter{ix.nameData, ix.nameIndex, ix.postIndex, ix.fileInfo, ix.contents, ix.contentEnds, ix.main} {
+		if b != nil && b.err != nil {
+			return b.err
+		}
+	}
+	if ix.err != nil {
+		return ix.err
+	}
 	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
+	return ix.main.commit(ix.file)
+}
+
+// A sectionWriter records the offsets and checksums of the sections
+// of an index as they are written to out.
+type sectionWriter struct {
+	out  *bufWriter
+	cur  int  // section being written
+	busy bool // whether cur has been started
+	off  [numSections]uint64
+	sums [numSections]uint32
+}
+
+// start ends the current section, if any, and starts section i
+// at the current offset, which it returns.
+func (w *sectionWriter) start(i int) uint64 {
+	sum := w.out.sum()
+	if w.busy {
+		w.sums[w.cur] = sum
+	}
+	w.cur, w.busy = i, true
+	w.off[i] = w.out.offset()
+	return w.off[i]
+}
+
+// finish ends the last section and writes the checksums
+// and the trailer.
+func (w *sectionWriter) finish() {
+	w.start(sectionChecksums)
+	for _, sum := range w.sums {
+		w.out.writeUint32(sum)
+	}
+	for _, v := range w.off {
+		w.out.writeUint64(v)
+	}
+	w.out.writeUint32(numSections)
+	w.out.writeString(trailerMagic)
+}
 
-	ix.main.flush()
+// writeDocs writes the documents section, with the given
+// document of each file.
+func writeDocs(w *sectionWriter, docs []uint32) {
+	w.start(sectionDocs)
+	for _, doc := range docs {
+		w.out.writeUint32(doc)
+	}
+}
+
+// writePathOptions writes the path options section, with the
+// given options for each path, unless there are none.
+func writePathOptions(w *sectionWriter, opts []string) {
+	empty := true
+	for _, o := range opts {
+		if o != "" {
+			empty = false
+		}
+	}
+	if empty {
+		return
+	}
+	w.start(sectionPathOptions)
+	for _, o := range opts {
+		w.out.writeString(o)
+		w.out.writeByte(0)
+	}
 }
 
 func copyFile(dst, src *bufWriter) {
-	dst.flush()
-	_, err := io.Copy(dst.file, src.finish())
-	if err != nil {
-		log.Fatalf("copying %s to %s: %v", src.name, dst.name, err)
+	if dst.err != nil {
+		return
+	}
+	if src.err != nil {
+		dst.err = src.err
+		return
+	}
+	_, err := io.Copy(dst, src.finish())
+	if err != nil && dst.err == nil {
+		dst.err = fmt.Errorf("copying %s to %s: %v", src.name, dst.name, err)
 	}
 }
 
 // addName adds the file with the given name to the index.
-// It returns the assigned file ID number.
+// It returns the assigned file ID number.  A name outside the
+// given root, which a symlink can lead to, is stored in full.
 func (ix *IndexWriter) addName(rootNo int, name string) uint32 {
-	if strings.Contains(name, "\x00") {
-		log.Fatalf("%q: file has NUL byte in name", name)
-	}
-
-	ix.nameIndex.writeUint32(ix.nameData.offset())
-	ix.nameData.writeUvarint(uint32(rootNo + 1))
 	if rootNo >= 0 {
-		rl := len(ix.paths[rootNo])
-		if name[:rl] == ix.paths[rootNo] {
-			name = name[rl:]
+		if root := ix.paths[rootNo]; strings.HasPrefix(name, root) {
+			name = name[len(root):]
+		} else {
+			rootNo = -1
 		}
 	}
+	ix.nameIndex.writeUint64(ix.nameData.offset())
+	ix.nameData.writeUvarint(uint32(rootNo + 1))
 	ix.nameData.writeString(name)
 	ix.nameData.writeByte(0)
 	id := ix.numName
@@ -294,41 +789,194 @@ func (ix *IndexWriter) addName(rootNo int, name string) uint32 {
 	return uint32(id)
 }
 
+// addFileInfo records the modification time, size and hash
+// of the file just added.
+func (ix *IndexWriter) addFileInfo(mtime time.Time, size int64, sum []byte) {
+	t := int64(0)
+	if !mtime.IsZero() {
+		t = mtime.UnixNano()
+	}
+	ix.fileInfo.writeUint64(uint64(t))
+	ix.fileInfo.writeUint64(uint64(size))
+	ix.fileInfo.write(sum)
+}
+
+// addDoc records the document of the file just added, fileid, whose
+// content has the hash sum: with Dedup, the first file added with
+// that content.  It reports whether the file is a new document, whose
+// trigrams must be added.
+func (ix *IndexWriter) addDoc(fileid uint32, sum []byte) bool {
+	if !ix.Dedup {
+		return true
+	}
+	if ix.docs == nil {
+		ix.docs = make(map[[sha256.Size]byte]uint32)
+	}
+	var key [sha256.Size]byte
+	copy(key[:], sum)
+	if doc, ok := ix.docs[key]; ok {
+		ix.fileDoc = append(ix.fileDoc, doc)
+		ix.numCopies++
+		return false
+	}
+	ix.docs[key] = fileid
+	ix.fileDoc = append(ix.fileDoc, fileid)
+	return true
+}
+
+// addContent records the compressed content of the file just
+// added, or nil to store none for it, if the index stores contents.
+func (ix *IndexWriter) addContent(content []byte) {
+	if ix.contents == nil {
+		return
+	}
+	ix.contents.write(content)
+	ix.contentEnds.writeUint64(ix.contents.offset())
+}
+
+// growPost makes room in ix.post for another entry, allocating
+// the buffer the first time and otherwise flushing it.
+func (ix *IndexWriter) growPost() {
+	if ix.post == nil {
+		n := ix.PostBufSize / 8
+		if n < 1 {
+			n = 1
+		}
+		ix.post = make([]postEntry, 0, n)
+		return
+	}
+	ix.flushPost()
+}
+
 // flushPost writes ix.post to a new temporary file and
 // clears the slice.
+// If it fails, it records the error in ix.err.
 func (ix *IndexWriter) flushPost() {
-	w, err := ioutil.TempFile("", "csearch-index")
+	post := ix.post
+	ix.post = ix.post[:0]
+	if ix.err != nil {
+		return
+	}
+	w, err := ioutil.TempFile(ix.TempDir, "csearch-index")
 	if err != nil {
-		log.Fatal(err)
+		ix.err = err
+		return
 	}
+	ix.postFile = append(ix.postFile, w)
+	ix.postLevel = append(ix.postLevel, 0)
 	if ix.Verbose {
-		log.Printf("flush %d entries to %s", len(ix.post), w.Name())
+		log.Printf("flush %d entries to %s", len(post), w.Name())
 	}
-	sortPost(ix.post)
+	sortPost(post)
 
 	// Write the raw ix.post array to disk as is.
 	// This process is the one reading it back in, so byte order is not a concern.
-	data := (*[npost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
-	if n, err := w.Write(data); err != nil || n < len(data) {
-		if err != nil {
-			log.Fatal(err)
+	if _, err := w.Write(postBytes(post)); err != nil {
+		ix.err = err
+		return
+	}
+	w.Seek(0, 0)
+
+	if ix.MaxSpillFiles >= 2 && len(ix.postFile) >= ix.MaxSpillFiles {
+		ix.mergeSpill()
+	}
+}
+
+// mergeSpill merges the newest spill files into one, choosing them
+// as described at the top of this file.
+// If it fails, it records the error in ix.err.
+func (ix *IndexWriter) mergeSpill() {
+	// The levels never increase from the oldest file to the newest,
+	// so the files of each level are together.
+	// If no level has more than one file, all are merged.
+	i := len(ix.postFile) - 1
+	for {
+		j := i
+		for j > 0 && ix.postLevel[j-1] == ix.postLevel[i] {
+			j--
+		}
+		if j < i || j == 0 {
+			i = j
+			break
 		}
-		log.Fatalf("short write writing %s", w.Name())
+		i = j - 1
 	}
+	level := ix.postLevel[i] + 1
+	files := ix.postFile[i:]
 
-	ix.post = ix.post[:0]
+	w, err := ioutil.TempFile(ix.TempDir, "csearch-index")
+	if err != nil {
+		ix.err = err
+		return
+	}
+	if ix.Verbose {
+		log.Printf("merge %d spill files into %s", len(files), w.Name())
+	}
+	var h postHeap
+	for _, f := range files {
+		if err := h.addFile(f); err != nil {
+			ix.err = err
+			break
+		}
+	}
+	out := make([]postEntry, 0, postBuf)
+	for ix.err == nil && !h.empty() {
+		out = append(out, h.next())
+		if len(out) == cap(out) || h.empty() {
+			if _, err := w.Write(postBytes(out)); err != nil {
+				ix.err = err
+			}
+			out = out[:0]
+		}
+	}
+	h.close()
+	for _, f := range files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	ix.postFile = append(ix.postFile[:i], w)
+	ix.postLevel = append(ix.postLevel[:i], level)
 	w.Seek(0, 0)
-	ix.postFile = append(ix.postFile, w)
+}
+
+// postBytes returns the memory holding post as a byte slice.
+func postBytes(post []postEntry) []byte {
+	var b []byte
+	if len(post) == 0 {
+		return b
+	}
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data = uintptr(unsafe.Pointer(&post[0]))
+	h.Len = len(post) * 8
+	h.Cap = h.Len
+	return b
+}
+
+// bytesPost returns the memory holding data, whose length
+// is a multiple of 8, as a slice of post entries.
+func bytesPost(data []byte) []postEntry {
+	var m []postEntry
+	if len(data) == 0 {
+		return m
+	}
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&m))
+	h.Data = uintptr(unsafe.Pointer(&data[0]))
+	h.Len = len(data) / 8
+	h.Cap = h.Len
+	return m
 }
 
 // mergePost reads the flushed index entries and merges them
 // into posting lists, writing the resulting lists to out.
-func (ix *IndexWriter) mergePost(out *bufWriter) {
+func (ix *IndexWriter) mergePost(out *bufWriter) error {
 	var h postHeap
+	defer h.close()
 
 	log.Printf("merge %d files + mem", len(ix.postFile))
 	for _, f := range ix.postFile {
-		h.addFile(f)
+		if err := h.addFile(f); err != nil {
+			return err
+		}
 	}
 	sortPost(ix.post)
 	h.addMem(ix.post)
@@ -336,54 +984,146 @@ func (ix *IndexWriter) mergePost(out *bufWriter) {
 	npost := 0
 	e := h.next()
 	offset0 := out.offset()
+	var enc postEncoder
 	for {
 		npost++
-		offset := out.offset() - offset0
 		trigram := e.trigram()
 		ix.buf[0] = byte(trigram >> 16)
 		ix.buf[1] = byte(trigram >> 8)
 		ix.buf[2] = byte(trigram)
 
 		// posting list
-		fileid := ^uint32(0)
-		nfile := uint32(0)
-		runCount := uint32(0)
+		enc.init(out)
 		for ; e.trigram() == trigram && trigram != 1<<24-1; e = h.next() {
-			delta := e.fileid() - fileid
-			if delta != 1 {
-				if runCount > 0 {
-					out.writeUvarint(runCount)
-					nfile++
-					runCount = 0
-				}
-				out.writeUvarint(delta + 30)
-				nfile++
-			} else {
-				runCount++
-				if runCount == 31 {
-					out.writeUvarint(runCount)
-					nfile++
-					runCount = 0
-				}
-			}
-			fileid = e.fileid()
-		}
-		if runCount > 0 {
-			out.writeUvarint(runCount)
-			nfile++
-			runCount = 0
+			enc.add(e.fileid())
 		}
-		out.writeUvarint(0)
+		nfile, offset := enc.finish()
 
 		// index entry
 		ix.postIndex.write(ix.buf[:3])
 		ix.postIndex.writeUint32(nfile)
-		ix.postIndex.writeUint32(offset)
+		ix.postIndex.writeUint64(offset - offset0)
 
 		if trigram == 1<<24-1 {
 			break
 		}
 	}
+	return nil
+}
+
+// postBlockSize is the number of file IDs in each block of
+// a block-encoded posting list.  Lists with at most this many
+// file IDs are written as a single delta list.
+const postBlockSize = 256
+
+// A postEncoder writes a single posting list, in the form described
+// in read.go.  File IDs are collected into blocks of postBlockSize
+// before being encoded, so that the list can be written as a plain
+// delta list if it turns out to be short.
+type postEncoder struct {
+	out   *bufWriter
+	ids   []uint32 // file IDs of the current block
+	skip  []uint32 // first file ID and payload end offset of each block written
+	start uint64   // offset of the first block
+	count uint32   // number of file IDs added
+	raw   []byte   // scratch space for encoding a block
+	comp  []byte   // scratch space for compressing a block
+}
+
+func (e *postEncoder) init(out *bufWriter) {
+	e.out = out
+	e.ids = e.ids[:0]
+	e.skip = e.skip[:0]
+	e.count = 0
+}
+
+// empty reports whether no file IDs have been added since init.
+func (e *postEncoder) empty() bool {
+	return e.count == 0
+}
+
+// add appends fileid, which must be greater than any added before, to the list.
+func (e *postEncoder) add(fileid uint32) {
+	if len(e.ids) == postBlockSize {
+		e.writeBlock()
+	}
+	e.ids = append(e.ids, fileid)
+	e.count++
+}
+
+// writeBlock writes the pending file IDs as a block:
+// an encoding byte followed by the delta list of the IDs,
+// compressed with s2 if that makes it smaller.
+func (e *postEncoder) writeBlock() {
+	if len(e.skip) == 0 {
+		e.start = e.out.offset()
+	}
+	e.raw = appendDeltas(e.raw[:0], e.ids[0]-1, e.ids)
+	e.comp = s2.Encode(e.comp[:cap(e.comp)], e.raw)
+	if len(e.comp) < len(e.raw) {
+		e.out.writeByte(blockS2)
+		e.out.write(e.comp)
+	} else {
+		e.out.writeByte(blockRaw)
+		e.out.write(e.raw)
+	}
+	e.skip = append(e.skip, e.ids[0], uint32(e.out.offset()-e.start))
+	e.ids = e.ids[:0]
+}
+
+// finish writes the rest of the list.  It returns the number of
+// file IDs in the list and the offset to record in the posting
+// list index for it.
+func (e *postEncoder) finish() (count uint32, offset uint64) {
+	if len(e.skip) == 0 {
+		offset = e.out.offset()
+		e.raw = appendDeltas(e.raw[:0], ^uint32(0), e.ids)
+		e.raw = append(e.raw, 0)
+		e.out.write(e.raw)
+		return e.count, offset
+	}
+	if len(e.ids) > 0 {
+		e.writeBlock()
+	}
+	offset = e.out.offset()
+	for _, x := range e.skip {
+		e.out.writeUint32(x)
+	}
+	return e.count, offset
+}
+
+// appendDeltas appends to b the delta list encoding the file IDs
+// ids, which follow the file ID prev.  A varint n > 31 is a delta
+// of n-30 from the previous file ID, and a varint 1 <= n <= 31 is
+// a run of n consecutive file IDs.
+func appendDeltas(b []byte, prev uint32, ids []uint32) []byte {
+	run := uint64(0)
+	for _, id := range ids {
+		delta := id - prev
+		prev = id
+		if delta == 1 {
+			if run++; run < 31 {
+				continue
+			}
+		}
+		if run > 0 {
+			b = appendUvarint(b, run)
+			run = 0
+		}
+		if delta != 1 {
+			b = appendUvarint(b, uint64(delta)+30)
+		}
+	}
+	if run > 0 {
+		b = appendUvarint(b, run)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(b, tmp[:n]...)
 }
 
 // A postChunk represents a chunk of post entries flushed to disk or
@@ -398,12 +1138,29 @@ const postBuf = 4096
 // A postHeap is a heap (priority queue) of postChunks.
 type postHeap struct {
 	ch []*postChunk
+	mm []mmapData // mapped files, for close
+}
+
+func (h *postHeap) addFile(f *os.File) error {
+	mm, err := mmapFile(f)
+	if err != nil {
+		return err
+	}
+	if mm.d != nil {
+		h.mm = append(h.mm, mm)
+	}
+	h.addMem(bytesPost(mm.d))
+	return nil
 }
 
-func (h *postHeap) addFile(f *os.File) {
-	data := mmapFile(f).d
-	m := (*[npost]postEntry)(unsafe.Pointer(&data[0]))[:len(data)/8]
-	h.addMem(m)
+// close unmaps the files added to h.  The heap must not be used
+// after close.
+func (h *postHeap) close() {
+	for i := range h.mm {
+		unmmapFile(&h.mm[i])
+	}
+	h.mm = nil
+	h.ch = nil
 }
 
 func (h *postHeap) addMem(x []postEntry) {
@@ -512,29 +1269,42 @@ func (h *postHeap) siftUp(j int) {
 }
 
 // A bufWriter is a convenience wrapper: a closeable bufio.Writer.
+// Like a bufio.Writer, it stops writing after the first error,
+// which it records in err.
 type bufWriter struct {
-	name string
-	file *os.File
-	buf  []byte
-	tmp  [8]byte
+	name   string
+	file   *os.File
+	buf    []byte
+	tmp    [8]byte
+	err    error
+	crc    uint32 // CRC-32C of the data written since the last call to sum
+	summed int    // length of the prefix of buf already included in crc
 }
 
-// bufCreate creates a new file with the given name and returns a
-// corresponding bufWriter.  If name is empty, bufCreate uses a
-// temporary file.
-func bufCreate(name string) *bufWriter {
-	var (
-		f   *os.File
-		err error
-	)
-	if name != "" {
-		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	} else {
-		f, err = ioutil.TempFile("", "csearch")
+// bufCreate creates a new temporary file in the same directory as
+// name, so that commit can rename it to name, and returns a
+// corresponding bufWriter.  The other temporary files are made
+// with bufTemp.
+func bufCreate(name string) (*bufWriter, error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, err
 	}
+	return newBufWriter(f), nil
+}
+
+// bufTemp creates a new temporary file in dir, or the default
+// directory for temporary files if dir is empty, and returns
+// a corresponding bufWriter.
+func bufTemp(dir string) (*bufWriter, error) {
+	f, err := ioutil.TempFile(dir, "csearch")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return newBufWriter(f), nil
+}
+
+func newBufWriter(f *os.File) *bufWriter {
 	return &bufWriter{
 		name: f.Name(),
 		buf:  make([]byte, 0, 256<<10),
@@ -542,13 +1312,24 @@ func bufCreate(name string) *bufWriter {
 	}
 }
 
+// setErr records the error err from writing the file.
+func (b *bufWriter) setErr(err error) {
+	if b.err == nil {
+		b.err = fmt.Errorf("writing %s: %v", b.name, err)
+	}
+}
+
 func (b *bufWriter) write(x []byte) {
 	n := cap(b.buf) - len(b.buf)
 	if len(x) > n {
 		b.flush()
 		if len(x) >= cap(b.buf) {
+			if b.err != nil {
+				return
+			}
+			b.crc = crc32.Update(b.crc, castagnoli, x)
 			if _, err := b.file.Write(x); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
+				b.setErr(err)
 			}
 			return
 		}
@@ -556,6 +1337,16 @@ func (b *bufWriter) write(x []byte) {
 	b.buf = append(b.buf, x...)
 }
 
+// Write implements io.Writer, so that bufWriter can be the
+// destination of io.Copy.
+func (b *bufWriter) Write(x []byte) (int, error) {
+	b.write(x)
+	if b.err != nil {
+		return 0, b.err
+	}
+	return len(x), nil
+}
+
 func (b *bufWriter) writeByte(x byte) {
 	if len(b.buf) >= cap(b.buf) {
 		b.flush()
@@ -568,8 +1359,12 @@ func (b *bufWriter) writeString(s string) {
 	if len(s) > n {
 		b.flush()
 		if len(s) >= cap(b.buf) {
+			if b.err != nil {
+				return
+			}
+			b.crc = crc32.Update(b.crc, castagnoli, []byte(s))
 			if _, err := b.file.WriteString(s); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
+				b.setErr(err)
 			}
 			return
 		}
@@ -578,22 +1373,30 @@ func (b *bufWriter) writeString(s string) {
 }
 
 // offset returns the current write offset.
-func (b *bufWriter) offset() uint32 {
+func (b *bufWriter) offset() uint64 {
 	off, _ := b.file.Seek(0, 1)
-	off += int64(len(b.buf))
-	if int64(uint32(off)) != off {
-		log.Fatalf("index is larger than 4GB")
-	}
-	return uint32(off)
+	return uint64(off) + uint64(len(b.buf))
+}
+
+// sum returns the CRC-32C checksum of the data written since the
+// previous call to sum and starts a new checksum.
+func (b *bufWriter) sum() uint32 {
+	sum := crc32.Update(b.crc, castagnoli, b.buf[b.summed:])
+	b.crc = 0
+	b.summed = len(b.buf)
+	return sum
 }
 
 func (b *bufWriter) flush() {
 	if len(b.buf) == 0 {
 		return
 	}
-	_, err := b.file.Write(b.buf)
-	if err != nil {
-		log.Fatalf("writing %s: %v", b.name, err)
+	b.crc = crc32.Update(b.crc, castagnoli, b.buf[b.summed:])
+	b.summed = 0
+	if b.err == nil {
+		if _, err := b.file.Write(b.buf); err != nil {
+			b.setErr(err)
+		}
 	}
 	b.buf = b.buf[:0]
 }
@@ -606,6 +1409,29 @@ func (b *bufWriter) finish() *os.File {
 	return f
 }
 
+// commit flushes the file, closes it and renames it to name.
+// On failure, it removes the file.
+func (b *bufWriter) commit(name string) error {
+	b.flush()
+	err := b.err
+	if e := b.file.Close(); err == nil && e != nil {
+		err = fmt.Errorf("closing %s: %v", b.name, e)
+	}
+	if err == nil {
+		err = os.Rename(b.name, name)
+	}
+	if err != nil {
+		os.Remove(b.name)
+	}
+	return err
+}
+
+// remove closes and removes the file, unless commit has renamed it.
+func (b *bufWriter) remove() {
+	b.file.Close()
+	os.Remove(b.name)
+}
+
 func (b *bufWriter) writeTrigram(t uint32) {
 	if cap(b.buf)-len(b.buf) < 3 {
 		b.flush()
@@ -620,6 +1446,14 @@ func (b *bufWriter) writeUint32(x uint32) {
 	b.buf = append(b.buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
 }
 
+func (b *bufWriter) writeUint64(x uint64) {
+	if cap(b.buf)-len(b.buf) < 8 {
+		b.flush()
+	}
+	b.buf = append(b.buf, byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+		byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
 func (b *bufWriter) writeUvarint(x uint32) {
 	if cap(b.buf)-len(b.buf) < 5 {
 		b.flush()
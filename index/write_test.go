@@ -8,11 +8,16 @@ package index
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 var trivialFiles = map[string]string{
@@ -24,67 +29,189 @@ var trivialFiles = map[string]string{
 	"file5":    "\nxyzw\n",
 }
 
-var trivialIndex = join(
+// trivialSections is the list of paths through the posting list index
+// of the index of trivialFiles.
+var trivialSections = join(
+	// list of paths
+	"\x00",
+
+	// list of names, each preceded by its root number
+	"\x00afile4\x00",
+	"\x00f0\x00",
+	"\x00file1\x00",
+	"\x00file3\x00",
+	"\x00file5\x00",
+	"\x00thefile2\x00",
+	"\x00\x00",
+
+	// list of posting lists
+	fileList(2),    // file1
+	fileList(3, 5), // file3, thefile2
+	fileList(0),    // afile4
+	fileList(4),    // file5
+	fileList(5),    // thefile2
+	fileList(0, 3), // afile4, file3
+	fileList(0, 3), // afile4, file3
+	fileList(0),    // afile4
+	fileList(4),    // file5
+	fileList(4),    // file5
+	fileList(4),    // file5
+	fileList(),
+
+	// name index
+	u64(0),
+	u64(1+6+1),
+	u64(1+6+1+1+2+1),
+	u64(1+6+1+1+2+1+1+5+1),
+	u64(1+6+1+1+2+1+1+5+1+1+5+1),
+	u64(1+6+1+1+2+1+1+5+1+1+5+1+1+5+1),
+	u64(1+6+1+1+2+1+1+5+1+1+5+1+1+5+1+1+8+1),
+
+	// posting list index,
+	"\na\n", u32(1), u64(0),
+	"\nab", u32(2), u64(2),
+	"\nda", u32(1), u64(2+3),
+	"\nxy", u32(1), u64(2+3+2),
+	"ab\n", u32(1), u64(2+3+2+2),
+	"abc", u32(2), u64(2+3+2+2+2),
+	"bc\n", u32(2), u64(2+3+2+2+2+3),
+	"dab", u32(1), u64(2+3+2+2+2+3+3),
+	"xyz", u32(1), u64(2+3+2+2+2+3+3+2),
+	"yzw", u32(1), u64(2+3+2+2+2+3+3+2+2),
+	"zw\n", u32(1), u64(2+3+2+2+2+3+3+2+2+2),
+	"\xff\xff\xff", u32(0), u64(2+3+2+2+2+3+3+2+2+2+2),
+)
+
+var trivialIndex = trivialIndexInfo(join(
+	fileInfo(0, "\ndabc\n"), // afile4
+	fileInfo(0, "\n\n"),     // f0
+	fileInfo(0, "\na\n"),    // file1
+	fileInfo(0, "\nabc\n"),  // file3
+	fileInfo(0, "\nxyzw\n"), // file5
+	fileInfo(0, "\nab\n"),   // thefile2
+))
+
+// trivialIndexInfo returns the index of trivialFiles with the
+// given file info section.
+func trivialIndexInfo(info string) string {
+	s := trivialSections
+	return join(
+		// header
+		"csearch index 4\n",
+
+		trivialSections,
+
+		// file info
+		info,
+
+		// checksums
+		crc(s[:1]),
+		crc(s[1:1+45]),
+		crc(s[1+45:1+45+26]),
+		crc(s[1+45+26:1+45+26+56]),
+		crc(s[1+45+26+56:]),
+		crc(info),
+		u32(0), // checksums
+		u32(0), // tombstones
+		u32(0), // path options
+		u32(0), // documents
+		u32(0), // contents
+
+		// trailer
+		u64(16),
+		u64(16+1),
+		u64(16+1+45),
+		u64(16+1+45+26),
+		u64(16+1+45+26+56),
+		u64(16+1+45+26+56+180),
+		u64(16+1+45+26+56+180+uint64(len(info))),
+		u64(0),
+		u64(0),
+		u64(0),
+		u64(0),
+		u32(11),
+
+		"\ncsearch trail4\n",
+	)
+}
+
+// trivialIndexV3 is trivialIndex in the version 3 format, which
+// did not record file info and encoded all posting lists as delta lists.
+var trivialIndexV3 = join(
+	"csearch index 3\n",
+	trivialSections,
+	u64(16),
+	u64(16+1),
+	u64(16+1+45),
+	u64(16+1+45+26),
+	u64(16+1+45+26+56),
+	u32(5),
+	"\ncsearch trail3\n",
+)
+
+// trivialIndexV2 is trivialIndex in the version 2 format,
+// which used 4-byte offsets.
+var trivialIndexV2 = join(
 	// header
-	"csearch index 1\n",
+	"csearch index 2\n",
 
 	// list of paths
 	"\x00",
 
-	// list of names
-	"afile4\x00",
-	"f0\x00",
-	"file1\x00",
-	"file3\x00",
-	"file5\x00",
-	"thefile2\x00",
-	"\x00",
+	// list of names, each preceded by its root number
+	"\x00afile4\x00",
+	"\x00f0\x00",
+	"\x00file1\x00",
+	"\x00file3\x00",
+	"\x00file5\x00",
+	"\x00thefile2\x00",
+	"\x00\x00",
 
 	// list of posting lists
-	"\na\n", fileList(2), // file1
-	"\nab", fileList(3, 5), // file3, thefile2
-	"\nda", fileList(0), // afile4
-	"\nxy", fileList(4), // file5
-	"ab\n", fileList(5), // thefile2
-	"abc", fileList(0, 3), // afile4, file3
-	"bc\n", fileList(0, 3), // afile4, file3
-	"dab", fileList(0), // afile4
-	"xyz", fileList(4), // file5
-	"yzw", fileList(4), // file5
-	"zw\n", fileList(4), // file5
-	"\xff\xff\xff", fileList(),
+	fileList(2),    // file1
+	fileList(3, 5), // file3, thefile2
+	fileList(0),    // afile4
+	fileList(4),    // file5
+	fileList(5),    // thefile2
+	fileList(0, 3), // afile4, file3
+	fileList(0, 3), // afile4, file3
+	fileList(0),    // afile4
+	fileList(4),    // file5
+	fileList(4),    // file5
+	fileList(4),    // file5
+	fileList(),
 
 	// name index
 	u32(0),
-	u32(6+1),
-	u32(6+1+2+1),
-	u32(6+1+2+1+5+1),
-	u32(6+1+2+1+5+1+5+1),
-	u32(6+1+2+1+5+1+5+1+5+1),
-	u32(6+1+2+1+5+1+5+1+5+1+8+1),
+	u32(1+6+1),
+	u32(1+6+1+1+2+1),
+	u32(1+6+1+1+2+1+1+5+1),
+	u32(1+6+1+1+2+1+1+5+1+1+5+1),
+	u32(1+6+1+1+2+1+1+5+1+1+5+1+1+5+1),
+	u32(1+6+1+1+2+1+1+5+1+1+5+1+1+5+1+1+8+1),
 
 	// posting list index,
 	"\na\n", u32(1), u32(0),
-	"\nab", u32(2), u32(5),
-	"\nda", u32(1), u32(5+6),
-	"\nxy", u32(1), u32(5+6+5),
-	"ab\n", u32(1), u32(5+6+5+5),
-	"abc", u32(2), u32(5+6+5+5+5),
-	"bc\n", u32(2), u32(5+6+5+5+5+6),
-	"dab", u32(1), u32(5+6+5+5+5+6+6),
-	"xyz", u32(1), u32(5+6+5+5+5+6+6+5),
-	"yzw", u32(1), u32(5+6+5+5+5+6+6+5+5),
-	"zw\n", u32(1), u32(5+6+5+5+5+6+6+5+5+5),
-	"\xff\xff\xff", u32(0), u32(5+6+5+5+5+6+6+5+5+5+5),
+	"\nab", u32(2), u32(2),
+	"\nda", u32(1), u32(2+3),
+	"\nxy", u32(1), u32(2+3+2),
+	"ab\n", u32(1), u32(2+3+2+2),
+	"abc", u32(2), u32(2+3+2+2+2),
+	"bc\n", u32(2), u32(2+3+2+2+2+3),
+	"dab", u32(1), u32(2+3+2+2+2+3+3),
+	"xyz", u32(1), u32(2+3+2+2+2+3+3+2),
+	"yzw", u32(1), u32(2+3+2+2+2+3+3+2+2),
+	"zw\n", u32(1), u32(2+3+2+2+2+3+3+2+2+2),
+	"\xff\xff\xff", u32(0), u32(2+3+2+2+2+3+3+2+2+2+2),
 
 	// trailer
 	u32(16),
 	u32(16+1),
-	u32(16+1+38),
-	u32(16+1+38+62),
-	u32(16+1+38+62+28),
+	u32(16+1+45),
+	u32(16+1+45+26),
+	u32(16+1+45+26+28),
 
-	"\ncsearch trailr\n",
+	"\ncsearch trail2\n",
 )
 
 type fileData struct {
@@ -105,19 +232,57 @@ func u32(x uint32) string {
 	return string(buf[:])
 }
 
+func u64(x uint64) string {
+	return u32(uint32(x>>32)) + u32(uint32(x))
+}
+
+// crc returns the checksum of a section holding data.
+func crc(data string) string {
+	return u32(crc32.Checksum([]byte(data), castagnoli))
+}
+
+// fileInfo returns the file info record for a file with the
+// given modification time and content.
+func fileInfo(mtime int64, data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return u64(uint64(mtime)) + u64(uint64(len(data))) + string(sum[:])
+}
+
+// fileList returns the encoding of a posting list holding list:
+// deltas larger than 1 are stored as delta+30 and runs of deltas
+// of 1 as their length, up to 31.
 func fileList(list ...uint32) string {
 	var buf []byte
 
+	uvarint := func(x uint32) {
+		for x >= 0x80 {
+			buf = append(buf, byte(x)|0x80)
+			x >>= 7
+		}
+		buf = append(buf, byte(x))
+	}
 	last := ^uint32(0)
+	run := uint32(0)
 	for _, x := range list {
 		delta := x - last
-		for delta >= 0x80 {
-			buf = append(buf, byte(delta)|0x80)
-			delta >>= 7
+		if delta == 1 && run < 31 {
+			run++
+		} else {
+			if run > 0 {
+				uvarint(run)
+				run = 0
+			}
+			if delta == 1 {
+				run = 1
+			} else {
+				uvarint(delta + 30)
+			}
 		}
-		buf = append(buf, byte(delta))
 		last = x
 	}
+	if run > 0 {
+		uvarint(run)
+	}
 	buf = append(buf, 0)
 	return string(buf)
 }
@@ -137,7 +302,9 @@ func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fil
 	if doFlush {
 		ix.flushPost()
 	}
-	ix.Flush()
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func buildIndex(t *testing.T, name string, paths []string, fileData map[string]string) {
@@ -187,3 +354,512 @@ func TestHeap(t *testing.T) {
 		}
 	}
 }
+
+// writeDir writes files into dir, with the given modification time,
+// and returns an index of dir, reusing files from old if it is not nil.
+func writeDir(t *testing.T, dir string, files map[string]string, mtime time.Time, old *Index) (string, int) {
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		names = append(names, filepath.Join(dir, fi.Name()))
+	}
+
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	ix := Create(f.Name())
+	ix.AddPaths([]string{dir})
+	if old != nil {
+		ix.Reuse(old)
+	}
+	for _, name := range names {
+		ix.AddFile(0, name)
+	}
+	ix.Flush()
+	ix.Close()
+	return f.Name(), ix.NumReused()
+}
+
+func TestReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	files := manyFiles("", 600, func(i int) string {
+		return fmt.Sprintf("file %d\n", i%7)
+	})
+	first, _ := writeDir(t, dir, files, t1, nil)
+	defer os.Remove(first)
+
+	// Change, delete and add some files.
+	os.Remove(filepath.Join(dir, "f010"))
+	os.Remove(filepath.Join(dir, "f500"))
+	changed := map[string]string{
+		"f020": "changed\n",
+		"f021": "file 0\n", // same size, different time
+		"g000": "new file\n",
+	}
+	old := Open(first)
+	second, n := writeDir(t, dir, changed, t2, old)
+	old.Close()
+	defer os.Remove(second)
+	if want := 600 - 2 - 2; n != want {
+		t.Errorf("reused %d files, want %d", n, want)
+	}
+	full, _ := writeDir(t, dir, nil, t2, nil)
+	defer os.Remove(full)
+	data1, _ := ioutil.ReadFile(second)
+	data2, _ := ioutil.ReadFile(full)
+	if !bytes.Equal(data1, data2) {
+		i := 0
+		for i < len(data1) && i < len(data2) && data1[i] == data2[i] {
+			i++
+		}
+		t.Errorf("reused index differs from full index at %d of %d/%d", i, len(data1), len(data2))
+	}
+
+	// A file with the same time and size is not read again.
+	old = Open(second)
+	third, _ := writeDir(t, dir, map[string]string{"f030": "FILE 2\n"}, t1, old)
+	old.Close()
+	defer os.Remove(third)
+	ix := Open(third)
+	if l := ix.PostingList(tri('F', 'I', 'L')); len(l) != 0 {
+		t.Errorf("PostingList(FIL) = %v, want []", l)
+	}
+	ix.Close()
+}
+
+// tempDir makes a new directory the one used for temporary files
+// until the returned function is called.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, had := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	if os.TempDir() != dir {
+		os.RemoveAll(dir)
+		t.Skip("cannot change temporary directory")
+	}
+	return dir, func() {
+		if had {
+			os.Setenv("TMPDIR", old)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// checkEmpty checks that the directory dir holds only the given files.
+func checkEmpty(t *testing.T, dir string, keep ...string) {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+Files:
+	for _, fi := range infos {
+		for _, k := range keep {
+			if fi.Name() == k {
+				continue Files
+			}
+		}
+		t.Errorf("left behind %s", fi.Name())
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	out := filepath.Join(dir, "index")
+	if err := ioutil.WriteFile(out, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err := CreateE(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Add(-1, "a", strings.NewReader("hello"), 5)
+	ix.flushPost()
+	if ix.Add(-1, "b\x00", strings.NewReader("world"), 5) {
+		t.Errorf("Add with NUL in name succeeded")
+	}
+	if ix.Err() == nil {
+		t.Errorf("Err() = nil after Add with NUL in name")
+	}
+	if ix.Add(-1, "c", strings.NewReader("again"), 5) {
+		t.Errorf("Add after error succeeded")
+	}
+	if err := ix.Flush(); err == nil {
+		t.Errorf("Flush succeeded after error")
+	}
+	if data, _ := ioutil.ReadFile(out); string(data) != "old" {
+		t.Errorf("failed Flush changed index to %q", data)
+	}
+	checkEmpty(t, dir, "index")
+
+	// CreateE fails if the index directory does not exist,
+	// without leaving temporary files behind.
+	if _, err := CreateE(filepath.Join(dir, "missing", "index")); err == nil {
+		t.Errorf("CreateE in missing directory succeeded")
+	}
+	checkEmpty(t, dir, "index")
+}
+
+func TestMergeError(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	good := filepath.Join(dir, "good")
+	bad := filepath.Join(dir, "bad")
+	out := filepath.Join(dir, "out")
+	buildIndex(t, good, nil, trivialFiles)
+	// Unterminated varint in the first posting list.
+	b := []byte(trivialIndex)
+	for i := 62; i < 72; i++ {
+		b[i] = 0xff
+	}
+	if err := ioutil.WriteFile(bad, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Merge(out, good, bad)
+	if _, ok := err.(*CorruptError); !ok {
+		t.Errorf("Merge with corrupt index: err = %v, want CorruptError", err)
+	}
+	if err := Merge(out, good, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Merge with missing index succeeded")
+	}
+	checkEmpty(t, dir, "good", "bad")
+	if err := Merge(out, good, good); err != nil {
+		t.Errorf("Merge: %v", err)
+	}
+	checkEmpty(t, dir, "good", "bad", "out")
+
+	// A Merger makes its temporary files in its TempDir,
+	// not in the default directory for temporary files.
+	m := &Merger{TempDir: filepath.Join(dir, "missing")}
+	if err := m.Merge(out, good, good); err == nil {
+		t.Errorf("Merge with missing TempDir succeeded")
+	}
+	checkEmpty(t, dir, "good", "bad", "out")
+	m.TempDir = filepath.Join(dir, "tmp")
+	if err := os.Mkdir(m.TempDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+	if err := m.MergeMany(out, good, good); err != nil {
+		t.Errorf("Merge with TempDir: %v", err)
+	}
+	checkEmpty(t, m.TempDir)
+}
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	tmp := filepath.Join(dir, "tmp")
+	for _, d := range []string{src, tmp} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := manyFiles("", 300, func(i int) string {
+		return strings.Repeat(fmt.Sprintf("spill %d\n", i*i), i%20)
+	})
+	want, _ := writeDir(t, src, files, time.Now(), nil)
+	defer os.Remove(want)
+
+	// build builds the index of src with the given settings,
+	// checking the number of spill files as it goes.
+	build := func(bufSize, maxSpill int) {
+		out := filepath.Join(dir, "out")
+		ix := Create(out)
+		ix.PostBufSize = bufSize
+		ix.MaxSpillFiles = maxSpill
+		ix.TempDir = tmp
+		ix.AddPaths([]string{src})
+		max := 0
+		for i := 0; i < 300; i++ {
+			ix.AddFile(0, filepath.Join(src, fmt.Sprintf("f%03d", i)))
+			if n := len(ix.postFile); n > max {
+				max = n
+			}
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		what := fmt.Sprintf("index with PostBufSize=%d, MaxSpillFiles=%d", bufSize, maxSpill)
+		checkSameIndex(t, what, out, want)
+		if maxSpill == 0 && max < 10 {
+			t.Errorf("%s: only %d spill files", what, max)
+		}
+		if maxSpill >= 2 && max >= maxSpill {
+			t.Errorf("%s: %d spill files", what, max)
+		}
+		checkEmpty(t, tmp)
+	}
+	build(800, 0)
+	build(800, 2)
+	build(800, 5)
+	build(1<<20, 2)
+
+	ix := Create(filepath.Join(dir, "out"))
+	ix.TempDir = filepath.Join(dir, "missing")
+	if ix.AddFile(0, filepath.Join(src, "f001")) {
+		t.Errorf("AddFile with missing TempDir succeeded")
+	}
+	if err := ix.Flush(); err == nil {
+		t.Errorf("Flush with missing TempDir succeeded")
+	}
+}
+
+func TestPathOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	build := func(out string, opts map[string]string) {
+		ix := Create(out)
+		ix.AddPaths([]string{"/a", "/b"})
+		for p, o := range opts {
+			ix.SetPathOptions(p, o)
+		}
+		// Files of /b with lines longer than 10 bytes are skipped.
+		ix.SetRootLimits(1, Limits{1 << 20, 10, 100, 0})
+		for _, name := range []string{"/a/x", "/a/y", "/b/x", "/b/y"} {
+			data := "hello\n"
+			if strings.HasSuffix(name, "y") {
+				data = "hello, world\n"
+			}
+			r := strings.NewReader(data)
+			ix.Add(int(name[1]-'a'), name, r, int64(r.Len()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(name string, want ...string) {
+		t.Helper()
+		if problems, err := Verify(file(name)); err != nil || len(problems) != 0 {
+			t.Errorf("%s: Verify = %v, %v, want no problems", name, problems, err)
+		}
+		ix := Open(file(name))
+		defer ix.Close()
+		if opts := ix.PathOptions(); strings.Join(opts, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: PathOptions() = %q, want %q", name, opts, want)
+		}
+	}
+
+	build(file("plain"), nil)
+	check("plain", "", "")
+	ix := Open(file("plain"))
+	var names []string
+	for id := 0; id < ix.numName; id++ {
+		names = append(names, ix.Name(uint32(id)))
+	}
+	ix.Close()
+	if want := "/a/x /a/y /b/x"; strings.Join(names, " ") != want {
+		t.Errorf("names = %v, want %s", names, want)
+	}
+
+	build(file("opts1"), map[string]string{"/a": "-x=1"})
+	check("opts1", "-x=1", "")
+	build(file("opts2"), map[string]string{"/b": "-y=2"})
+	check("opts2", "", "-y=2")
+
+	// Merge takes the options of each path from the last index.
+	if err := Merge(file("merged"), file("opts1"), file("opts2")); err != nil {
+		t.Fatal(err)
+	}
+	check("merged", "", "-y=2")
+
+	// Remove keeps them.
+	if _, err := Remove(file("removed"), file("opts2"), []string{"/a/x"}); err != nil {
+		t.Fatal(err)
+	}
+	check("removed", "", "-y=2")
+
+	ixw := Create(file("bad"))
+	ixw.AddPaths([]string{"/a"})
+	ixw.SetPathOptions("/a", "x\x00y")
+	if err := ixw.Flush(); err == nil {
+		t.Errorf("Flush with NUL in path options succeeded")
+	}
+}
+
+func TestNameOutsideRoot(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	defer os.Remove(f.Name())
+	ix := Create(f.Name())
+	ix.AddPaths([]string{"/a"})
+	for _, name := range []string{"/a/x", "/b/y"} {
+		r := strings.NewReader("hello\n")
+		ix.Add(0, name, r, int64(r.Len()))
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rix := Open(f.Name())
+	defer rix.Close()
+	for id, want := range []string{"/a/x", "/b/y"} {
+		if name := rix.Name(uint32(id)); name != want {
+			t.Errorf("Name(%d) = %q, want %q", id, name, want)
+		}
+	}
+}
+
+func TestReuseDocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0777)
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := manyFiles(src, 300, func(i int) string {
+		return fmt.Sprintf("file %d\n", i%7)
+	})
+	for name, data := range files {
+		ioutil.WriteFile(name, []byte(data), 0666)
+		os.Chtimes(name, t1, t1)
+	}
+	build := func(out string, dedup bool, old *Index) {
+		ix := Create(out)
+		ix.Dedup = dedup
+		ix.AddPaths([]string{src})
+		if old != nil {
+			ix.Reuse(old)
+		}
+		infos, _ := ioutil.ReadDir(src)
+		for _, fi := range infos {
+			ix.AddFile(0, filepath.Join(src, fi.Name()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if old != nil && ix.NumReused() == 0 {
+			t.Errorf("no files reused")
+		}
+	}
+	old := filepath.Join(dir, "old")
+	build(old, true, nil)
+
+	// The documents change, so the reused trigrams
+	// are found through copies of them.
+	for i := 0; i < 7; i++ {
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("f%03d", i)), []byte("changed\n"), 0666)
+	}
+	for _, dedup := range []bool{true, false} {
+		reused := filepath.Join(dir, "reused")
+		full := filepath.Join(dir, "full")
+		ix := Open(old)
+		build(reused, dedup, ix)
+		ix.Close()
+		build(full, dedup, nil)
+		checkSameIndex(t, fmt.Sprintf("reused index (dedup %v)", dedup), reused, full)
+	}
+}
+
+func TestContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0777)
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := manyFiles(src, 50, func(i int) string {
+		return strings.Repeat(fmt.Sprintf("file %d\n", i%5), i+1)
+	})
+	for name, data := range files {
+		ioutil.WriteFile(name, []byte(data), 0666)
+		os.Chtimes(name, t1, t1)
+	}
+	build := func(out string, store bool, old *Index) *IndexWriter {
+		ix := Create(out)
+		ix.Dedup = true
+		ix.StoreContents = store
+		ix.AddPaths([]string{src})
+		if old != nil {
+			ix.Reuse(old)
+		}
+		infos, _ := ioutil.ReadDir(src)
+		for _, fi := range infos {
+			ix.AddFile(0, filepath.Join(src, fi.Name()))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return ix
+	}
+	check := func(file string) {
+		if problems, err := Verify(file); err != nil || len(problems) != 0 {
+			t.Errorf("Verify(%s) = %v, %v, want no problems", file, problems, err)
+		}
+		ix := Open(file)
+		defer ix.Close()
+		if !ix.HasContents() {
+			t.Errorf("%s: no contents", file)
+		}
+		for id := uint32(0); id < uint32(ix.numName); id++ {
+			name := ix.Name(id)
+			want, _ := ioutil.ReadFile(name)
+			if data, ok := ix.Contents(id); !ok || string(data) != string(want) {
+				t.Errorf("%s: Contents(%s) = %.20q, %v, want %.20q", file, name, data, ok, want)
+			}
+		}
+	}
+	plain := filepath.Join(dir, "plain")
+	build(plain, false, nil)
+	if ix := Open(plain); ix.HasContents() {
+		t.Errorf("index without StoreContents has contents")
+	}
+	old := filepath.Join(dir, "old")
+	build(old, true, nil)
+	check(old)
+
+	for i := 0; i < 5; i++ {
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("f%03d", i)), []byte("changed\n"), 0666)
+	}
+	full := filepath.Join(dir, "full")
+	build(full, true, nil)
+	check(full)
+	for _, from := range []string{old, plain} {
+		reused := filepath.Join(dir, "reused")
+		ix := Open(from)
+		w := build(reused, true, ix)
+		ix.Close()
+		// The files of an index without contents must be read again.
+		if n := w.NumReused(); n == 0 && from == old || n != 0 && from == plain {
+			t.Errorf("reusing %s: reused %d files", filepath.Base(from), n)
+		}
+		checkSameIndex(t, "index reusing "+filepath.Base(from), reused, full)
+	}
+}
@@ -12,10 +12,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"os"
 	"regexp/syntax"
 	"sort"
+	"strconv"
 
+	"github.com/waddyano/codesearch/archive"
+	"github.com/waddyano/codesearch/git"
 	"github.com/waddyano/codesearch/sparse"
 )
 
@@ -362,6 +364,14 @@ type Grep struct {
 	N bool // N flag - print line numbers
 	H bool // H flag - do not print file names
 
+	// Collapse reports the matches in a group of identical files
+	// (see Group) only in the first, noting the number of others.
+	Collapse bool
+
+	// Open, if not nil, opens the files that File and Group
+	// search, in place of opening the files themselves.
+	Open func(name string) (io.ReadCloser, error)
+
 	Done                 bool
 	lines_printed        int64 // running match count
 	max_print_lines      int64 // Max match count
@@ -380,14 +390,40 @@ func (g *Grep) AddFlags() {
 	flag.BoolVar(&g.H, "h", false, "omit file names")
 }
 
+// File searches the file with the given name, which may be
+// the virtual path of a file in an archive (see package archive)
+// or in a git revision (see package git).
 func (g *Grep) File(name string) {
-	f, err := os.Open(name)
+	g.Group([]string{name})
+}
+
+// Group searches the files with the given names, which have the
+// same contents (see index.Set.PostingGroups), reading only the first
+// that can be opened.  It reports the matches in each of the files
+// or, if g.Collapse is set, only in the first.
+func (g *Grep) Group(names []string) {
+	open := openFile
+	if g.Open != nil {
+		open = g.Open
+	}
+	f, err := open(names[0])
 	if err != nil {
 		fmt.Fprintf(g.Stderr, "%s\n", err)
+		if len(names) > 1 {
+			g.Group(names[1:])
+		}
 		return
 	}
 	defer f.Close()
-	g.Reader(f, name)
+	g.reader(f, names)
+}
+
+// openFile opens the file with the given name for File.
+func openFile(name string) (io.ReadCloser, error) {
+	if _, _, _, ok := git.SplitPinned(name); ok {
+		return git.Open(name)
+	}
+	return archive.Open(name)
 }
 
 func (g *Grep) LimitPrintCount(globalLimit int64, fileLimit int64) {
@@ -418,7 +454,24 @@ func countNL(b []byte) int {
 	return n
 }
 
+// print prints a line of output and reports whether
+// that reaches the limit on the number of lines printed.
+func (g *Grep) print(format string, args ...interface{}) bool {
+	fmt.Fprintf(g.Stdout, format, args...)
+	g.lines_printed++
+	if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
+		g.Done = true
+	}
+	return g.Done
+}
+
+// Reader searches r, reporting the matches as being in the file name.
 func (g *Grep) Reader(r io.Reader, name string) {
+	g.reader(r, []string{name})
+}
+
+// reader searches r, the contents of the files names.
+func (g *Grep) reader(r io.Reader, names []string) {
 	if g.Done {
 		return
 	}
@@ -430,18 +483,33 @@ func (g *Grep) Reader(r io.Reader, name string) {
 		needLineno           = g.N
 		lineno               = 1
 		count                = 0
+		name                 = names[0]
+		copies               = names[1:]
+		label                = name
 		prefix               = ""
 		beginText            = true
 		endText              = false
 		outSep               = '\n'
 		printedForFile int64 = 0
 	)
-	if !g.H {
-		prefix = name + ":"
-	}
+	var lines []string // lines printed, to print again for copies
 	if g.L && g.Z {
 		outSep = '\x00'
 	}
+	if g.Collapse && len(copies) > 0 {
+		if outSep == '\n' {
+			what := "copies"
+			if len(copies) == 1 {
+				what = "copy"
+			}
+			label = fmt.Sprintf("%s (+%d identical %s)", name, len(copies), what)
+		}
+		copies = nil
+	}
+	if !g.H {
+		prefix = label + ":"
+	}
+scan:
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
@@ -463,10 +531,13 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			}
 			g.Match = true
 			if g.L {
-				fmt.Fprintf(g.Stdout, "%s%c", name, outSep)
-				g.lines_printed++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
+				if g.print("%s%c", label, outSep) {
+					return
+				}
+				for _, c := range copies {
+					if g.print("%s%c", c, outSep) {
+						return
+					}
 				}
 				return
 			}
@@ -483,30 +554,22 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			if len(line) == 0 || line[len(line)-1] != '\n' {
 				nl = "\n"
 			}
-			switch {
-			case g.C:
+			if g.C {
 				count++
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s%s", prefix, lineno, line, nl)
-				g.lines_printed++
-				printedForFile++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
-					return
+			} else {
+				text := string(line) + nl
+				if g.N {
+					text = strconv.Itoa(lineno) + ":" + text
 				}
-				if g.maxPrintLinesPerFile > 0 && printedForFile >= g.maxPrintLinesPerFile {
+				if g.print("%s%s", prefix, text) {
 					return
 				}
-			default:
-				fmt.Fprintf(g.Stdout, "%s%s%s", prefix, line, nl)
-				g.lines_printed++
-				printedForFile++
-				if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-					g.Done = true
-					return
+				if len(copies) > 0 {
+					lines = append(lines, text)
 				}
+				printedForFile++
 				if g.maxPrintLinesPerFile > 0 && printedForFile >= g.maxPrintLinesPerFile {
-					return
+					break scan
 				}
 			}
 			if needLineno {
@@ -528,11 +591,23 @@ func (g *Grep) Reader(r io.Reader, name string) {
 		}
 	}
 	if g.C && count > 0 {
-		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
-		g.lines_printed++
-		if g.max_print_lines > 0 && g.lines_printed >= g.max_print_lines {
-			g.Done = true
+		if g.print("%s: %d\n", label, count) {
 			return
 		}
+		for _, c := range copies {
+			if g.print("%s: %d\n", c, count) {
+				return
+			}
+		}
+	}
+	for _, c := range copies {
+		if !g.H {
+			prefix = c + ":"
+		}
+		for _, text := range lines {
+			if g.print("%s%s", prefix, text) {
+				return
+			}
+		}
 	}
 }
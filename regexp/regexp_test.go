@@ -219,3 +219,44 @@ func TestGrep(t *testing.T) {
 		}
 	}
 }
+
+var groupTests = []struct {
+	s   string
+	out string
+	g   Grep
+}{
+	{s: "abc\ndef\nghalloo\n", out: "a:abc\na:ghalloo\nb:abc\nb:ghalloo\nc:abc\nc:ghalloo\n"},
+	{s: "abc\ndef\nghalloo\n", out: "a (+2 identical copies):abc\na (+2 identical copies):ghalloo\n", g: Grep{Collapse: true}},
+	{s: "abc\n", out: "a\nb\nc\n", g: Grep{L: true}},
+	{s: "abc\n", out: "a (+2 identical copies)\n", g: Grep{L: true, Collapse: true}},
+	{s: "abc\n", out: "a\x00", g: Grep{L: true, Z: true, Collapse: true}},
+	{s: "abc\nabc\n", out: "a: 2\nb: 2\nc: 2\n", g: Grep{C: true}},
+	{s: "abc\ndef\nabc\n", out: "1:abc\n3:abc\n1:abc\n3:abc\n1:abc\n3:abc\n", g: Grep{N: true, H: true}},
+}
+
+func TestGrepGroup(t *testing.T) {
+	re, err := Compile("(?m)a+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range groupTests {
+		g := tt.g
+		g.Regexp = re
+		var out bytes.Buffer
+		g.Stdout = &out
+		g.reader(strings.NewReader(tt.s), []string{"a", "b", "c"})
+		if out.String() != tt.out {
+			t.Errorf("#%d: grep(%q) = %q, want %q", i, tt.s, out.String(), tt.out)
+		}
+	}
+
+	// The output limit counts the lines printed for each copy.
+	g := Grep{Regexp: re}
+	var out bytes.Buffer
+	g.Stdout = &out
+	g.LimitPrintCount(3, 0)
+	g.reader(strings.NewReader("abc\ndef\nghalloo\n"), []string{"a", "b", "c"})
+	if want := "a:abc\na:ghalloo\nb:abc\n"; out.String() != want || !g.Done {
+		t.Errorf("grep with limit 3 = %q, done %v, want %q, true", out.String(), g.Done, want)
+	}
+}